@@ -1,18 +1,34 @@
 package main
 
 import (
+	_ "expvar" // serves the telemetry at /debug/vars
+	"flag"
 	"fmt"
 	"goPiCopter/imus"
 	"goPiCopter/io"
+	"goPiCopter/io/sensors/i2c"
 	"math"
+	"net/http"
+	"os"
 	"time"
 )
 
+var (
+	busNumber = flag.Uint("bus", 1, "i2c bus the sensors are on, the first RaspberryPis use bus 0")
+	record    = flag.String("record", "", "record every i2c transaction to this file")
+	replay    = flag.String("replay", "", "replay the i2c transactions recorded in this file instead of reading the sensors")
+	drdy      = flag.Bool("drdy", true, "sample the gyroscope and accelerometer on their data ready interrupts, not when recording or replaying")
+	board     = flag.String("board", io.BOARD_ADAFRUIT, "the sensor board, adafruit for the L3GD20 and LSM303, mpu6050 or mpu9250")
+	telemetry = flag.String("telemetry", "localhost:8043", "serve the telemetry, such as the i2c transaction counters, at /debug/vars on this address, empty for none")
+)
+
 /**
 * Remotely control a quadcopter using a RaspberryPi as
 * the on board computer, reading the sensors and computing
 * how much power to apply to the motors. The current implementation
-* uses three sensors (gyroscope, accelerometer, and magnetometer).
+* uses three sensors (gyroscope, accelerometer, and magnetometer), on
+* the board -board says.
+* Run "goPiCopter scan" to find out which sensors are attached.
 **/
 func main() {
 	const (
@@ -20,7 +36,11 @@ func main() {
 		r2d = 180.0 / math.Pi // Used to convert radians to degrees
 	)
 	var (
-		imu *imus.ImuMayhony
+		imu      *imus.ImuMayhony
+		bus      i2c.Transport
+		clock    func() int64
+		err      error
+		ok       bool
 		sData    io.SensorData
 		cData    io.CmdData
 		i        int // number of iterations in the for loop
@@ -33,22 +53,54 @@ func main() {
 		roll     float32
 	)
 
-	imu = imus.NewImuMayhony()
+	flag.Parse()
+	if flag.Arg(0) == "scan" {
+		scan(flag.Args()[1:])
+		return
+	}
+	io.SENSOR_BOARD = *board
+
+	bus, clock, err = sensorBus(byte(*busNumber), *record, *replay)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	imu = imus.NewImuMayhonyAt(clock())
 	sensorChannel := make(chan io.SensorData)
 	cmdChannel := make(chan io.CmdData)
 
-	go io.ReadSensors(sensorChannel)
+	if *drdy && *record == "" && *replay == "" {
+		if gyroLine, accelLine, err := io.OpenDataReadyLines(); err == nil {
+			go io.ReadSensorsOnLines(bus, gyroLine, accelLine, sensorChannel)
+		} else {
+			fmt.Printf("No data ready interrupts, polling the sensors, err=%v\n", err)
+			go io.ReadSensorsOn(bus, sensorChannel)
+		}
+	} else {
+		go io.ReadSensorsOn(bus, sensorChannel)
+	}
 
 	go io.ReadCommands(cmdChannel)
 
+	if *telemetry != "" {
+		go func() {
+			fmt.Printf("Telemetry stopped, err=%v\n", http.ListenAndServe(*telemetry, nil))
+		}()
+	}
+
 	second = int64(time.Second)
-	lastTime = time.Now().UnixNano()
+	lastTime = clock()
 	for {
 		select {
-		case sData = <-sensorChannel:
+		case sData, ok = <-sensorChannel:
+			if !ok {
+				fmt.Printf("Sensors stopped\n")
+				return
+			}
 			yaw, pitch, roll = imu.Update(sData.When, sData.Gx*d2r, sData.Gy*d2r, sData.Gz*d2r, sData.Ax, sData.Ay, sData.Az, sData.Mx, sData.My, sData.Mz)
 			i++
-			now = time.Now().UnixNano()
+			now = sData.When
 			if (now - lastTime) >= second {
 				cnt++
 				fmt.Printf("%d YPR(%10.5f, %10.5f, %10.5f)\n", cnt, yaw*r2d, pitch*r2d, roll*r2d)
@@ -59,3 +111,37 @@ func main() {
 		}
 	}
 }
+
+/**
+* Return the bus the sensors are on, and the clock that goes with it.
+* Optionally record every transaction on the bus, or replay a recording
+* in place of the bus.  A recording is flushed to its file every second.
+**/
+func sensorBus(busNumber byte, record, replay string) (bus i2c.Transport, clock func() int64, err error) {
+	var (
+		file *os.File
+		rec  *i2c.Recorder
+		rp   *i2c.Replay
+	)
+	clock = func() int64 { return time.Now().UnixNano() }
+	if replay != "" {
+		if file, err = os.Open(replay); err == nil {
+			if rp, err = i2c.NewReplay(file); err == nil {
+				bus, clock = rp, rp.Now
+			}
+		}
+		return
+	}
+
+	if bus, err = i2c.Bus(busNumber); err != nil {
+		return
+	}
+	if record != "" {
+		if file, err = os.Create(record); err == nil {
+			if rec, err = i2c.NewRecorder(bus, file); err == nil {
+				bus, clock = rec, rec.Now
+			}
+		}
+	}
+	return
+}
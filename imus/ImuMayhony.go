@@ -21,8 +21,18 @@ type ImuMayhony struct {
 * Create a new ImuMayhony struct, and initialize it
 **/
 func NewImuMayhony() (imu *ImuMayhony) {
+	imu = NewImuMayhonyAt(time.Now().UnixNano())
+	return
+}
+
+/**
+* Create a new ImuMayhony struct, initialized as of the given time
+* in nanoseconds.  Replaying recorded sensor data has to start the
+* filter at the recorded time to reproduce the recorded results.
+**/
+func NewImuMayhonyAt(when int64) (imu *ImuMayhony) {
 	imu = new(ImuMayhony)
-	imu.lastUpdate = time.Now().UnixNano()
+	imu.lastUpdate = when
 	imu.q0 = 1.0
 	imu.twoKp = 2.0 * 0.5
 	imu.twoKi = 2.0 * 0.1
@@ -1,11 +1,80 @@
 package io
 
 import (
+	"errors"
 	"fmt"
 	"goPiCopter/io/sensors"
+	"goPiCopter/io/sensors/gpio"
+	"goPiCopter/io/sensors/i2c"
+	"sync"
 	"time"
 )
 
+const (
+	// How long each sensor's transactions may take, from being queued
+	// on the scheduler to finishing, before counting as a missed deadline
+	GYRO_DEADLINE  = 2 * time.Millisecond
+	ACCEL_DEADLINE = 5 * time.Millisecond
+	MAG_DEADLINE   = 20 * time.Millisecond
+	// The magnetometer is read at 10Hz, every 5th summary
+	MAG_PERIOD = time.Second / 10
+	// How long to leave a gyroscope with a FIFO between bursts, a 32
+	// sample FIFO at 95Hz, or the accelerometer's at 100Hz, is full
+	// after a third of a second
+	FIFO_PERIOD = 5 * time.Millisecond
+	// How many times setup tries a sensor it couldn't reach, and how
+	// long it waits between tries
+	SETUP_ATTEMPTS    = 3
+	SETUP_RETRY_DELAY = 100 * time.Millisecond
+	// How long to wait for a data ready edge, a few sample periods, before
+	// taking it the edge was missed and reading the sensor anyway
+	DRDY_TIMEOUT = 50 * time.Millisecond
+	// How many timeouts, with no edge on either line, before giving up on them
+	DRDY_GIVE_UP = 10
+)
+
+// The GPIO lines the chips' interrupt pins are wired to, the gyroscope's
+// DRDY/INT2 to BCM 17 and the accelerometer's INT1 to BCM 27, on the
+// RaspberryPi's gpiochip0
+var (
+	DRDY_CHIP       uint32 = 0
+	GYRO_DRDY_LINE  uint32 = 17
+	ACCEL_DRDY_LINE uint32 = 27
+)
+
+// How the accelerometer is set up, 12 bits at 100Hz, +/-4g leaves
+// headroom for the frame's vibration
+var ACCEL_CONFIG = sensors.LSM303ACCELConfig{
+	DataRate:        100,
+	Range:           sensors.LSM303ACCEL_RANGE_4G,
+	HighResolution:  true,
+	BlockDataUpdate: true,
+}
+
+// The sensor boards setup knows
+const (
+	BOARD_ADAFRUIT = "adafruit" // Adafruit's 10-DOF, the L3GD20 and LSM303
+	BOARD_MPU6050  = "mpu6050"
+	BOARD_MPU9250  = "mpu9250"
+)
+
+// Which board the sensors are on
+var SENSOR_BOARD = BOARD_ADAFRUIT
+
+// How an MPU is set up, and mounted on the board
+var (
+	MPU_CONFIG      = sensors.DefaultMPU6050Config
+	MPU_ORIENTATION = sensors.NoRotation
+)
+
+// How the chips are mounted on the board, the gyroscope's X and Y are
+// swapped on the original layout.  Other layouts only need these changing.
+var (
+	GYRO_ORIENTATION  = sensors.Orientation{{0, 1, 0}, {1, 0, 0}, {0, 0, 1}}
+	ACCEL_ORIENTATION = sensors.NoRotation
+	MAG_ORIENTATION   = sensors.NoRotation
+)
+
 type Sensors struct {
 }
 
@@ -13,33 +82,159 @@ type SensorData struct {
 	When       int64
 	Count      int     // number of samples taken
 	Gx, Gy, Gz float32 // Gyroscope data
-	Ax, Ay, Az float32 // Accelerometer data
+	Ax, Ay, Az float32 // Accelerometer data, m/s^2
 	Mx, My, Mz float32 // Magnetometer data
 }
 
 /**
-* Setup the sensors
+* Construct a sensor's driver, trying again unless the chip is missing
+* or isn't the right one, which trying again won't fix
+**/
+func construct(name string, build func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = build()
+		if err == nil || errors.Is(err, sensors.ErrNotPresent) || errors.Is(err, sensors.ErrWrongChip) || attempt == SETUP_ATTEMPTS {
+			return
+		}
+		fmt.Printf("Setup: %s failed, trying again, err=%v\n", name, err)
+		time.Sleep(SETUP_RETRY_DELAY)
+	}
+}
+
+/**
+* Run the sensor's self-test, if it has one, and print the report.  A
+* sensor that fails it is as good as missing.
+**/
+func preflight(sensor sensors.Sensor) (err error) {
+	tester, ok := sensor.(sensors.SelfTester)
+	if !ok {
+		return
+	}
+	var report sensors.SelfTestReport
+	if report, err = tester.SelfTest(); err != nil {
+		return
+	}
+	fmt.Printf("Preflight: %v\n", report)
+	if !report.Pass {
+		err = fmt.Errorf("%s failed its self-test", report.Driver)
+	}
+	return
+}
+
+/**
+* Setup the sensors on SENSOR_BOARD, each on its own handle to the bus,
+* and self-test them.  There's no flying without the gyroscope and
+* accelerometer, but without the magnetometer there's only no heading,
+* so it's left nil.
+**/
+func setup(gyroBus, accelBus, magBus i2c.Transport) (gyroscope sensors.Gyroscope, accelerometer sensors.Accelerometer, magnetometer sensors.Magnetometer, err error) {
+	fmt.Printf("Setup %s...\n", SENSOR_BOARD)
+	switch SENSOR_BOARD {
+	case BOARD_ADAFRUIT:
+		gyroscope, accelerometer, magnetometer, err = setupAdafruit(gyroBus, accelBus, magBus)
+	case BOARD_MPU6050, BOARD_MPU9250:
+		// one chip, the gyroscope's and accelerometer's samples come together
+		gyroscope, accelerometer, magnetometer, err = setupMPU(gyroBus, magBus)
+	default:
+		err = fmt.Errorf("unknown sensor board %q", SENSOR_BOARD)
+		fmt.Printf("Error: %v\n", err)
+	}
+	//err = calibrate(gyroscope, accelerometer)
+	//if err != nil {
+	//	fmt.Printf("Error: %v\n", err)
+	//}
+	return
+}
+
+/**
+* Setup the Adafruit board's L3GD20 and LSM303
 **/
-func setup() (gyroscope *sensors.L3GD20, accelerometer *sensors.LSM303ACCEL, magnetometer *sensors.LSM303MAG, err error) {
-	fmt.Printf("Setup...\n")
-	gyroscope, err = sensors.NewL3GD20()
+func setupAdafruit(gyroBus, accelBus, magBus i2c.Transport) (gyroscope sensors.Gyroscope, accelerometer sensors.Accelerometer, magnetometer sensors.Magnetometer, err error) {
+	err = construct("L3GD20", func() (err error) {
+		var gyro *sensors.L3GD20
+		if gyro, err = sensors.NewL3GD20With(sensors.WithTransport(gyroBus), sensors.WithOrientation(GYRO_ORIENTATION)); err == nil {
+			gyroscope = gyro
+		}
+		return
+	})
 	if err != nil {
 		fmt.Printf("Error: getting device L3GD20, err=%v\n", err)
-	} else {
-		accelerometer, err = sensors.NewLSM303ACCEL()
-		if err != nil {
-			fmt.Printf("Error: getting device LSM303ACCEL, err=%v\n", err)
-		} else {
-			magnetometer, err = sensors.NewLSM303MAG()
-			if err != nil {
-				fmt.Printf("Error: getting device LSM303MAG, err=%v\n", err)
-				//} else {
-				//	err = calibrate(gyroscope, accelerometer)
-				//	if err != nil {
-				//		fmt.Printf("Error: %v\n", err)
-				//	}
+		return
+	}
+	if err = preflight(gyroscope); err != nil {
+		fmt.Printf("Error: preflight L3GD20, err=%v\n", err)
+		return
+	}
+	err = construct("LSM303ACCEL", func() (err error) {
+		var accel *sensors.LSM303ACCEL
+		if accel, err = sensors.NewLSM303ACCELWith(sensors.WithTransport(accelBus), sensors.WithOrientation(ACCEL_ORIENTATION)); err == nil {
+			if err = accel.Configure(ACCEL_CONFIG); err == nil {
+				accelerometer = accel
 			}
 		}
+		return
+	})
+	if err != nil {
+		fmt.Printf("Error: getting device LSM303ACCEL, err=%v\n", err)
+		return
+	}
+	if err = preflight(accelerometer); err != nil {
+		fmt.Printf("Error: preflight LSM303ACCEL, err=%v\n", err)
+		return
+	}
+	err = construct("LSM303MAG", func() (err error) {
+		var mag *sensors.LSM303MAG
+		if mag, err = sensors.NewLSM303MAGWith(sensors.WithTransport(magBus), sensors.WithOrientation(MAG_ORIENTATION)); err == nil {
+			magnetometer = mag
+		}
+		return
+	})
+	if err == nil {
+		err = preflight(magnetometer)
+	}
+	if err != nil {
+		fmt.Printf("Error: getting device LSM303MAG, carrying on without it, err=%v\n", err)
+		magnetometer, err = nil, nil
+	}
+	return
+}
+
+/**
+* Setup an MPU-6050, or an MPU-9250 and its AK8963.  The gyroscope and
+* accelerometer are views onto the one chip, both read on the gyroscope's
+* handle to the bus.
+**/
+func setupMPU(gyroBus, magBus i2c.Transport) (gyroscope sensors.Gyroscope, accelerometer sensors.Accelerometer, magnetometer sensors.Magnetometer, err error) {
+	var mpu *sensors.MPU6050
+	name := "MPU6050"
+	newMPU := sensors.NewMPU6050With
+	if SENSOR_BOARD == BOARD_MPU9250 {
+		name, newMPU = "MPU9250", sensors.NewMPU9250With
+	}
+	err = construct(name, func() (err error) {
+		if mpu, err = newMPU(sensors.WithTransport(gyroBus), sensors.WithOrientation(MPU_ORIENTATION)); err == nil {
+			err = mpu.Configure(MPU_CONFIG)
+		}
+		return
+	})
+	if err != nil {
+		fmt.Printf("Error: getting device %s, err=%v\n", name, err)
+		return
+	}
+	gyroscope, accelerometer = mpu.Gyroscope(), mpu.Accelerometer()
+	if SENSOR_BOARD != BOARD_MPU9250 {
+		return
+	}
+	err = construct("AK8963", func() (err error) {
+		var mag *sensors.AK8963
+		if mag, err = mpu.Magnetometer(sensors.WithTransport(magBus)); err == nil {
+			magnetometer = mag
+		}
+		return
+	})
+	if err != nil {
+		fmt.Printf("Error: getting device AK8963, carrying on without it, err=%v\n", err)
+		magnetometer, err = nil, nil
 	}
 	return
 }
@@ -47,7 +242,7 @@ func setup() (gyroscope *sensors.L3GD20, accelerometer *sensors.LSM303ACCEL, mag
 /**
 * Calibrate the sensors
 **/
-func calibrate(gyroscope *sensors.L3GD20, accelerometer *sensors.LSM303ACCEL) (err error) {
+func calibrate(gyroscope sensors.Gyroscope, accelerometer sensors.Accelerometer) (err error) {
 	const (
 		ITERATIONS int = 100
 	)
@@ -72,7 +267,7 @@ func calibrate(gyroscope *sensors.L3GD20, accelerometer *sensors.LSM303ACCEL) (e
 /**
 * Summarize the sensor data and send it off to be processed
 **/
-func sendSensorData(sensorChannel chan SensorData, when int64, gyroscope *sensors.L3GD20, accelerometer *sensors.LSM303ACCEL, mx, my, mz float32, count int) {
+func sendSensorData(sensorChannel chan SensorData, when int64, gyroscope sensors.Gyroscope, accelerometer sensors.Accelerometer, mx, my, mz float32, count int) {
 	var (
 		err  error
 		data SensorData
@@ -92,62 +287,507 @@ func sendSensorData(sensorChannel chan SensorData, when int64, gyroscope *sensor
 }
 
 /**
-* Loop reading sensors, attempt to summarize at 50Hz
+* Loop reading the sensors on the RaspberryPi's i2c bus, attempt to summarize at 50Hz.
+* Sampling is driven by the sensors' data ready interrupts if their lines
+* can be had, the bus is polled if they can't.
 **/
 func ReadSensors(sensorChannel chan SensorData) {
+	bus, err := i2c.Bus(1)
+	if err != nil {
+		fmt.Printf("readSensors: failed to open i2c bus, err=%v\n", err)
+		close(sensorChannel)
+		return
+	}
+	gyroLine, accelLine, err := OpenDataReadyLines()
+	if err != nil {
+		fmt.Printf("readSensors: no data ready interrupts, polling, err=%v\n", err)
+		ReadSensorsOn(bus, sensorChannel)
+		return
+	}
+	ReadSensorsOnLines(bus, gyroLine, accelLine, sensorChannel)
+}
+
+/**
+* Request rising edges on the lines the gyroscope's and accelerometer's
+* data ready pins are wired to
+**/
+func OpenDataReadyLines() (gyroLine, accelLine gpio.EventSource, err error) {
+	var gyro, accel *gpio.Line
+	if gyro, err = gpio.OpenLine(DRDY_CHIP, GYRO_DRDY_LINE, gpio.GPIOEVENT_REQUEST_RISING_EDGE, "goPiCopter gyro"); err != nil {
+		return
+	}
+	if accel, err = gpio.OpenLine(DRDY_CHIP, ACCEL_DRDY_LINE, gpio.GPIOEVENT_REQUEST_RISING_EDGE, "goPiCopter accel"); err != nil {
+		gyro.Close()
+		return
+	}
+	gyroLine, accelLine = gyro, accel
+	return
+}
+
+/**
+* Return true once the bus is replaying a recording that has run out,
+* or that the sensors have stopped following
+**/
+func replayOver(err error) bool {
+	return errors.Is(err, i2c.ErrReplayEnded) || errors.Is(err, i2c.ErrReplayDiverged)
+}
+
+/**
+* The latest magnetometer reading, shared with the goroutine taking it
+**/
+type magReading struct {
+	lock       sync.Mutex
+	mx, my, mz float32
+}
+
+func (m *magReading) set(mx, my, mz float32) {
+	m.lock.Lock()
+	m.mx, m.my, m.mz = mx, my, mz
+	m.lock.Unlock()
+}
+
+func (m *magReading) get() (mx, my, mz float32) {
+	m.lock.Lock()
+	mx, my, mz = m.mx, m.my, m.mz
+	m.lock.Unlock()
+	return
+}
+
+/**
+* Read the magnetometer's field as a sample measured and evaluated, so
+* its temperature compensation is kept up to date
+**/
+func readField(magnetometer sensors.Magnetometer) (mx, my, mz float32, err error) {
+	if err = magnetometer.Measure(); err == nil {
+		mx, my, mz, err = magnetometer.Evaluate()
+	}
+	return
+}
+
+/**
+* Read the magnetometer every MAG_PERIOD until done is closed
+**/
+func readMagnetometer(magnetometer sensors.Magnetometer, mag *magReading, done chan struct{}) {
+	ticker := time.NewTicker(MAG_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			mx, my, mz, err := readField(magnetometer)
+			if err != nil {
+				fmt.Printf("readSensors: failed to read magnetometer, err=%v\n", err)
+				continue
+			}
+			mag.set(mx, my, mz)
+		}
+	}
+}
+
+/**
+* Print how many deadlines were missed at each priority since the last report
+**/
+func reportMissed(sched *i2c.Scheduler) {
+	names := [i2c.PRIORITIES]string{"magnetometer", "accelerometer", "gyroscope"}
+	for priority, s := range sched.Stats() {
+		if s.Missed > 0 {
+			fmt.Printf("readSensors: %s missed %v of %v deadlines, worst by %v\n", names[priority], s.Missed, s.Transactions, s.MaxLate)
+		}
+	}
+	sched.ResetStats()
+}
+
+/**
+* Loop reading sensors on the given bus, attempt to summarize at 50Hz.
+* The data is stamped with the bus's clock when it has one, so a replayed
+* recording sees the same times the recorded flight did.
+*
+* The sensors share the bus through a scheduler, the gyroscope at the
+* highest priority, so a slow magnetometer read, made on its own
+* goroutine, doesn't hold up gyroscope samples.  Recording or replaying
+* needs the transactions in a repeatable order, so on a bus with a clock
+* the magnetometer is read in the loop instead, every 5th summary.
+**/
+func ReadSensorsOn(bus i2c.Transport, sensorChannel chan SensorData) {
+	readSensorsOn(bus, nil, sensorChannel)
+}
+
+/**
+* Loop reading sensors on the given bus as ReadSensorsOn does, sampling
+* the gyroscope and accelerometer as their data ready lines rise rather
+* than polling them, and stamping the data with the kernel's timestamps
+* of the edges.  The lines are closed when the loop ends, or once it
+* gives up on them.  A recording or replay needs the bus's own clock, so
+* on a bus with one the lines are closed straight away and the bus polled.
+**/
+func ReadSensorsOnLines(bus i2c.Transport, gyroLine, accelLine gpio.EventSource, sensorChannel chan SensorData) {
+	lines := &dataReadyLines{gyro: gyroLine, accel: accelLine}
+	if _, ok := bus.(i2c.Clock); ok {
+		fmt.Printf("readSensors: recording or replaying, polling rather than waiting on data ready\n")
+		lines.close()
+		lines = nil
+	}
+	readSensorsOn(bus, lines, sensorChannel)
+}
+
+func readSensorsOn(bus i2c.Transport, lines *dataReadyLines, sensorChannel chan SensorData) {
 	var (
-		count         int
-		now           int64   // Current time in nanoseconds
-		lastTime      int64   // Last 100Hz time in nanoseconds
-		hz            int64   // Hz in nanoseconds
-		magCount      int     // Read the Magnetometer every 5th summarize
-		mx, my, mz    float32 // Magnetometer data
 		err           error
-		gyroscope     *sensors.L3GD20
-		accelerometer *sensors.LSM303ACCEL
-		magnetometer  *sensors.LSM303MAG
+		clock         func() int64
+		inline        bool // read the Magnetometer in the loop
+		gyroscope     sensors.Gyroscope
+		accelerometer sensors.Accelerometer
+		magnetometer  sensors.Magnetometer
 	)
 
+	sched := i2c.NewScheduler(bus)
+	defer sched.Close()
+
 	fmt.Printf("Allocating sensors...\n")
-	gyroscope, accelerometer, magnetometer, err = setup()
+	gyroscope, accelerometer, magnetometer, err = setup(
+		sched.Client(i2c.PRIORITY_HIGH, GYRO_DEADLINE),
+		sched.Client(i2c.PRIORITY_NORMAL, ACCEL_DEADLINE),
+		sched.Client(i2c.PRIORITY_LOW, MAG_DEADLINE))
 	if err != nil {
+		if lines != nil {
+			lines.close()
+		}
 		close(sensorChannel)
 		return
 	}
 
-	fmt.Printf("Reading sensors...\n")
-	hz = int64(time.Second/50) - 200000 // minus overhead to send sensor data
+	clock = func() int64 { return time.Now().UnixNano() }
+	if c, ok := bus.(i2c.Clock); ok {
+		clock = c.Now
+		inline = true
+	}
 
-	lastTime = time.Now().UnixNano()
-	mx, my, mz, err = magnetometer.ReadXYZ()
-	if err != nil {
-		fmt.Printf("readSensors: failed to read magnetometer, err=%v\n", err)
+	readSensors(gyroscope, accelerometer, magnetometer, clock, inline, sched, lines, sensorChannel)
+}
+
+/**
+* Loop reading the given sensors, whatever they are, attempt to summarize at 50Hz
+**/
+func ReadSensorsFrom(gyroscope sensors.Gyroscope, accelerometer sensors.Accelerometer, magnetometer sensors.Magnetometer, sensorChannel chan SensorData) {
+	clock := func() int64 { return time.Now().UnixNano() }
+	readSensors(gyroscope, accelerometer, magnetometer, clock, false, nil, nil, sensorChannel)
+}
+
+/**
+* Turn on the sensor's FIFO if it has one, returning it, or nil
+**/
+func enableFIFO(name string, sensor sensors.Triaxial) (fifo sensors.Buffered) {
+	if buffered, ok := sensor.(sensors.Buffered); ok {
+		if err := buffered.EnableFIFO(); err != nil {
+			fmt.Printf("readSensors: failed to enable the %s FIFO, err=%v\n", name, err)
+		} else {
+			fifo = buffered
+		}
 	}
+	return
+}
+
+/**
+* Turn the gyroscope's and accelerometer's FIFOs on, where they have them.
+* When the accelerometer's samples come in the gyroscope's FIFO, as the
+* MPU's do, there's the one FIFO, and the accelerometer isn't measured
+* on its own.
+**/
+func enableFIFOs(gyroscope sensors.Gyroscope, accelerometer sensors.Accelerometer) (gyroFIFO, accelFIFO sensors.Buffered, shared bool) {
+	gyroFIFO = enableFIFO("gyroscope", gyroscope)
+	if sharer, ok := accelerometer.(sensors.FIFOSharer); ok && gyroFIFO != nil && sharer.SharedFIFO() == gyroFIFO {
+		shared = true
+	} else {
+		accelFIFO = enableFIFO("accelerometer", accelerometer)
+	}
+	return
+}
+
+/**
+* Take a sample, or every sample waiting when the sensor's FIFO is on
+**/
+func measure(name string, sensor sensors.Triaxial, fifo sensors.Buffered, now int64) (n int, err error) {
+	if fifo == nil {
+		if err = sensor.Measure(); err == nil {
+			n = 1
+		}
+		return
+	}
+	var overrun bool
+	n, overrun, err = fifo.MeasureFIFO(now)
+	if overrun {
+		fmt.Printf("readSensors: %s FIFO filled up, samples may have been lost\n", name)
+	}
+	return
+}
+
+/**
+* The gyroscope's and accelerometer's data ready lines, and an edge on
+* one of them, or the error waiting for one
+**/
+type dataReadyLines struct {
+	gyro, accel gpio.EventSource
+}
+
+func (lines *dataReadyLines) close() {
+	for _, line := range []gpio.EventSource{lines.gyro, lines.accel} {
+		if err := line.Close(); err != nil {
+			fmt.Printf("readSensors: failed to close data ready line, err=%v\n", err)
+		}
+	}
+}
+
+type dataReady struct {
+	gyro  bool // on the gyroscope's line, the accelerometer's if not
+	event gpio.Event
+	err   error
+}
+
+/**
+* Wait for edges on the line, handing them on until the line's closed
+* or done is.  A line that fails other than by timing out fails again
+* at once, so it's waited on no more often than a timeout allows.
+**/
+func watchLine(line gpio.EventSource, gyro bool, ready chan dataReady, done chan struct{}) {
 	for {
-		count++
+		event, err := line.Wait(DRDY_TIMEOUT)
+		if errors.Is(err, gpio.ErrClosed) {
+			return
+		}
+		if err != nil && !errors.Is(err, gpio.ErrTimeout) {
+			select {
+			case <-time.After(DRDY_TIMEOUT):
+			case <-done:
+				return
+			}
+		}
+		select {
+		case ready <- dataReady{gyro, event, err}:
+		case <-done:
+			return
+		}
+	}
+}
+
+/**
+* Route the sensors' data ready signals to their pins
+**/
+func enableDataReady(gyroscope sensors.Gyroscope, accelerometer sensors.Accelerometer) (err error) {
+	for _, sensor := range []sensors.Triaxial{gyroscope, accelerometer} {
+		signaller, ok := sensor.(sensors.DataReadySignaller)
+		if !ok {
+			err = fmt.Errorf("%s has no data ready signal", sensor.Name())
+			return
+		}
+		if err = signaller.EnableDataReady(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+/**
+* The read loop, reading the magnetometer inline or on its own goroutine,
+* and reporting the scheduler's missed deadlines when there is one.
+* Sensors with a FIFO are read a burst at a time, and a gyroscope with
+* one every FIFO_PERIOD rather than polled as fast as the bus goes.  Reads
+* that fail are left out of the summary, and counted and reported with
+* the missed deadlines.
+*
+* Given data ready lines the FIFOs stay off and the gyroscope and
+* accelerometer are each read as their line rises, the data stamped with
+* the edge's kernel timestamp, carried over onto clock's timeline by the
+* difference between them at the first edge.  A sensor whose edge doesn't
+* come within DRDY_TIMEOUT is read anyway, which lowers its pin so the
+* next sample raises it again, and if neither line has risen after
+* DRDY_GIVE_UP timeouts they're taken not to be wired up and the bus is
+* polled instead.  The lines are closed as soon as they're given up on,
+* otherwise when the loop ends.
+**/
+func readSensors(gyroscope sensors.Gyroscope, accelerometer sensors.Accelerometer, magnetometer sensors.Magnetometer,
+	clock func() int64, inline bool, sched *i2c.Scheduler, lines *dataReadyLines, sensorChannel chan SensorData) {
+	var (
+		count      int
+		now        int64   // Current time in nanoseconds
+		lastTime   int64   // Last 100Hz time in nanoseconds
+		hz         int64   // Hz in nanoseconds
+		magCount   int     // Read the Magnetometer every 5th summarize
+		summaries  int     // Report missed deadlines every 50th summarize
+		mx, my, mz float32 // Magnetometer data
+		mag        magReading
+		err        error
+		n          int
+		gyroFIFO   sensors.Buffered
+		accelFIFO  sensors.Buffered
+		sharedFIFO bool // the accelerometer's samples come in the gyroscope's FIFO
+		ready      chan dataReady
+		edges      int   // data ready edges since the last report
+		missed     int   // data ready timeouts since the last report
+		offset     int64 // clock less the kernel's timestamps
+		synced     bool  // offset has been taken at an edge
+		gyroFails  int   // failed reads since the last report
+		accelFails int
+		lastFail   error
+	)
+
+	done := make(chan struct{})
+	defer close(done)
+	defer func() {
+		if lines != nil {
+			lines.close()
+		}
+	}()
+
+	if lines != nil {
+		if err = enableDataReady(gyroscope, accelerometer); err != nil {
+			fmt.Printf("readSensors: no data ready interrupts, polling, err=%v\n", err)
+			lines.close()
+			lines = nil
+		}
+	}
+	if lines != nil {
+		ready = make(chan dataReady)
+		go watchLine(lines.gyro, true, ready, done)
+		go watchLine(lines.accel, false, ready, done)
+		// a pin already up won't rise until its sample's read
 		gyroscope.Measure()
-		now = time.Now().UnixNano()
+		accelerometer.Measure()
+	} else {
+		gyroFIFO, accelFIFO, sharedFIFO = enableFIFOs(gyroscope, accelerometer)
+	}
+
+	fmt.Printf("Reading sensors...\n")
+	hz = int64(time.Second/50) - 200000 // minus overhead to send sensor data
+
+	lastTime = clock()
+	// without a magnetometer the field stays zero, which the IMU ignores
+	if magnetometer != nil {
+		if mx, my, mz, err = readField(magnetometer); err != nil {
+			fmt.Printf("readSensors: failed to read magnetometer, err=%v\n", err)
+		}
+	}
+	mag.set(mx, my, mz)
+	if !inline && magnetometer != nil {
+		go readMagnetometer(magnetometer, &mag, done)
+	}
+
+	summarize := func() {
+		mx, my, mz = mag.get()
+		sendSensorData(sensorChannel, now, gyroscope, accelerometer, mx, my, mz, count)
+		lastTime = now
+		count = 0
+		magCount++
+		if summaries++; summaries == 50 {
+			summaries = 0
+			if sched != nil {
+				reportMissed(sched)
+			}
+			if missed > 0 {
+				fmt.Printf("readSensors: %v data ready edges missed, %v caught\n", missed, edges)
+			}
+			edges, missed = 0, 0
+			if gyroFails > 0 || accelFails > 0 {
+				fmt.Printf("readSensors: %v gyroscope and %v accelerometer reads failed, last err=%v\n", gyroFails, accelFails, lastFail)
+			}
+			gyroFails, accelFails = 0, 0
+		}
+	}
+	// count a failed read, its sample's left out of the summary
+	failed := func(gyro bool, err error) {
+		if err == nil {
+			return
+		}
+		if gyro {
+			gyroFails++
+		} else {
+			accelFails++
+		}
+		lastFail = err
+	}
+
+	for lines != nil {
+		dr := <-ready
+		sensor, name := sensors.Triaxial(accelerometer), "accelerometer"
+		if dr.gyro {
+			sensor, name = gyroscope, "gyroscope"
+		}
+		stamp := clock()
+		if dr.err != nil {
+			missed++
+		} else {
+			if !synced {
+				offset, synced = stamp-dr.event.Timestamp, true
+			}
+			edges++
+			stamp = dr.event.Timestamp + offset
+		}
+		if !synced && missed >= DRDY_GIVE_UP {
+			fmt.Printf("readSensors: no data ready edges on either line, polling\n")
+			lines.close()
+			lines = nil
+			gyroFIFO, accelFIFO, sharedFIFO = enableFIFOs(gyroscope, accelerometer)
+			break
+		}
+		n, err = measure(name, sensor, nil, stamp)
+		count += n
+		if replayOver(err) {
+			fmt.Printf("readSensors: %v\n", err)
+			close(sensorChannel)
+			return
+		}
+		failed(dr.gyro, err)
+		// the edges come in on two lines, time mustn't run backwards across them
+		if stamp > now {
+			now = stamp
+		}
+		// the magnetometer's on its own goroutine, lines are never
+		// waited on with a bus clock to read it inline by
 		if (now - lastTime) >= hz {
-			sendSensorData(sensorChannel, now, gyroscope, accelerometer, mx, my, mz, count)
-			lastTime = now
-			count = 0
-			magCount++
+			summarize()
 		}
+	}
 
-		accelerometer.Measure()
-		now = time.Now().UnixNano()
+	for {
+		if gyroFIFO != nil {
+			time.Sleep(FIFO_PERIOD)
+		}
+		n, err = measure("gyroscope", gyroscope, gyroFIFO, clock())
+		count += n
+		if replayOver(err) {
+			fmt.Printf("readSensors: %v\n", err)
+			close(sensorChannel)
+			return
+		}
+		failed(true, err)
+		now = clock()
 		if (now - lastTime) >= hz {
-			sendSensorData(sensorChannel, now, gyroscope, accelerometer, mx, my, mz, count)
-			lastTime = now
-			count = 0
-			magCount++
+			summarize()
 		}
 
-		if magCount == 5 {
+		if !sharedFIFO {
+			_, err = measure("accelerometer", accelerometer, accelFIFO, clock())
+			if replayOver(err) {
+				fmt.Printf("readSensors: %v\n", err)
+				close(sensorChannel)
+				return
+			}
+			failed(false, err)
+			now = clock()
+			if (now - lastTime) >= hz {
+				summarize()
+			}
+		}
+
+		if magCount >= 5 {
 			magCount = 0
-			mx, my, mz, err = magnetometer.ReadXYZ()
-			if err != nil {
-				fmt.Printf("readSensors: failed to read magnetometer, err=%v\n", err)
+			if inline && magnetometer != nil {
+				mx, my, mz, err = readField(magnetometer)
+				if err != nil {
+					fmt.Printf("readSensors: failed to read magnetometer, err=%v\n", err)
+				} else {
+					mag.set(mx, my, mz)
+				}
 			}
 		}
 	}
@@ -0,0 +1,273 @@
+package sensors
+
+import (
+	"errors"
+	"fmt"
+	"goPiCopter/io/sensors/i2c"
+	"time"
+)
+
+/**
+* The AK8963 is the triple-axis Magnetometer (compass) in the MPU-9250.
+* It only answers on the host's bus with the MPU's bypass on, see
+* MPU6050.Magnetometer.  Output is little endian, and a read of the
+* outputs has to go on to ST2 for the chip to take the next measurement.
+* Each axis has its own sensitivity adjustment, burnt into the fuse ROM,
+* read once when the driver is constructed.  There's no gain to step up,
+* a field too strong for it sets ST2's HOFL.
+**/
+const (
+	AK8963_ADDR = 0x0C
+	AK8963_ID   = 0x48 // WIA, the device ID
+
+	AK8963_WIA   = 0x00
+	AK8963_INFO  = 0x01
+	AK8963_ST1   = 0x02
+	AK8963_HXL   = 0x03
+	AK8963_HXH   = 0x04
+	AK8963_HYL   = 0x05
+	AK8963_HYH   = 0x06
+	AK8963_HZL   = 0x07
+	AK8963_HZH   = 0x08
+	AK8963_ST2   = 0x09
+	AK8963_CNTL1 = 0x0A
+	AK8963_CNTL2 = 0x0B
+	AK8963_ASTC  = 0x0C
+	AK8963_ASAX  = 0x10 // fuse ROM sensitivity adjustments
+	AK8963_ASAY  = 0x11
+	AK8963_ASAZ  = 0x12
+
+	AK8963_ST1_DRDY  = 0x01
+	AK8963_ST1_DOR   = 0x02 // a measurement was skipped, not read in time
+	AK8963_ST2_HOFL  = 0x08 // overflowed
+	AK8963_ST2_BITM  = 0x10 // 16 bit output
+	AK8963_CNTL2_RST = 0x01
+
+	// CNTL1, the output's bits and the mode
+	AK8963_CNTL1_16BIT           = 0x10
+	AK8963_CNTL1_MODE            = 0x0F
+	AK8963_MODE_POWER_DOWN       = 0x00
+	AK8963_MODE_SINGLE           = 0x01
+	AK8963_MODE_CONTINUOUS_8HZ   = 0x02
+	AK8963_MODE_CONTINUOUS_100HZ = 0x06
+	AK8963_MODE_FUSE_ROM         = 0x0F
+	AK8963_SENSITIVITY_14BIT     = 0.6              // microtesla/digit
+	AK8963_SENSITIVITY_16BIT     = 0.15             // microtesla/digit
+	AK8963_MODE_DELAY            = time.Millisecond // after a change of mode, the datasheet asks for 100us
+)
+
+type AK8963 struct {
+	bus    i2c.Transport
+	addr   byte
+	cntl1  byte       // as last written
+	adjust [3]float32 // each axis's sensitivity adjustment
+	buffer [7]byte    // every read goes here, so reading doesn't allocate
+	magSamples
+	// how the chip is mounted on the board
+	orientation Orientation
+	// hard and soft iron calibration
+	calibration ironCalibration
+}
+
+// Return a new Device
+func NewAK8963() (bp *AK8963, err error) {
+	bp, err = NewAK8963With()
+	return
+}
+
+// Return a new Device on the given bus
+func NewAK8963OnBus(bus i2c.Transport) (bp *AK8963, err error) {
+	bp, err = NewAK8963With(WithTransport(bus))
+	return
+}
+
+// Return a new Device set up by the options, or a DriverError saying why
+// there isn't one
+func NewAK8963With(opts ...Option) (bp *AK8963, err error) {
+	var o options
+	if o, err = applyOptions(AK8963_ADDR, opts); err != nil {
+		err = driverError("AK8963", o.addr, err)
+		return
+	}
+	// Make sure it's the chip before writing to it
+	if _, err = identify(o.bus, o.addr, "AK8963"); err != nil {
+		return
+	}
+	bp = new(AK8963)
+	bp.bus = o.bus
+	bp.addr = o.addr
+	bp.orientation = o.orientation
+	// Read the sensitivity adjustments, then measure continuously at
+	// 100Hz with 16 bit output
+	err = bp.readAdjustments()
+	if err == nil {
+		err = bp.SetMode(AK8963_MODE_CONTINUOUS_100HZ, true)
+	}
+	if err == nil {
+		err = o.writeRegisters(bp.WriteRegister)
+	}
+	if err != nil {
+		bp, err = nil, driverError("AK8963", o.addr, err)
+	}
+	return
+}
+
+// Read a byte from the specified register
+func (bp *AK8963) ReadRegister(reg byte) (value int8, err error) {
+	bytes := bp.buffer[:1]
+	err = i2c.ReadBlockInto(bp.bus, bp.addr, reg, bytes)
+	if err == nil {
+		value = int8(bytes[0])
+	}
+	return
+}
+
+// Write a byte to the specified register
+func (bp *AK8963) WriteRegister(reg byte, data byte) (err error) {
+	err = bp.bus.WriteByte(bp.addr, reg, data)
+	if err == nil && reg == AK8963_CNTL1 {
+		bp.cntl1 = data
+	}
+	return
+}
+
+// Change mode, one of the AK8963_MODE_... with 16 or 14 bit output,
+// powering down in between as the datasheet asks
+func (bp *AK8963) SetMode(mode byte, bits16 bool) (err error) {
+	cntl1 := mode & AK8963_CNTL1_MODE
+	if bits16 {
+		cntl1 |= AK8963_CNTL1_16BIT
+	}
+	if err = bp.WriteRegister(AK8963_CNTL1, AK8963_MODE_POWER_DOWN); err != nil {
+		return
+	}
+	time.Sleep(AK8963_MODE_DELAY)
+	if err = bp.WriteRegister(AK8963_CNTL1, cntl1); err == nil {
+		time.Sleep(AK8963_MODE_DELAY)
+	}
+	return
+}
+
+// Read the fuse ROM's sensitivity adjustments, leaving the chip powered down
+func (bp *AK8963) readAdjustments() (err error) {
+	if err = bp.SetMode(AK8963_MODE_FUSE_ROM, false); err != nil {
+		return
+	}
+	bytes := bp.buffer[:3]
+	if err = i2c.ReadBlockInto(bp.bus, bp.addr, AK8963_ASAX, bytes); err != nil {
+		return
+	}
+	for axis, asa := range bytes {
+		bp.adjust[axis] = (float32(asa)-128)/256 + 1
+	}
+	err = bp.WriteRegister(AK8963_CNTL1, AK8963_MODE_POWER_DOWN)
+	return
+}
+
+// Return the microtesla per digit of the output's bits
+func (bp *AK8963) sensitivity() float32 {
+	if bp.cntl1&AK8963_CNTL1_16BIT != 0 {
+		return AK8963_SENSITIVITY_16BIT
+	}
+	return AK8963_SENSITIVITY_14BIT
+}
+
+// Read the raw x, y, z values from their registers, and ST2 after them
+// so the chip goes on to the next measurement.  An overflowed reading is
+// returned as ErrOverflow as well as the values.
+func (bp *AK8963) ReadRaw() (x, y, z int16, err error) {
+	bytes := bp.buffer[:7]
+	err = i2c.ReadBlockInto(bp.bus, bp.addr, AK8963_HXL, bytes)
+	if err == nil {
+		// Extract the values, low byte first
+		x = int16(uint16(bytes[0]) | (uint16(bytes[1]) << 8))
+		y = int16(uint16(bytes[2]) | (uint16(bytes[3]) << 8))
+		z = int16(uint16(bytes[4]) | (uint16(bytes[5]) << 8))
+		if bytes[6]&AK8963_ST2_HOFL != 0 {
+			err = fmt.Errorf("AK8963: %w", ErrOverflow)
+		}
+	}
+	return
+}
+
+// Read the X, Y, and Z values from their registers, adjusted by the
+// sensitivity and its adjustments, in microtesla
+func (bp *AK8963) readScaled() (x, y, z float32, err error) {
+	var (
+		xi, yi, zi int16
+	)
+	if xi, yi, zi, err = bp.ReadRaw(); err == nil {
+		sensitivity := bp.sensitivity()
+		x = float32(xi) * bp.adjust[0] * sensitivity
+		y = float32(yi) * bp.adjust[1] * sensitivity
+		z = float32(zi) * bp.adjust[2] * sensitivity
+	}
+	return
+}
+
+// Read the X, Y, and Z values in the board's axes, but not the iron
+// calibration
+func (bp *AK8963) readUncalibrated() (x, y, z float32, err error) {
+	if x, y, z, err = bp.readScaled(); err == nil {
+		x, y, z = bp.orientation.Apply(x, y, z)
+	} else {
+		x, y, z = 0, 0, 0
+	}
+	return
+}
+
+// Read the X, Y, and Z values from their registers, adjusted by the
+// sensitivity and the iron calibration, in microtesla.
+// An overflowed reading is returned as ErrOverflow, not a value.
+func (bp *AK8963) ReadXYZ() (x, y, z float32, err error) {
+	x, y, z, err = bp.readUncalibrated()
+	if err == nil {
+		x, y, z = bp.calibration.apply(x, y, z)
+	}
+	return
+}
+
+// Correct what's read from now on with a copy of the calibration, nil
+// turns it off.  It's safe to call while another goroutine reads.
+func (bp *AK8963) SetCalibration(cal *MagCalibration) {
+	bp.calibration.set(cal)
+}
+
+// Take a sample, a failed read is returned rather than counted as a sample
+func (bp *AK8963) Measure() (err error) {
+	var (
+		x, y, z float32
+	)
+	x, y, z, err = bp.readScaled()
+	if err == nil {
+		bp.add(x, y, z)
+	}
+	return
+}
+
+// Evaluate the samples
+func (bp *AK8963) Evaluate() (x, y, z float32, err error) {
+	if bp.sampleCnt > 0 {
+		x, y, z = bp.orientation.Apply(bp.mean())
+		x, y, z = bp.calibration.apply(x, y, z)
+	} else {
+		err = errors.New("No magnetometer samples to Evaluate")
+	}
+	return
+}
+
+// Return the driver's name
+func (bp *AK8963) Name() string {
+	return "AK8963"
+}
+
+// Return the chip's address on its bus
+func (bp *AK8963) Address() byte {
+	return bp.addr
+}
+
+// Read the chip's WIA register
+func (bp *AK8963) Identity() (id Identity, err error) {
+	id, err = identify(bp.bus, bp.addr, "AK8963")
+	return
+}
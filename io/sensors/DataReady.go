@@ -0,0 +1,51 @@
+package sensors
+
+/**
+* Routing the chips' data ready signals to their interrupt pins, so a
+* GPIO edge says a new sample is waiting instead of the bus being polled
+* for it.  The L3GD20 raises DRDY/INT2, the LSM303DLHC's accelerometer
+* INT1.  Each pin stays high until the sample is read, so an edge that's
+* missed leaves it high and no more edges come until it is.
+**/
+const (
+	L3GD20_CTRL_REG3_I2_DRDY       = 0x08 // data ready on DRDY/INT2
+	LSM303ACCEL_CTRL_REG3_I1_DRDY1 = 0x10 // data ready on INT1
+)
+
+// Raise DRDY/INT2 with each new sample
+func (bp *L3GD20) EnableDataReady() (err error) {
+	err = setBits(bp.ReadRegister, bp.WriteRegister, L3GD20_CTRL_REG3, L3GD20_CTRL_REG3_I2_DRDY, true)
+	return
+}
+
+// Stop raising DRDY/INT2
+func (bp *L3GD20) DisableDataReady() (err error) {
+	err = setBits(bp.ReadRegister, bp.WriteRegister, L3GD20_CTRL_REG3, L3GD20_CTRL_REG3_I2_DRDY, false)
+	return
+}
+
+// Raise INT1 with each new sample
+func (bp *LSM303ACCEL) EnableDataReady() (err error) {
+	err = setBits(bp.ReadRegister, bp.WriteRegister, LSM303ACCEL_CTRL_REG3, LSM303ACCEL_CTRL_REG3_I1_DRDY1, true)
+	return
+}
+
+// Stop raising INT1
+func (bp *LSM303ACCEL) DisableDataReady() (err error) {
+	err = setBits(bp.ReadRegister, bp.WriteRegister, LSM303ACCEL_CTRL_REG3, LSM303ACCEL_CTRL_REG3_I1_DRDY1, false)
+	return
+}
+
+// Set or clear bits in reg, leaving the rest as they are
+func setBits(read func(reg byte) (int8, error), write func(reg, data byte) error, reg, bits byte, on bool) (err error) {
+	var value int8
+	if value, err = read(reg); err != nil {
+		return
+	}
+	if on {
+		err = write(reg, byte(value)|bits)
+	} else {
+		err = write(reg, byte(value)&^bits)
+	}
+	return
+}
@@ -0,0 +1,69 @@
+package sensors
+
+import (
+	"errors"
+	"fmt"
+	"goPiCopter/io/sensors/i2c"
+)
+
+// The kinds of sensor failure, test for them with errors.Is
+var (
+	// A reading was out of range for the sensor's setting
+	ErrOverflow = errors.New("sensors: reading overflowed")
+	// The sensor had no new data in the time allowed
+	ErrNotReady = errors.New("sensors: data not ready")
+	// The sensor didn't keep still for long enough in the time allowed
+	ErrMoving = errors.New("sensors: not still")
+)
+
+// Why a driver couldn't be constructed, test for them with errors.Is
+var (
+	// Nothing answered at the chip's address
+	ErrNotPresent = errors.New("sensors: chip not present")
+	// Something answered, but its identity registers aren't the chip's
+	ErrWrongChip = errors.New("sensors: wrong chip")
+	// The bus couldn't be opened, or failed talking to the chip
+	ErrBus = errors.New("sensors: bus error")
+)
+
+// A DriverError describes a driver that couldn't be constructed
+type DriverError struct {
+	Driver string
+	Addr   byte
+	Kind   error  // ErrNotPresent, ErrWrongChip or ErrBus
+	Detail string // what the identity registers read, for ErrWrongChip
+	Err    error  // the underlying error, usually an *i2c.Error
+}
+
+func (e *DriverError) Error() string {
+	msg := fmt.Sprintf("sensors: %s at 0x%02X: %s", e.Driver, e.Addr, e.Kind.Error())
+	if e.Detail != "" {
+		msg += ", " + e.Detail
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *DriverError) Is(target error) bool {
+	return e.Kind == target
+}
+
+func (e *DriverError) Unwrap() error {
+	return e.Err
+}
+
+// Wrap err from constructing the driver's chip at addr in a DriverError,
+// a chip that doesn't acknowledge isn't there
+func driverError(driver string, addr byte, err error) error {
+	var de *DriverError
+	if err == nil || errors.As(err, &de) {
+		return err
+	}
+	kind := ErrBus
+	if errors.Is(err, i2c.ErrNack) {
+		kind = ErrNotPresent
+	}
+	return &DriverError{Driver: driver, Addr: addr, Kind: kind, Err: err}
+}
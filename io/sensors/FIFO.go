@@ -0,0 +1,82 @@
+package sensors
+
+import (
+	"errors"
+	"goPiCopter/io/sensors/i2c"
+)
+
+/**
+* Reading the 32 sample FIFO the L3GD20 and the LSM303's accelerometer
+* share.  FIFO_SRC_REG is laid out the same on both, and all the samples
+* waiting are read in one burst from OUT_X_L, the register address rolls
+* back from OUT_Z_H to OUT_X_L while the FIFO is on.
+**/
+const (
+	fifoSize = 32
+
+	fifoSrcOVRN  = 0x40 // full
+	fifoSrcEMPTY = 0x20
+	fifoSrcFSS   = 0x1F // samples waiting
+
+	// the most read in one go when the bus can't do a combined transaction
+	fifoChunkSamples = i2c.I2C_SMBUS_BLOCK_MAX / 6
+)
+
+// Where FIFO burst reads go, so reading doesn't allocate
+type fifoBuffer struct {
+	data [fifoSize * 6]byte
+	reg  [1]byte
+	msgs [2]i2c.Msg
+}
+
+// Return how many samples FIFO_SRC_REG says are waiting, up to max,
+// and whether the FIFO filled up
+func fifoLevel(src byte, max int) (n int, overrun bool) {
+	switch {
+	case src&fifoSrcEMPTY != 0:
+		n = 0
+	case src&fifoSrcOVRN != 0:
+		n = fifoSize
+		overrun = true
+	default:
+		n = int(src & fifoSrcFSS)
+	}
+	if n > max {
+		n = max
+	}
+	return
+}
+
+// Read n samples starting at reg, the chip's OUT_X_L, in one combined
+// transaction if the bus can, otherwise as many block reads as it takes
+func (f *fifoBuffer) read(bus i2c.Transport, addr, reg byte, n int) (err error) {
+	data := f.data[:n*6]
+	if t, ok := bus.(i2c.Transferer); ok {
+		f.reg[0] = reg | 0x80
+		f.msgs[0] = i2c.Msg{Addr: addr, Buf: f.reg[:]}
+		f.msgs[1] = i2c.Msg{Addr: addr, Flags: i2c.I2C_M_RD, Buf: data}
+		if err = t.Transfer(f.msgs[:]...); !errors.Is(err, i2c.ErrNotSupported) {
+			return
+		}
+	}
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > fifoChunkSamples*6 {
+			chunk = chunk[:fifoChunkSamples*6]
+		}
+		if err = i2c.ReadBlockInto(bus, addr, reg|0x80, chunk); err != nil {
+			return
+		}
+		data = data[len(chunk):]
+	}
+	return
+}
+
+// Return the raw values of the i-th sample read, as the chip has them
+func (f *fifoBuffer) sample(i int) (x, y, z int16) {
+	bytes := f.data[i*6 : i*6+6]
+	x = int16(uint16(bytes[0]) | (uint16(bytes[1]) << 8))
+	y = int16(uint16(bytes[2]) | (uint16(bytes[3]) << 8))
+	z = int16(uint16(bytes[4]) | (uint16(bytes[5]) << 8))
+	return
+}
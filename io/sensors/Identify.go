@@ -0,0 +1,119 @@
+package sensors
+
+import (
+	"fmt"
+	"goPiCopter/io/sensors/i2c"
+)
+
+/**
+* Recognising the supported chips on a bus.  Each Probe knows the
+* addresses a chip can be strapped to and the identity registers
+* that tell it apart from whatever else might answer there.
+**/
+type Probe struct {
+	Driver string
+	Addrs  []byte
+	// Report whether the chip at addr is this driver's, and what was
+	// read, or the error reading it
+	Match func(bus i2c.Transport, addr byte) (ok bool, detail string, err error)
+}
+
+// What was found at an address
+type Identity struct {
+	Addr   byte
+	Driver string // the supported driver that matched, empty if none did
+	Detail string // what the identity registers read
+}
+
+// The probes for every supported chip
+var Probes = []Probe{
+	{
+		Driver: "L3GD20",
+		Addrs:  []byte{L3GD20_ADDR_ALT, L3GD20_ADDR},
+		Match:  matchWhoAmI(L3GD20_WHO_AM_I, L3GD20_ID),
+	},
+	{
+		Driver: "LSM303ACCEL",
+		Addrs:  []byte{LSM303ACCEL_ADDR_ALT, LSM303ACCEL_ADDR},
+		Match:  matchWhoAmI(LSM303ACCEL_WHO_AM_I, LSM303ACCEL_ID),
+	},
+	{
+		Driver: "LSM303MAG",
+		Addrs:  []byte{LSM303MAG_ADDR},
+		Match:  matchLSM303MAG,
+	},
+	{
+		Driver: "MPU6050",
+		Addrs:  []byte{MPU6050_ADDR, MPU6050_ADDR_ALT},
+		Match:  matchMPU,
+	},
+	{
+		Driver: "AK8963",
+		Addrs:  []byte{AK8963_ADDR},
+		Match:  matchWhoAmI(AK8963_WIA, AK8963_ID),
+	},
+}
+
+// Return a Match for a chip with a WHO_AM_I style register
+func matchWhoAmI(reg, id byte) func(bus i2c.Transport, addr byte) (bool, string, error) {
+	return func(bus i2c.Transport, addr byte) (ok bool, detail string, err error) {
+		var bytes []byte
+		if bytes, err = bus.ReadByteBlock(addr, reg, 1); err != nil {
+			return
+		}
+		ok = bytes[0] == id
+		detail = fmt.Sprintf("WHO_AM_I=0x%02X", bytes[0])
+		return
+	}
+}
+
+// The LSM303 magnetometer identifies itself as "H43" in IRA, IRB and IRC
+func matchLSM303MAG(bus i2c.Transport, addr byte) (ok bool, detail string, err error) {
+	var bytes []byte
+	if bytes, err = bus.ReadByteBlock(addr, LSM303MAG_IRA_REG, 3); err != nil {
+		return
+	}
+	ok = bytes[0] == LSM303MAG_IRA_ID && bytes[1] == LSM303MAG_IRB_ID && bytes[2] == LSM303MAG_IRC_ID
+	detail = fmt.Sprintf("IRA/IRB/IRC=0x%02X 0x%02X 0x%02X", bytes[0], bytes[1], bytes[2])
+	return
+}
+
+// The MPU-6050 and MPU-9250 share the driver and its addresses,
+// WHO_AM_I says which model answered
+func matchMPU(bus i2c.Transport, addr byte) (ok bool, detail string, err error) {
+	var bytes []byte
+	if bytes, err = bus.ReadByteBlock(addr, MPU6050_WHO_AM_I, 1); err != nil {
+		return
+	}
+	detail = fmt.Sprintf("WHO_AM_I=0x%02X", bytes[0])
+	var model string
+	if model, ok = MPUModels[bytes[0]]; ok {
+		detail += " " + model
+	}
+	return
+}
+
+// Run every probe that knows the address against it.  There's
+// one Identity for each probe tried, or a single one with no
+// Driver if none of the supported chips live at that address.
+func Identify(bus i2c.Transport, addr byte) (ids []Identity) {
+	for _, probe := range Probes {
+		for _, a := range probe.Addrs {
+			if a != addr {
+				continue
+			}
+			id := Identity{Addr: addr}
+			ok, detail, err := probe.Match(bus, addr)
+			if id.Detail = detail; err != nil {
+				id.Detail = err.Error()
+			} else if ok {
+				id.Driver = probe.Driver
+			}
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		ids = append(ids, Identity{Addr: addr, Detail: "no supported driver for this address"})
+	}
+	return
+}
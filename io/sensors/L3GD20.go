@@ -9,8 +9,9 @@ import (
 * The L3GD20 is a triple-axis Gyroscope.
 **/
 const (
-	L3GD20_ADDR = 0x6B
-	L3GD20_ID   = 0xD4
+	L3GD20_ADDR     = 0x6B
+	L3GD20_ADDR_ALT = 0x6A // SA0 pulled low
+	L3GD20_ID       = 0xD4
 
 	L3GD20_WHO_AM_I      = 0x0F
 	L3GD20_CTRL_REG1     = 0x20
@@ -47,10 +48,15 @@ const (
 	L3GD20_SENSITIVITY_500DPS  = 0.0175      // Roughly 45/256
 	L3GD20_SENSITIVITY_2000DPS = 0.070       // Roughly 18/256
 	L3GD20_DPS_TO_RADS         = 0.017453293 // degress/s to rad/s multiplier
+
+	// OUT_TEMP falls a digit per degree C, from about this at 0.  The
+	// datasheet doesn't give a zero point, CalibrateTemperature finds it.
+	L3GD20_TEMP_OFFSET = 25
 )
 
 type L3GD20 struct {
-	bus       *i2c.I2CBus
+	bus       i2c.Transport
+	addr      byte
 	dpsRange  byte
 	biasX     float32
 	biasY     float32
@@ -59,22 +65,62 @@ type L3GD20 struct {
 	sampleY   int
 	sampleZ   int
 	sampleCnt int
+	buffer    [6]byte // every read goes here, so reading doesn't allocate
+	dataRate  int     // Hz, as set in CTRL_REG1
+	fifo      fifoBuffer
+	// how the chip is mounted on the board
+	orientation Orientation
+	// degrees C at OUT_TEMP 0, and the temperature bias model
+	tempOffset float32
+	tempComp   tempCompensation
 }
 
 // Return a new Device
 func NewL3GD20() (bp *L3GD20, err error) {
+	bp, err = NewL3GD20With()
+	return
+}
+
+// Return a new Device on the given bus
+func NewL3GD20OnBus(bus i2c.Transport) (bp *L3GD20, err error) {
+	bp, err = NewL3GD20With(WithTransport(bus))
+	return
+}
+
+// Return a new Device set up by the options, or a DriverError saying why
+// there isn't one
+func NewL3GD20With(opts ...Option) (bp *L3GD20, err error) {
+	var o options
+	if o, err = applyOptions(L3GD20_ADDR, opts); err != nil {
+		err = driverError("L3GD20", o.addr, err)
+		return
+	}
+	// Make sure it's the chip before writing to it
+	if _, err = identify(o.bus, o.addr, "L3GD20"); err != nil {
+		return
+	}
 	bp = new(L3GD20)
-	bp.bus, err = i2c.Bus(1)
+	bp.bus = o.bus
+	bp.addr = o.addr
+	bp.orientation = o.orientation
 	bp.dpsRange = L3GD20_RANGE_250DPS
-	// Turn it on, enable all 3 axis
-	err = bp.bus.WriteByte(L3GD20_ADDR, L3GD20_CTRL_REG1, 0x0F)
+	bp.dataRate = L3GD20DataRates[0]
+	bp.tempOffset = L3GD20_TEMP_OFFSET
+	// Turn it on, enable all 3 axis, at 95Hz and 250dps with the filters off
+	err = bp.Configure(DefaultL3GD20Config)
+	if err == nil {
+		err = o.writeRegisters(bp.WriteRegister)
+	}
+	if err != nil {
+		bp, err = nil, driverError("L3GD20", o.addr, err)
+	}
 	return
 }
 
 // Read a byte from the specified register
 func (bp *L3GD20) ReadRegister(reg byte) (value int8, err error) {
-	var bytes []byte
-	bytes, err = bp.bus.ReadByteBlock(L3GD20_ADDR, reg, 1)
+	bytes := bp.buffer[:1]
+	err = i2c.ReadBlockInto(bp.bus, bp.addr, reg, bytes)
 	if err == nil {
 		value = int8(bytes[0])
 	}
@@ -83,32 +129,71 @@ func (bp *L3GD20) ReadRegister(reg byte) (value int8, err error) {
 
 // Write a byte to the specified register
 func (bp *L3GD20) WriteRegister(reg byte, data byte) (err error) {
-	err = bp.bus.WriteByte(L3GD20_ADDR, reg, data)
+	err = bp.bus.WriteByte(bp.addr, reg, data)
 	if err == nil && reg == L3GD20_CTRL_REG4 {
 		bp.dpsRange = (data >> 4) & 0x03
 	}
+	if err == nil && reg == L3GD20_CTRL_REG1 {
+		bp.dataRate = L3GD20DataRates[data>>6]
+	}
 	return
 }
 
-// Read the temperature
+// Return the sensitivity in dps/digit for the range set in CTRL_REG4
+func (bp *L3GD20) sensitivity() float32 {
+	switch bp.dpsRange {
+	case L3GD20_RANGE_250DPS:
+		return L3GD20_SENSITIVITY_250DPS
+	case L3GD20_RANGE_500DPS:
+		return L3GD20_SENSITIVITY_500DPS
+	}
+	// FS 11 is 2000dps too
+	return L3GD20_SENSITIVITY_2000DPS
+}
+
+// Read the temperature, raw from OUT_TEMP
 func (bp *L3GD20) ReadTemperature() (deg int8, err error) {
-	var bytes []byte
-	bytes, err = bp.bus.ReadByteBlock(L3GD20_ADDR, L3GD20_OUT_TEMP, 1)
+	bytes := bp.buffer[:1]
+	err = i2c.ReadBlockInto(bp.bus, bp.addr, L3GD20_OUT_TEMP, bytes)
 	if err == nil {
 		deg = int8(bytes[0])
 	}
 	return
 }
 
+// Read the temperature in degrees C
+func (bp *L3GD20) ReadCelsius() (deg float32, err error) {
+	var raw int8
+	if raw, err = bp.ReadTemperature(); err == nil {
+		deg = bp.tempOffset - float32(raw)
+	}
+	return
+}
+
+// Calibrate ReadCelsius against the actual temperature, in degrees C
+func (bp *L3GD20) CalibrateTemperature(actual float32) (err error) {
+	var raw int8
+	if raw, err = bp.ReadTemperature(); err == nil {
+		bp.tempOffset = actual + float32(raw)
+	}
+	return
+}
+
+// Take the bias model's bias at the chip's temperature off what's
+// read from now on, nil turns it off
+func (bp *L3GD20) SetTempModel(model *TempModel) {
+	bp.tempComp.set(model)
+}
+
 // Read the raw x, y, z values from their registers
 func (bp *L3GD20) ReadRaw() (x, y, z int16, err error) {
-	var bytes []byte
-	bytes, err = bp.bus.ReadByteBlock(L3GD20_ADDR, L3GD20_OUT_X_L|0x80, 6)
+	bytes := bp.buffer[:6]
+	err = i2c.ReadBlockInto(bp.bus, bp.addr, L3GD20_OUT_X_L|0x80, bytes)
 	if err == nil {
-		// Extract the values  (warning: swapped the X/Y because of my layout)
-		y = int16(uint16(bytes[0]) | (uint16(bytes[1]) << 8)) // X
-		x = int16(uint16(bytes[2]) | (uint16(bytes[3]) << 8)) // Y
-		z = int16(uint16(bytes[4]) | (uint16(bytes[5]) << 8)) // Z
+		// Extract the values, in the chip's axes
+		x = int16(uint16(bytes[0]) | (uint16(bytes[1]) << 8))
+		y = int16(uint16(bytes[2]) | (uint16(bytes[3]) << 8))
+		z = int16(uint16(bytes[4]) | (uint16(bytes[5]) << 8))
 	}
 	return
 }
@@ -116,33 +201,36 @@ func (bp *L3GD20) ReadRaw() (x, y, z int16, err error) {
 // Return adjusted x, y, z values
 func (bp *L3GD20) ReadXYZ() (x, y, z float32, err error) {
 	var (
-		sensitivity float32 = 1.0
 		xi, yi, zi int16
 	)
 	xi, yi, zi, err = bp.ReadRaw()
 	if err == nil {
-		// Compensate values depending on the sensitivity
-		switch bp.dpsRange {
-		case L3GD20_RANGE_250DPS:
-			sensitivity = L3GD20_SENSITIVITY_250DPS
-		case L3GD20_RANGE_500DPS:
-			sensitivity = L3GD20_SENSITIVITY_500DPS
-		case L3GD20_RANGE_2000DPS:
-			sensitivity = L3GD20_SENSITIVITY_2000DPS
-		}
-		x = (float32(xi) - bp.biasX) * sensitivity
-		y = (float32(yi) - bp.biasY) * sensitivity
-		z = (float32(zi) - bp.biasZ) * sensitivity
+		tx, ty, tz := bp.tempComp.bias()
+		x, y, z = bp.convert(float32(xi), float32(yi), float32(zi))
+		x, y, z = x-tx, y-ty, z-tz
 	}
 	return
 }
 
-// Take a sample
-func (bp *L3GD20) Measure() {
+// Return raw values in degrees/s in the board's axes, less the bias
+func (bp *L3GD20) convert(xi, yi, zi float32) (x, y, z float32) {
+	// Compensate values depending on the sensitivity
+	sensitivity := bp.sensitivity()
+	x = (xi - bp.biasX) * sensitivity
+	y = (yi - bp.biasY) * sensitivity
+	z = (zi - bp.biasZ) * sensitivity
+	x, y, z = bp.orientation.Apply(x, y, z)
+	return
+}
+
+// Take a sample, a failed read is returned rather than counted as a sample
+func (bp *L3GD20) Measure() (err error) {
 	var (
-		err     error
 		x, y, z int16
 	)
+	if err = bp.tempComp.refresh(bp.ReadCelsius); err != nil {
+		return
+	}
 	x, y, z, err = bp.ReadRaw()
 	if err == nil {
 		bp.sampleX += int(x)
@@ -150,25 +238,15 @@ func (bp *L3GD20) Measure() {
 		bp.sampleZ += int(z)
 		bp.sampleCnt++
 	}
+	return
 }
 
 // Evaluate the samples
 func (bp *L3GD20) Evaluate() (x, y, z float32, err error) {
-	var (
-		sensitivity float32 = 1.0
-	)
 	if bp.sampleCnt > 0 {
-		switch bp.dpsRange {
-		case L3GD20_RANGE_250DPS:
-			sensitivity = L3GD20_SENSITIVITY_250DPS
-		case L3GD20_RANGE_500DPS:
-			sensitivity = L3GD20_SENSITIVITY_500DPS
-		case L3GD20_RANGE_2000DPS:
-			sensitivity = L3GD20_SENSITIVITY_2000DPS
-		}
-		x = (float32(bp.sampleX/bp.sampleCnt) - bp.biasX) * sensitivity
-		y = (float32(bp.sampleY/bp.sampleCnt) - bp.biasY) * sensitivity
-		z = (float32(bp.sampleZ/bp.sampleCnt) - bp.biasZ) * sensitivity
+		tx, ty, tz := bp.tempComp.bias()
+		x, y, z = bp.convert(float32(bp.sampleX/bp.sampleCnt), float32(bp.sampleY/bp.sampleCnt), float32(bp.sampleZ/bp.sampleCnt))
+		x, y, z = x-tx, y-ty, z-tz
 		bp.sampleCnt, bp.sampleX, bp.sampleY, bp.sampleZ = 0, 0, 0, 0
 	} else {
 		err = errors.New("No gyroscope samples to Evaluate")
@@ -188,3 +266,19 @@ func (bp *L3GD20) ComputeBias() (err error) {
 	}
 	return
 }
+
+// Return the driver's name
+func (bp *L3GD20) Name() string {
+	return "L3GD20"
+}
+
+// Return the chip's address on its bus
+func (bp *L3GD20) Address() byte {
+	return bp.addr
+}
+
+// Read the chip's WHO_AM_I register
+func (bp *L3GD20) Identity() (id Identity, err error) {
+	id, err = identify(bp.bus, bp.addr, "L3GD20")
+	return
+}
@@ -0,0 +1,203 @@
+package sensors
+
+import (
+	"fmt"
+)
+
+/**
+* Typed configuration of the L3GD20's output data rate, filters, full
+* scale and block data update, as laid out in CTRL_REG1, CTRL_REG2,
+* CTRL_REG4 and CTRL_REG5.  The low pass and high pass cutoffs depend
+* on the data rate, so they're given in Hz and checked against the
+* datasheet's tables for the data rate chosen.
+**/
+const (
+	// CTRL_REG2 HPM, the high pass filter mode
+	L3GD20_HPM_NORMAL_RESET = 0x00 // normal, reset by reading REFERENCE
+	L3GD20_HPM_REFERENCE    = 0x01 // output relative to REFERENCE
+	L3GD20_HPM_NORMAL       = 0x02
+	L3GD20_HPM_AUTORESET    = 0x03 // reset on interrupt
+
+	L3GD20_CTRL_REG1_PD    = 0x08 // normal mode, rather than power down
+	L3GD20_CTRL_REG1_AXES  = 0x07 // Z, Y and X enabled
+	L3GD20_CTRL_REG4_BDU   = 0x80
+	L3GD20_CTRL_REG5_HPEN  = 0x10
+	L3GD20_CTRL_REG5_OUT   = 0x03 // Out_Sel, what reaches the output registers
+	L3GD20_OUT_SEL_LPF1    = 0x00
+	L3GD20_OUT_SEL_HPF     = 0x01
+	L3GD20_OUT_SEL_LPF2    = 0x02
+	L3GD20_CTRL_REG5_FILTS = L3GD20_CTRL_REG5_HPEN | L3GD20_CTRL_REG5_OUT
+)
+
+type L3GD20Config struct {
+	DataRate int // output data rate in Hz, 95, 190, 380 or 760
+	// Low pass filter the output, Bandwidth is the cutoff in Hz,
+	// one of L3GD20Bandwidths for the DataRate
+	LowPass   bool
+	Bandwidth float32
+	Range     byte // L3GD20_RANGE_250DPS, _500DPS or _2000DPS
+	// High pass filter the output, before the low pass filter if that's
+	// on too.  HighPassCutoff is in Hz, one of L3GD20HighPassCutoffs for
+	// the DataRate
+	HighPass       bool
+	HighPassMode   byte // L3GD20_HPM_...
+	HighPassCutoff float32
+	// Don't update the output registers until both bytes of a sample are read
+	BlockDataUpdate bool
+}
+
+// The data rates, in the order of CTRL_REG1's DR bits
+var L3GD20DataRates = []int{95, 190, 380, 760}
+
+// The low pass cutoffs for each data rate, in the order of CTRL_REG1's BW bits
+var L3GD20Bandwidths = map[int][]float32{
+	95:  {12.5, 25, 25, 25},
+	190: {12.5, 25, 50, 70},
+	380: {20, 25, 50, 100},
+	760: {30, 35, 50, 100},
+}
+
+// The high pass cutoffs for each data rate, in the order of CTRL_REG2's HPCF bits
+var L3GD20HighPassCutoffs = map[int][]float32{
+	95:  {7.2, 3.5, 1.8, 0.9, 0.45, 0.18, 0.09, 0.045, 0.018, 0.009},
+	190: {13.5, 7.2, 3.5, 1.8, 0.9, 0.45, 0.18, 0.09, 0.045, 0.018},
+	380: {27, 13.5, 7.2, 3.5, 1.8, 0.9, 0.45, 0.18, 0.09, 0.045},
+	760: {51.4, 27, 13.5, 7.2, 3.5, 1.8, 0.9, 0.45, 0.18, 0.09},
+}
+
+// What NewL3GD20 sets the chip up as
+var DefaultL3GD20Config = L3GD20Config{
+	DataRate:       95,
+	Bandwidth:      12.5,
+	Range:          L3GD20_RANGE_250DPS,
+	HighPassMode:   L3GD20_HPM_NORMAL_RESET,
+	HighPassCutoff: 7.2,
+}
+
+// Return the index of value in list, or -1
+func indexOf(list []float32, value float32) int {
+	for i, v := range list {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// Return the register bits for the configuration, or why it's invalid
+func (config L3GD20Config) registers() (ctrl1, ctrl2, ctrl4, ctrl5 byte, err error) {
+	dr := -1
+	for i, rate := range L3GD20DataRates {
+		if rate == config.DataRate {
+			dr = i
+		}
+	}
+	if dr < 0 {
+		err = fmt.Errorf("L3GD20: data rate %vHz isn't one of %v", config.DataRate, L3GD20DataRates)
+		return
+	}
+	bandwidths := L3GD20Bandwidths[config.DataRate]
+	bw := indexOf(bandwidths, config.Bandwidth)
+	if bw < 0 {
+		err = fmt.Errorf("L3GD20: bandwidth %vHz isn't one of %v at %vHz", config.Bandwidth, bandwidths, config.DataRate)
+		return
+	}
+	cutoffs := L3GD20HighPassCutoffs[config.DataRate]
+	hpcf := indexOf(cutoffs, config.HighPassCutoff)
+	if hpcf < 0 {
+		err = fmt.Errorf("L3GD20: high pass cutoff %vHz isn't one of %v at %vHz", config.HighPassCutoff, cutoffs, config.DataRate)
+		return
+	}
+	if config.Range > L3GD20_RANGE_2000DPS {
+		err = fmt.Errorf("L3GD20: invalid range 0x%02X", config.Range)
+		return
+	}
+	if config.HighPassMode > L3GD20_HPM_AUTORESET {
+		err = fmt.Errorf("L3GD20: invalid high pass mode 0x%02X", config.HighPassMode)
+		return
+	}
+
+	ctrl1 = byte(dr)<<6 | byte(bw)<<4 | L3GD20_CTRL_REG1_PD | L3GD20_CTRL_REG1_AXES
+	ctrl2 = config.HighPassMode<<4 | byte(hpcf)
+	ctrl4 = config.Range << 4
+	if config.BlockDataUpdate {
+		ctrl4 |= L3GD20_CTRL_REG4_BDU
+	}
+	switch {
+	case config.LowPass:
+		ctrl5 = L3GD20_OUT_SEL_LPF2
+	case config.HighPass:
+		ctrl5 = L3GD20_OUT_SEL_HPF
+	default:
+		ctrl5 = L3GD20_OUT_SEL_LPF1
+	}
+	if config.HighPass {
+		ctrl5 |= L3GD20_CTRL_REG5_HPEN
+	}
+	return
+}
+
+// Check the configuration is one the chip can do
+func (config L3GD20Config) Validate() (err error) {
+	_, _, _, _, err = config.registers()
+	return
+}
+
+// Set the chip up, nothing is written if the configuration is invalid.
+// CTRL_REG5's bits other than the filters' are left as they are.
+func (bp *L3GD20) Configure(config L3GD20Config) (err error) {
+	var (
+		ctrl1, ctrl2, ctrl4, ctrl5 byte
+		value                      int8
+	)
+	if ctrl1, ctrl2, ctrl4, ctrl5, err = config.registers(); err != nil {
+		return
+	}
+	if value, err = bp.ReadRegister(L3GD20_CTRL_REG5); err != nil {
+		return
+	}
+	ctrl5 |= byte(value) &^ L3GD20_CTRL_REG5_FILTS
+
+	settings := []struct {
+		reg   byte
+		value byte
+	}{
+		{L3GD20_CTRL_REG2, ctrl2},
+		{L3GD20_CTRL_REG4, ctrl4},
+		{L3GD20_CTRL_REG5, ctrl5},
+		{L3GD20_CTRL_REG1, ctrl1},
+	}
+	for _, setting := range settings {
+		if err = bp.WriteRegister(setting.reg, setting.value); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Read back how the chip is set up
+func (bp *L3GD20) ReadConfig() (config L3GD20Config, err error) {
+	var regs [4]int8
+	for i, reg := range []byte{L3GD20_CTRL_REG1, L3GD20_CTRL_REG2, L3GD20_CTRL_REG4, L3GD20_CTRL_REG5} {
+		if regs[i], err = bp.ReadRegister(reg); err != nil {
+			return
+		}
+	}
+	ctrl1, ctrl2, ctrl4, ctrl5 := byte(regs[0]), byte(regs[1]), byte(regs[2]), byte(regs[3])
+
+	config.DataRate = L3GD20DataRates[ctrl1>>6]
+	config.Bandwidth = L3GD20Bandwidths[config.DataRate][(ctrl1>>4)&0x03]
+	config.HighPassMode = (ctrl2 >> 4) & 0x03
+	if hpcf := int(ctrl2 & 0x0F); hpcf < len(L3GD20HighPassCutoffs[config.DataRate]) {
+		config.HighPassCutoff = L3GD20HighPassCutoffs[config.DataRate][hpcf]
+	}
+	config.Range = (ctrl4 >> 4) & 0x03
+	if config.Range > L3GD20_RANGE_2000DPS {
+		// FS 11 is 2000dps as well
+		config.Range = L3GD20_RANGE_2000DPS
+	}
+	config.BlockDataUpdate = ctrl4&L3GD20_CTRL_REG4_BDU != 0
+	config.LowPass = ctrl5&L3GD20_CTRL_REG5_OUT >= L3GD20_OUT_SEL_LPF2
+	config.HighPass = ctrl5&L3GD20_CTRL_REG5_HPEN != 0
+	return
+}
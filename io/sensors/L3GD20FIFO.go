@@ -0,0 +1,131 @@
+package sensors
+
+import (
+	"time"
+)
+
+/**
+* The L3GD20's 32 sample FIFO.  In stream mode the chip keeps the
+* latest 32 samples, and FIFO_SRC_REG says how many are waiting and
+* whether it filled up, in which case the oldest may have been lost.
+* They're all read in one burst, see fifoBuffer.  The chip doesn't stamp
+* its samples, the newest is taken to be from when the FIFO was read and
+* the rest one data rate period apart before it.
+**/
+const (
+	L3GD20_FIFO_SIZE         = 32
+	L3GD20_CTRL_REG5_FIFO_EN = 0x40
+
+	// FIFO_CTRL_REG FM, the FIFO mode, and WTM, the watermark level
+	L3GD20_FM_BYPASS           = 0x00
+	L3GD20_FM_FIFO             = 0x20 // stop once full
+	L3GD20_FM_STREAM           = 0x40 // overwrite the oldest once full
+	L3GD20_FM_STREAM_TO_FIFO   = 0x60
+	L3GD20_FM_BYPASS_TO_STREAM = 0x80
+	L3GD20_FIFO_WTM            = 0x1F
+
+	// FIFO_SRC_REG
+	L3GD20_FIFO_SRC_WTM   = 0x80 // at or above the watermark
+	L3GD20_FIFO_SRC_OVRN  = 0x40 // full
+	L3GD20_FIFO_SRC_EMPTY = 0x20
+	L3GD20_FIFO_SRC_FSS   = 0x1F // samples waiting
+)
+
+// A sample from the FIFO
+type L3GD20Sample struct {
+	When    int64   // nanoseconds, estimated from the data rate
+	X, Y, Z float32 // degrees/s, less the bias and any temperature bias
+}
+
+// Put the FIFO in stream mode
+func (bp *L3GD20) EnableFIFO() (err error) {
+	var ctrl5 int8
+	if ctrl5, err = bp.ReadRegister(L3GD20_CTRL_REG5); err != nil {
+		return
+	}
+	if err = bp.WriteRegister(L3GD20_FIFO_CTRL_REG, L3GD20_FM_STREAM); err == nil {
+		err = bp.WriteRegister(L3GD20_CTRL_REG5, byte(ctrl5)|L3GD20_CTRL_REG5_FIFO_EN)
+	}
+	return
+}
+
+// Turn the FIFO off, back to reading a sample at a time
+func (bp *L3GD20) DisableFIFO() (err error) {
+	var ctrl5 int8
+	if ctrl5, err = bp.ReadRegister(L3GD20_CTRL_REG5); err != nil {
+		return
+	}
+	if err = bp.WriteRegister(L3GD20_CTRL_REG5, byte(ctrl5)&^L3GD20_CTRL_REG5_FIFO_EN); err == nil {
+		err = bp.WriteRegister(L3GD20_FIFO_CTRL_REG, L3GD20_FM_BYPASS)
+	}
+	return
+}
+
+// Return how many samples are waiting in the FIFO, up to max,
+// and whether it filled up
+func (bp *L3GD20) fifoLevel(max int) (n int, overrun bool, err error) {
+	var src int8
+	if src, err = bp.ReadRegister(L3GD20_FIFO_SRC_REG); err == nil {
+		n, overrun = fifoLevel(byte(src), max)
+	}
+	return
+}
+
+// Read n samples from the FIFO into bp.fifo
+func (bp *L3GD20) readFIFO(n int) (err error) {
+	err = bp.fifo.read(bp.bus, bp.addr, L3GD20_OUT_X_L, n)
+	return
+}
+
+// Return the raw values of the i-th sample read into bp.fifo
+func (bp *L3GD20) fifoSample(i int) (x, y, z int16) {
+	x, y, z = bp.fifo.sample(i)
+	return
+}
+
+// Read every sample waiting in the FIFO, up to len(samples), read at now.
+// overrun reports the FIFO had filled up, so samples may have been lost.
+func (bp *L3GD20) ReadFIFO(now int64, samples []L3GD20Sample) (n int, overrun bool, err error) {
+	if n, overrun, err = bp.fifoLevel(len(samples)); err != nil || n == 0 {
+		return
+	}
+	if err = bp.readFIFO(n); err != nil {
+		n = 0
+		return
+	}
+	tx, ty, tz := bp.tempComp.bias()
+	interval := int64(time.Second) / int64(bp.dataRate)
+	for i := 0; i < n; i++ {
+		x, y, z := bp.fifoSample(i)
+		bx, by, bz := bp.convert(float32(x), float32(y), float32(z))
+		samples[i] = L3GD20Sample{
+			When: now - int64(n-1-i)*interval,
+			X:    bx - tx,
+			Y:    by - ty,
+			Z:    bz - tz,
+		}
+	}
+	return
+}
+
+// Take every sample waiting in the FIFO, as Measure takes one
+func (bp *L3GD20) MeasureFIFO(now int64) (n int, overrun bool, err error) {
+	if err = bp.tempComp.refresh(bp.ReadCelsius); err != nil {
+		return
+	}
+	if n, overrun, err = bp.fifoLevel(L3GD20_FIFO_SIZE); err != nil || n == 0 {
+		return
+	}
+	if err = bp.readFIFO(n); err != nil {
+		n = 0
+		return
+	}
+	for i := 0; i < n; i++ {
+		x, y, z := bp.fifoSample(i)
+		bp.sampleX += int(x)
+		bp.sampleY += int(y)
+		bp.sampleZ += int(z)
+	}
+	bp.sampleCnt += n
+	return
+}
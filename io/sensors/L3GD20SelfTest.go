@@ -0,0 +1,84 @@
+package sensors
+
+import (
+	"time"
+)
+
+/**
+* The L3GD20's self-test, CTRL_REG4's ST bits.  With them set an
+* electrostatic force acts on the sensing mass, shifting the output as
+* though the chip were turning.  The test is run at 2000dps, where the
+* shift can't saturate, and passes if every axis shifts by an amount in
+* the limits of ST's self-test procedure.  Run it with the FIFO off and
+* the chip still.
+**/
+const (
+	L3GD20_CTRL_REG4_ST = 0x06 // self-test mode
+	L3GD20_ST_NORMAL    = 0x00
+	L3GD20_ST_POSITIVE  = 0x02 // self-test 0
+	L3GD20_ST_NEGATIVE  = 0x06 // self-test 1
+
+	// The limits of the shift at 2000dps, in degrees/s
+	L3GD20_SELFTEST_MIN = 175
+	L3GD20_SELFTEST_MAX = 875
+)
+
+// Run the hardware self-test, putting CTRL_REG4 back as it was after it
+func (bp *L3GD20) SelfTest() (report SelfTestReport, err error) {
+	report = newSelfTestReport(bp.Name(), true)
+	var ctrl4 int8
+	if ctrl4, err = bp.ReadRegister(L3GD20_CTRL_REG4); err != nil {
+		return
+	}
+	defer func() {
+		// Restore the configuration however the test ended
+		if restore := bp.WriteRegister(L3GD20_CTRL_REG4, byte(ctrl4)); err == nil {
+			err = restore
+		}
+	}()
+
+	test := byte(ctrl4)&^(0x30|L3GD20_CTRL_REG4_ST) | L3GD20_RANGE_2000DPS<<4 | L3GD20_CTRL_REG4_BDU
+	var before, after [3]float32
+	if err = bp.WriteRegister(L3GD20_CTRL_REG4, test); err != nil {
+		return
+	}
+	if before, err = bp.selfTestReading(); err != nil {
+		return
+	}
+	if err = bp.WriteRegister(L3GD20_CTRL_REG4, test|L3GD20_ST_POSITIVE); err != nil {
+		return
+	}
+	if after, err = bp.selfTestReading(); err != nil {
+		return
+	}
+	for axis, name := range []string{"X shift", "Y shift", "Z shift"} {
+		shift := after[axis] - before[axis]
+		if shift < 0 {
+			shift = -shift
+		}
+		report.check(name, shift, L3GD20_SELFTEST_MIN, L3GD20_SELFTEST_MAX, "dps")
+	}
+	return
+}
+
+// Wait for the setting to settle, then return the average of
+// SELFTEST_SAMPLES samples in degrees/s, without the bias
+func (bp *L3GD20) selfTestReading() (avg [3]float32, err error) {
+	period := time.Second / time.Duration(bp.dataRate)
+	time.Sleep(SELFTEST_SETTLE * period)
+	for i := 0; i < SELFTEST_SAMPLES; i++ {
+		var x, y, z int16
+		if x, y, z, err = bp.ReadRaw(); err != nil {
+			return
+		}
+		avg[0] += float32(x)
+		avg[1] += float32(y)
+		avg[2] += float32(z)
+		time.Sleep(period)
+	}
+	scale := bp.sensitivity() / SELFTEST_SAMPLES
+	for axis := range avg {
+		avg[axis] *= scale
+	}
+	return
+}
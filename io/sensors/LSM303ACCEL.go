@@ -8,12 +8,17 @@ import (
 /**
 * The LSM303ACCEL is a triple-axis Accelerometer.
 * The LSM303 has two devices on it, this code accesses the Accelerometer.
+* Its output is left justified, 12 bits in high resolution mode, 10 in
+* normal mode and 8 in low power mode, and read out in m/s^2.
 **/
 const (
 	LSM303ACCEL_ADDR          = 0x19
+	LSM303ACCEL_ADDR_ALT      = 0x18    // SA0 pulled low
+	LSM303ACCEL_ID            = 0x33    // WHO_AM_I of the LSM303DLHC accelerometer
 	LSM303ACCEL_GRAVITY_EARTH = 9.80665 // Earth's gravity in m/s^2
 	LSM303ACCEL_Accel_MG_LSB  = 0.001   // 1, 2, 4 or 12 mg per lsb
 
+	LSM303ACCEL_WHO_AM_I      = 0x0F // 00110011   r
 	LSM303ACCEL_CTRL_REG1     = 0x20 // 00000111   rw
 	LSM303ACCEL_CTRL_REG2     = 0x21 // 00000000   rw
 	LSM303ACCEL_CTRL_REG3     = 0x22 // 00000000   rw
@@ -44,10 +49,24 @@ const (
 	LSM303ACCEL_TIME_LIMIT    = 0x3B
 	LSM303ACCEL_TIME_LATENCY  = 0x3C
 	LSM303ACCEL_TIME_WINDOW   = 0x3D
+
+	LSM303ACCEL_RANGE_2G  = 0x00
+	LSM303ACCEL_RANGE_4G  = 0x01
+	LSM303ACCEL_RANGE_8G  = 0x02
+	LSM303ACCEL_RANGE_16G = 0x03
+
+	// g/digit of the 12 bit value
+	LSM303ACCEL_SENSITIVITY_2G  = LSM303ACCEL_Accel_MG_LSB
+	LSM303ACCEL_SENSITIVITY_4G  = 2 * LSM303ACCEL_Accel_MG_LSB
+	LSM303ACCEL_SENSITIVITY_8G  = 4 * LSM303ACCEL_Accel_MG_LSB
+	LSM303ACCEL_SENSITIVITY_16G = 12 * LSM303ACCEL_Accel_MG_LSB
 )
 
 type LSM303ACCEL struct {
-	bus       *i2c.I2CBus
+	bus       i2c.Transport
+	addr      byte
+	gRange    byte
+	dataRate  int // Hz, as set in CTRL_REG1
 	biasX     float32
 	biasY     float32
 	biasZ     float32
@@ -55,21 +74,57 @@ type LSM303ACCEL struct {
 	sampleY   int
 	sampleZ   int
 	sampleCnt int
+	buffer    [6]byte // every read goes here, so reading doesn't allocate
+	fifo      fifoBuffer
+	// how the chip is mounted on the board
+	orientation Orientation
+	// offset and scale calibration, nil for none
+	calibration *AccelCalibration
 }
 
 // Return a new Device
 func NewLSM303ACCEL() (bp *LSM303ACCEL, err error) {
+	bp, err = NewLSM303ACCELWith()
+	return
+}
+
+// Return a new Device on the given bus
+func NewLSM303ACCELOnBus(bus i2c.Transport) (bp *LSM303ACCEL, err error) {
+	bp, err = NewLSM303ACCELWith(WithTransport(bus))
+	return
+}
+
+// Return a new Device set up by the options, or a DriverError saying why
+// there isn't one
+func NewLSM303ACCELWith(opts ...Option) (bp *LSM303ACCEL, err error) {
+	var o options
+	if o, err = applyOptions(LSM303ACCEL_ADDR, opts); err != nil {
+		err = driverError("LSM303ACCEL", o.addr, err)
+		return
+	}
+	// Make sure it's the chip before writing to it
+	if _, err = identify(o.bus, o.addr, "LSM303ACCEL"); err != nil {
+		return
+	}
 	bp = new(LSM303ACCEL)
-	bp.bus, err = i2c.Bus(1)
-	// Turn it on, enable all 3 axis
-	err = bp.bus.WriteByte(LSM303ACCEL_ADDR, LSM303ACCEL_CTRL_REG1, 0x27)
+	bp.bus = o.bus
+	bp.addr = o.addr
+	bp.orientation = o.orientation
+	// Turn it on, enable all 3 axis, at 10Hz and 2g
+	err = bp.Configure(DefaultLSM303ACCELConfig)
+	if err == nil {
+		err = o.writeRegisters(bp.WriteRegister)
+	}
+	if err != nil {
+		bp, err = nil, driverError("LSM303ACCEL", o.addr, err)
+	}
 	return
 }
 
 // Read a byte from the specified register
 func (bp *LSM303ACCEL) ReadRegister(reg byte) (value int8, err error) {
-	var bytes []byte
-	bytes, err = bp.bus.ReadByteBlock(LSM303ACCEL_ADDR, reg, 1)
+	bytes := bp.buffer[:1]
+	err = i2c.ReadBlockInto(bp.bus, bp.addr, reg, bytes)
 	if err == nil {
 		value = int8(bytes[0])
 	}
@@ -78,14 +133,32 @@ func (bp *LSM303ACCEL) ReadRegister(reg byte) (value int8, err error) {
 
 // Write a byte to the specified register
 func (bp *LSM303ACCEL) WriteRegister(reg byte, data byte) (err error) {
-	err = bp.bus.WriteByte(LSM303ACCEL_ADDR, reg, data)
+	err = bp.bus.WriteByte(bp.addr, reg, data)
+	if err == nil && reg == LSM303ACCEL_CTRL_REG4 {
+		bp.gRange = (data >> 4) & 0x03
+	}
+	if err == nil && reg == LSM303ACCEL_CTRL_REG1 {
+		bp.dataRate = lsm303accelDataRate(data)
+	}
 	return
 }
 
+// Return the m/s^2 per digit of the raw, left justified, value
+// for the range set in CTRL_REG4
+func (bp *LSM303ACCEL) scale() float32 {
+	sensitivity := [4]float32{
+		LSM303ACCEL_SENSITIVITY_2G,
+		LSM303ACCEL_SENSITIVITY_4G,
+		LSM303ACCEL_SENSITIVITY_8G,
+		LSM303ACCEL_SENSITIVITY_16G,
+	}[bp.gRange]
+	return sensitivity * LSM303ACCEL_GRAVITY_EARTH / 16
+}
+
 // Read the raw x, y, z values from their registers
 func (bp *LSM303ACCEL) ReadRaw() (x, y, z int16, err error) {
-	var bytes []byte
-	bytes, err = bp.bus.ReadByteBlock(LSM303ACCEL_ADDR, LSM303ACCEL_OUT_X_L|0x80, 6)
+	bytes := bp.buffer[:6]
+	err = i2c.ReadBlockInto(bp.bus, bp.addr, LSM303ACCEL_OUT_X_L|0x80, bytes)
 	if err == nil {
 		// Extract the values
 		x = int16(uint16(bytes[0]) | (uint16(bytes[1]) << 8))
@@ -95,24 +168,40 @@ func (bp *LSM303ACCEL) ReadRaw() (x, y, z int16, err error) {
 	return
 }
 
-// Return adjusted x, y, z values
+// Return adjusted x, y, z values in m/s^2
 func (bp *LSM303ACCEL) ReadXYZ() (x, y, z float32, err error) {
 	var (
 		xi, yi, zi int16
 	)
 	xi, yi, zi, err = bp.ReadRaw()
 	if err == nil {
-		x = float32(xi) - bp.biasX
-		y = float32(yi) - bp.biasY
-		z = float32(zi) - bp.biasZ
+		x, y, z = bp.convert(float32(xi), float32(yi), float32(zi))
+	}
+	return
+}
+
+// Return raw values in m/s^2 in the board's axes, less the bias
+func (bp *LSM303ACCEL) scaled(xi, yi, zi float32) (x, y, z float32) {
+	scale := bp.scale()
+	x = (xi - bp.biasX) * scale
+	y = (yi - bp.biasY) * scale
+	z = (zi - bp.biasZ) * scale
+	x, y, z = bp.orientation.Apply(x, y, z)
+	return
+}
+
+// Return raw values in m/s^2, less the bias, calibrated
+func (bp *LSM303ACCEL) convert(xi, yi, zi float32) (x, y, z float32) {
+	x, y, z = bp.scaled(xi, yi, zi)
+	if bp.calibration != nil {
+		x, y, z = bp.calibration.Apply(x, y, z)
 	}
 	return
 }
 
-// Take a sample
-func (bp *LSM303ACCEL) Measure() {
+// Take a sample, a failed read is returned rather than counted as a sample
+func (bp *LSM303ACCEL) Measure() (err error) {
 	var (
-		err     error
 		x, y, z int16
 	)
 	x, y, z, err = bp.ReadRaw()
@@ -122,14 +211,14 @@ func (bp *LSM303ACCEL) Measure() {
 		bp.sampleZ += int(z)
 		bp.sampleCnt++
 	}
+	return
 }
 
-// Evaluate the samples
+// Evaluate the samples, in m/s^2
 func (bp *LSM303ACCEL) Evaluate() (x, y, z float32, err error) {
 	if bp.sampleCnt > 0 {
-		x = float32(bp.sampleX/bp.sampleCnt) - bp.biasX
-		y = float32(bp.sampleY/bp.sampleCnt) - bp.biasY
-		z = float32(bp.sampleZ/bp.sampleCnt) - bp.biasZ
+		n := float32(bp.sampleCnt)
+		x, y, z = bp.convert(float32(bp.sampleX)/n, float32(bp.sampleY)/n, float32(bp.sampleZ)/n)
 		bp.sampleCnt, bp.sampleX, bp.sampleY, bp.sampleZ = 0, 0, 0, 0
 	} else {
 		err = errors.New("No accelerometer samples to Evaluate")
@@ -137,15 +226,34 @@ func (bp *LSM303ACCEL) Evaluate() (x, y, z float32, err error) {
 	return
 }
 
-// Compute bias from samples
+// Compute bias from samples taken with the copter level and still, less
+// the 1g of gravity on the board's Z
 func (bp *LSM303ACCEL) ComputeBias() (err error) {
 	if bp.sampleCnt > 0 {
-		bp.biasX = float32(bp.sampleX / bp.sampleCnt)
-		bp.biasY = float32(bp.sampleY / bp.sampleCnt)
-		bp.biasZ = float32(bp.sampleZ / bp.sampleCnt)
+		n := float32(bp.sampleCnt)
+		gx, gy, gz := bp.orientation.ToChip(0, 0, LSM303ACCEL_GRAVITY_EARTH/bp.scale())
+		bp.biasX = float32(bp.sampleX)/n - gx
+		bp.biasY = float32(bp.sampleY)/n - gy
+		bp.biasZ = float32(bp.sampleZ)/n - gz
 		bp.sampleCnt, bp.sampleX, bp.sampleY, bp.sampleZ = 0, 0, 0, 0
 	} else {
 		err = errors.New("No accelerometer samples to ComputeBias")
 	}
 	return
 }
+
+// Return the driver's name
+func (bp *LSM303ACCEL) Name() string {
+	return "LSM303ACCEL"
+}
+
+// Return the chip's address on its bus
+func (bp *LSM303ACCEL) Address() byte {
+	return bp.addr
+}
+
+// Read the chip's WHO_AM_I register
+func (bp *LSM303ACCEL) Identity() (id Identity, err error) {
+	id, err = identify(bp.bus, bp.addr, "LSM303ACCEL")
+	return
+}
@@ -0,0 +1,273 @@
+package sensors
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+/**
+* Six position calibration of the accelerometer's offset and scale.  The
+* copter is put down still with each axis pointing straight up, then
+* straight down, so each axis reads +1g and -1g: the offset is half way
+* between and the scale makes the difference 2g.  With CrossAxis the
+* calibration fits a full matrix by least squares instead, correcting
+* axes that aren't quite square to each other or to the board too.
+* Readings are only taken once the accelerometer has kept still, its
+* readings' spread under LSM303ACCEL_STILL_NOISE, for a window of
+* LSM303ACCEL_STILL_SAMPLES.
+**/
+const (
+	LSM303ACCEL_STILL_SAMPLES = 50   // readings in the window that must be still
+	LSM303ACCEL_STILL_NOISE   = 0.05 // m/s^2, standard deviation of each axis
+	LSM303ACCEL_STILL_GRAVITY = 0.2  // how far from 1g a still reading may be, uncalibrated, as a fraction
+	// How close to straight up an axis must be for the pose to count
+	LSM303ACCEL_POSE_ALIGNMENT = 0.9
+)
+
+// A pose to calibrate in, and the gravity it reads, in g
+type AccelPose struct {
+	Name    string
+	Gravity [3]float32
+}
+
+// The six poses, each axis up and down
+var AccelPoses = []AccelPose{
+	{"level, Z up", [3]float32{0, 0, 1}},
+	{"upside down, Z down", [3]float32{0, 0, -1}},
+	{"on its side, X up", [3]float32{1, 0, 0}},
+	{"on its side, X down", [3]float32{-1, 0, 0}},
+	{"on its end, Y up", [3]float32{0, 1, 0}},
+	{"on its end, Y down", [3]float32{0, -1, 0}},
+}
+
+// An accelerometer calibration, corrected = Matrix * (reading - Offset)
+type AccelCalibration struct {
+	Offset [3]float32    // in m/s^2
+	Matrix [3][3]float32 // scale, and with cross axis terms off the diagonal
+}
+
+// Return the calibrated x, y, z
+func (cal *AccelCalibration) Apply(x, y, z float32) (cx, cy, cz float32) {
+	dx, dy, dz := x-cal.Offset[0], y-cal.Offset[1], z-cal.Offset[2]
+	m := &cal.Matrix
+	cx = m[0][0]*dx + m[0][1]*dy + m[0][2]*dz
+	cy = m[1][0]*dx + m[1][1]*dy + m[1][2]*dz
+	cz = m[2][0]*dx + m[2][1]*dy + m[2][2]*dz
+	return
+}
+
+// Collects the still readings in each of the six poses, and fits a
+// calibration to them
+type AccelCalibrator struct {
+	CrossAxis bool // fit cross axis terms, not just offset and scale
+	readings  [6][3]float32
+	have      [6]bool
+}
+
+// Return the first pose that hasn't been read yet, done once they all have
+func (c *AccelCalibrator) Next() (pose int, done bool) {
+	for pose = range c.have {
+		if !c.have[pose] {
+			return
+		}
+	}
+	done = true
+	return
+}
+
+// Add a still reading, in m/s^2, returning which pose it's in and
+// whether that pose is new.  A reading with no axis near enough
+// straight up or down isn't in any of them.
+func (c *AccelCalibrator) Add(x, y, z float32) (pose int, isNew bool, err error) {
+	reading := [3]float32{x, y, z}
+	length := magnitude(x, y, z)
+	axis := 0
+	for i := range reading {
+		if math.Abs(float64(reading[i])) > math.Abs(float64(reading[axis])) {
+			axis = i
+		}
+	}
+	if length == 0 || float32(math.Abs(float64(reading[axis])))/length < LSM303ACCEL_POSE_ALIGNMENT {
+		err = fmt.Errorf("sensors: accelerometer reading %.2f, %.2f, %.2f isn't one of the six poses", x, y, z)
+		return
+	}
+	for pose = range AccelPoses {
+		if AccelPoses[pose].Gravity[axis]*reading[axis] > 0 {
+			break
+		}
+	}
+	isNew = !c.have[pose]
+	c.readings[pose], c.have[pose] = reading, true
+	return
+}
+
+// Fit the calibration to the readings in all six poses
+func (c *AccelCalibrator) Fit() (cal AccelCalibration, err error) {
+	if pose, done := c.Next(); !done {
+		err = fmt.Errorf("sensors: no accelerometer reading %s", AccelPoses[pose].Name)
+		return
+	}
+	if !c.CrossAxis {
+		for pose := 0; pose < 6; pose += 2 {
+			// the poses come in pairs, an axis up then down
+			axis := 0
+			for i, g := range AccelPoses[pose].Gravity {
+				if g != 0 {
+					axis = i
+				}
+			}
+			up, down := c.readings[pose][axis], c.readings[pose+1][axis]
+			if up <= down {
+				err = fmt.Errorf("sensors: accelerometer reads no more %s than %s", AccelPoses[pose].Name, AccelPoses[pose+1].Name)
+				return
+			}
+			cal.Offset[axis] = (up + down) / 2
+			cal.Matrix[axis][axis] = 2 * LSM303ACCEL_GRAVITY_EARTH / (up - down)
+		}
+		return
+	}
+
+	// Each axis of gravity is a linear function of the readings,
+	// g = a x + b y + c z + d, fitted by least squares over the poses
+	var a [3][3]float64
+	var d [3]float64
+	for row := 0; row < 3; row++ {
+		normal := make([][]float64, 4)
+		for i := range normal {
+			normal[i] = make([]float64, 5)
+		}
+		for pose, r := range c.readings {
+			terms := [4]float64{float64(r[0]), float64(r[1]), float64(r[2]), 1}
+			g := float64(AccelPoses[pose].Gravity[row]) * LSM303ACCEL_GRAVITY_EARTH
+			for i, t := range terms {
+				for j, u := range terms {
+					normal[i][j] += t * u
+				}
+				normal[i][4] += t * g
+			}
+		}
+		p, ok := solve(normal)
+		if !ok {
+			err = errors.New("sensors: the accelerometer readings can't be fitted")
+			return
+		}
+		copy(a[row][:], p[:3])
+		d[row] = p[3]
+	}
+	// g = A r + d = A (r - offset), so A offset = -d
+	centre := make([][]float64, 3)
+	for row := range centre {
+		centre[row] = []float64{a[row][0], a[row][1], a[row][2], -d[row]}
+	}
+	offset, ok := solve(centre)
+	if !ok {
+		err = errors.New("sensors: the accelerometer readings can't be fitted")
+		return
+	}
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			cal.Matrix[row][col] = float32(a[row][col])
+		}
+		cal.Offset[row] = float32(offset[row])
+	}
+	return
+}
+
+// Correct what's read from now on with the calibration, nil turns it off
+func (bp *LSM303ACCEL) SetCalibration(cal *AccelCalibration) {
+	bp.calibration = cal
+}
+
+// Wait until the accelerometer has kept still for LSM303ACCEL_STILL_SAMPLES
+// readings, and return their average in m/s^2, less the bias but not
+// calibrated.  ErrMoving if it hasn't kept still by the timeout.
+func (bp *LSM303ACCEL) WaitStill(timeout time.Duration) (x, y, z float32, err error) {
+	if bp.dataRate == 0 {
+		err = errors.New("LSM303ACCEL: can't wait for stillness powered down")
+		return
+	}
+	period := time.Second / time.Duration(bp.dataRate)
+	deadline := time.Now().Add(timeout)
+	var window [LSM303ACCEL_STILL_SAMPLES][3]float32
+	for n := 0; ; n++ {
+		var xi, yi, zi int16
+		if xi, yi, zi, err = bp.ReadRaw(); err != nil {
+			return
+		}
+		r := &window[n%len(window)]
+		r[0], r[1], r[2] = bp.scaled(float32(xi), float32(yi), float32(zi))
+		if n+1 >= len(window) {
+			mean, spread := meanSpread(window[:])
+			g := magnitude(mean[0], mean[1], mean[2]) / LSM303ACCEL_GRAVITY_EARTH
+			still := math.Abs(float64(g-1)) < LSM303ACCEL_STILL_GRAVITY
+			for _, s := range spread {
+				still = still && s < LSM303ACCEL_STILL_NOISE
+			}
+			if still {
+				x, y, z = mean[0], mean[1], mean[2]
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			err = fmt.Errorf("LSM303ACCEL: %w after %v", ErrMoving, timeout)
+			return
+		}
+		time.Sleep(period)
+	}
+}
+
+// Return the mean and standard deviation of each axis of the readings
+func meanSpread(readings [][3]float32) (mean, spread [3]float32) {
+	n := float32(len(readings))
+	for _, r := range readings {
+		for axis := range mean {
+			mean[axis] += r[axis] / n
+		}
+	}
+	for _, r := range readings {
+		for axis := range spread {
+			d := r[axis] - mean[axis]
+			spread[axis] += d * d / n
+		}
+	}
+	for axis := range spread {
+		spread[axis] = float32(math.Sqrt(float64(spread[axis])))
+	}
+	return
+}
+
+// Calibrate in the six poses, calling prompt with each pose the copter
+// should be put down in, and correct what's read with the calibration
+// from then on.  A still reading in a pose that's already been read, or
+// in none of them, is passed over until the copter's moved on, for up to
+// timeout for each pose.
+func (bp *LSM303ACCEL) CalibrateSixPosition(crossAxis bool, timeout time.Duration, prompt func(pose AccelPose)) (cal AccelCalibration, err error) {
+	c := AccelCalibrator{CrossAxis: crossAxis}
+	for {
+		pose, done := c.Next()
+		if done {
+			break
+		}
+		prompt(AccelPoses[pose])
+		deadline := time.Now().Add(timeout)
+		for isNew := false; !isNew; {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				err = fmt.Errorf("LSM303ACCEL: not put down %s: %w after %v", AccelPoses[pose].Name, ErrMoving, timeout)
+				return
+			}
+			var x, y, z float32
+			if x, y, z, err = bp.WaitStill(remaining); err != nil {
+				return
+			}
+			// a reading in none of the poses is as good as moving
+			_, isNew, _ = c.Add(x, y, z)
+		}
+	}
+	if cal, err = c.Fit(); err == nil {
+		bp.SetCalibration(&cal)
+	}
+	return
+}
@@ -0,0 +1,126 @@
+package sensors
+
+import (
+	"fmt"
+)
+
+/**
+* Typed configuration of the LSM303 accelerometer's output data rate,
+* full scale, resolution and block data update, as laid out in CTRL_REG1
+* and CTRL_REG4.  Low power mode trades resolution, 8 bits, for the two
+* fastest data rates; high resolution mode gives 12 bits, and can't be
+* had in low power mode.
+**/
+const (
+	LSM303ACCEL_CTRL_REG1_LPEN = 0x08 // low power mode
+	LSM303ACCEL_CTRL_REG1_AXES = 0x07 // Z, Y and X enabled
+	LSM303ACCEL_CTRL_REG4_BDU  = 0x80
+	LSM303ACCEL_CTRL_REG4_HR   = 0x08 // high resolution mode
+)
+
+type LSM303ACCELConfig struct {
+	DataRate        int  // output data rate in Hz, one of LSM303ACCELDataRates
+	Range           byte // LSM303ACCEL_RANGE_2G, _4G, _8G or _16G
+	HighResolution  bool // 12 bit output, rather than 10
+	LowPower        bool // 8 bit output, with the data rates of LSM303ACCELLowPowerDataRates
+	BlockDataUpdate bool // don't update the output registers until both bytes of a sample are read
+}
+
+// The data rates, in the order of CTRL_REG1's ODR bits.  ODR 0 is power
+// down, and ODR 8 is only there in low power mode.
+var LSM303ACCELDataRates = []int{0, 1, 10, 25, 50, 100, 200, 400, 0, 1344}
+
+// The data rates in low power mode, where ODR 9 is faster
+var LSM303ACCELLowPowerDataRates = []int{0, 1, 10, 25, 50, 100, 200, 400, 1620, 5376}
+
+// What NewLSM303ACCEL sets the chip up as
+var DefaultLSM303ACCELConfig = LSM303ACCELConfig{
+	DataRate: 10,
+	Range:    LSM303ACCEL_RANGE_2G,
+}
+
+// Return the data rate CTRL_REG1 selects, 0 when powered down
+func lsm303accelDataRate(ctrl1 byte) int {
+	rates := LSM303ACCELDataRates
+	if ctrl1&LSM303ACCEL_CTRL_REG1_LPEN != 0 {
+		rates = LSM303ACCELLowPowerDataRates
+	}
+	if odr := int(ctrl1 >> 4); odr < len(rates) {
+		return rates[odr]
+	}
+	return 0
+}
+
+// Return the register bits for the configuration, or why it's invalid
+func (config LSM303ACCELConfig) registers() (ctrl1, ctrl4 byte, err error) {
+	rates, mode := LSM303ACCELDataRates, "normal"
+	if config.LowPower {
+		rates, mode = LSM303ACCELLowPowerDataRates, "low power"
+	}
+	odr := -1
+	for i, rate := range rates {
+		if rate > 0 && rate == config.DataRate {
+			odr = i
+		}
+	}
+	if odr < 0 {
+		err = fmt.Errorf("LSM303ACCEL: there's no %vHz data rate in %v mode", config.DataRate, mode)
+		return
+	}
+	if config.Range > LSM303ACCEL_RANGE_16G {
+		err = fmt.Errorf("LSM303ACCEL: invalid range 0x%02X", config.Range)
+		return
+	}
+	if config.HighResolution && config.LowPower {
+		err = fmt.Errorf("LSM303ACCEL: high resolution mode isn't available in low power mode")
+		return
+	}
+
+	ctrl1 = byte(odr)<<4 | LSM303ACCEL_CTRL_REG1_AXES
+	if config.LowPower {
+		ctrl1 |= LSM303ACCEL_CTRL_REG1_LPEN
+	}
+	ctrl4 = config.Range << 4
+	if config.HighResolution {
+		ctrl4 |= LSM303ACCEL_CTRL_REG4_HR
+	}
+	if config.BlockDataUpdate {
+		ctrl4 |= LSM303ACCEL_CTRL_REG4_BDU
+	}
+	return
+}
+
+// Check the configuration is one the chip can do
+func (config LSM303ACCELConfig) Validate() (err error) {
+	_, _, err = config.registers()
+	return
+}
+
+// Set the chip up, nothing is written if the configuration is invalid
+func (bp *LSM303ACCEL) Configure(config LSM303ACCELConfig) (err error) {
+	var ctrl1, ctrl4 byte
+	if ctrl1, ctrl4, err = config.registers(); err != nil {
+		return
+	}
+	if err = bp.WriteRegister(LSM303ACCEL_CTRL_REG4, ctrl4); err == nil {
+		err = bp.WriteRegister(LSM303ACCEL_CTRL_REG1, ctrl1)
+	}
+	return
+}
+
+// Read back how the chip is set up
+func (bp *LSM303ACCEL) ReadConfig() (config LSM303ACCELConfig, err error) {
+	var ctrl1, ctrl4 int8
+	if ctrl1, err = bp.ReadRegister(LSM303ACCEL_CTRL_REG1); err != nil {
+		return
+	}
+	if ctrl4, err = bp.ReadRegister(LSM303ACCEL_CTRL_REG4); err != nil {
+		return
+	}
+	config.DataRate = lsm303accelDataRate(byte(ctrl1))
+	config.LowPower = byte(ctrl1)&LSM303ACCEL_CTRL_REG1_LPEN != 0
+	config.Range = (byte(ctrl4) >> 4) & 0x03
+	config.HighResolution = byte(ctrl4)&LSM303ACCEL_CTRL_REG4_HR != 0
+	config.BlockDataUpdate = byte(ctrl4)&LSM303ACCEL_CTRL_REG4_BDU != 0
+	return
+}
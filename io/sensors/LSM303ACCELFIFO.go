@@ -0,0 +1,110 @@
+package sensors
+
+import (
+	"time"
+)
+
+/**
+* The LSM303 accelerometer's 32 sample FIFO, the same as the L3GD20's
+* but for where FIFO_CTRL_REG keeps the mode.  In stream mode the chip
+* keeps the latest 32 samples, and they're read in one burst, see
+* fifoBuffer, with the newest taken to be from when the FIFO was read
+* and the rest one data rate period apart before it.
+**/
+const (
+	LSM303ACCEL_FIFO_SIZE         = 32
+	LSM303ACCEL_CTRL_REG5_FIFO_EN = 0x40
+
+	// FIFO_CTRL_REG FM, the FIFO mode, TR, the trigger, and FTH, the watermark level
+	LSM303ACCEL_FM_BYPASS  = 0x00
+	LSM303ACCEL_FM_FIFO    = 0x40 // stop once full
+	LSM303ACCEL_FM_STREAM  = 0x80 // overwrite the oldest once full
+	LSM303ACCEL_FM_TRIGGER = 0xC0 // stream until triggered, then FIFO
+	LSM303ACCEL_FIFO_TR    = 0x20 // trigger on INT2 rather than INT1
+	LSM303ACCEL_FIFO_FTH   = 0x1F
+
+	// FIFO_SRC_REG
+	LSM303ACCEL_FIFO_SRC_WTM   = 0x80 // at or above the watermark
+	LSM303ACCEL_FIFO_SRC_OVRN  = 0x40 // full
+	LSM303ACCEL_FIFO_SRC_EMPTY = 0x20
+	LSM303ACCEL_FIFO_SRC_FSS   = 0x1F // samples waiting
+)
+
+// A sample from the FIFO
+type LSM303ACCELSample struct {
+	When    int64   // nanoseconds, estimated from the data rate
+	X, Y, Z float32 // m/s^2, less the bias
+}
+
+// Put the FIFO in stream mode
+func (bp *LSM303ACCEL) EnableFIFO() (err error) {
+	var ctrl5 int8
+	if ctrl5, err = bp.ReadRegister(LSM303ACCEL_CTRL_REG5); err != nil {
+		return
+	}
+	if err = bp.WriteRegister(LSM303ACCEL_FIFO_CTRL_REG, LSM303ACCEL_FM_STREAM); err == nil {
+		err = bp.WriteRegister(LSM303ACCEL_CTRL_REG5, byte(ctrl5)|LSM303ACCEL_CTRL_REG5_FIFO_EN)
+	}
+	return
+}
+
+// Turn the FIFO off, back to reading a sample at a time
+func (bp *LSM303ACCEL) DisableFIFO() (err error) {
+	var ctrl5 int8
+	if ctrl5, err = bp.ReadRegister(LSM303ACCEL_CTRL_REG5); err != nil {
+		return
+	}
+	if err = bp.WriteRegister(LSM303ACCEL_CTRL_REG5, byte(ctrl5)&^LSM303ACCEL_CTRL_REG5_FIFO_EN); err == nil {
+		err = bp.WriteRegister(LSM303ACCEL_FIFO_CTRL_REG, LSM303ACCEL_FM_BYPASS)
+	}
+	return
+}
+
+// Return how many samples are waiting in the FIFO, up to max,
+// and whether it filled up, having read them into bp.fifo
+func (bp *LSM303ACCEL) readFIFO(max int) (n int, overrun bool, err error) {
+	var src int8
+	if src, err = bp.ReadRegister(LSM303ACCEL_FIFO_SRC_REG); err != nil {
+		return
+	}
+	if n, overrun = fifoLevel(byte(src), max); n == 0 {
+		return
+	}
+	if err = bp.fifo.read(bp.bus, bp.addr, LSM303ACCEL_OUT_X_L, n); err != nil {
+		n = 0
+	}
+	return
+}
+
+// Read every sample waiting in the FIFO, up to len(samples), read at now.
+// overrun reports the FIFO had filled up, so samples may have been lost.
+func (bp *LSM303ACCEL) ReadFIFO(now int64, samples []LSM303ACCELSample) (n int, overrun bool, err error) {
+	if n, overrun, err = bp.readFIFO(len(samples)); err != nil || n == 0 {
+		return
+	}
+	var interval int64
+	if bp.dataRate > 0 {
+		interval = int64(time.Second) / int64(bp.dataRate)
+	}
+	for i := 0; i < n; i++ {
+		x, y, z := bp.fifo.sample(i)
+		samples[i].When = now - int64(n-1-i)*interval
+		samples[i].X, samples[i].Y, samples[i].Z = bp.convert(float32(x), float32(y), float32(z))
+	}
+	return
+}
+
+// Take every sample waiting in the FIFO, as Measure takes one
+func (bp *LSM303ACCEL) MeasureFIFO(now int64) (n int, overrun bool, err error) {
+	if n, overrun, err = bp.readFIFO(LSM303ACCEL_FIFO_SIZE); err != nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		x, y, z := bp.fifo.sample(i)
+		bp.sampleX += int(x)
+		bp.sampleY += int(y)
+		bp.sampleZ += int(z)
+	}
+	bp.sampleCnt += n
+	return
+}
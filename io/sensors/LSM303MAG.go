@@ -1,6 +1,8 @@
 package sensors
 
 import (
+	"errors"
+	"fmt"
 	"goPiCopter/io/sensors/i2c"
 )
 
@@ -11,6 +13,9 @@ import (
 const (
 	LSM303MAG_ADDR                        = 0x1E
 	LSM303MAG_SENSORS_GAUSS_TO_MICROTESLA = 100
+	LSM303MAG_IRA_ID                      = 'H' // identification registers read "H43"
+	LSM303MAG_IRB_ID                      = '4'
+	LSM303MAG_IRC_ID                      = '3'
 
 	LSM303MAG_CRA_REG    = 0x00
 	LSM303MAG_CRB_REG    = 0x01
@@ -21,7 +26,7 @@ const (
 	LSM303MAG_OUT_Z_L    = 0x06
 	LSM303MAG_OUT_Y_H    = 0x07
 	LSM303MAG_OUT_Y_L    = 0x08
-	LSM303MAG_SR_REGg    = 0x09
+	LSM303MAG_SR_REGg    = 0x09 // misspelt, see LSM303MAG_SR_REG
 	LSM303MAG_IRA_REG    = 0x0A
 	LSM303MAG_IRB_REG    = 0x0B
 	LSM303MAG_IRC_REG    = 0x0C
@@ -35,34 +40,78 @@ const (
 	LSM303MAG_GAIN_4_7 = 0xA0 // +/- 4.7
 	LSM303MAG_GAIN_5_6 = 0xC0 // +/- 5.6
 	LSM303MAG_GAIN_8_1 = 0xE0 // +/- 8.1
+
+	// TEMP_OUT rises 8 digits per degree C, from about this at 0.  The
+	// datasheet doesn't give a zero point, CalibrateTemperature finds it.
+	LSM303MAG_TEMP_OFFSET      = 20
+	LSM303MAG_TEMP_LSB_PER_DEG = 8
 )
 
 type LSM303MAG struct {
-	bus          *i2c.I2CBus
+	bus          i2c.Transport
+	addr         byte
 	gain         byte
+	stale        bool // the outputs were measured at the gain before
 	gauss_lsb_xy float32
 	gauss_lsb_z  float32
+	dataRate     float32 // Hz, from CRA_REG
+	buffer       [6]byte // every read goes here, so reading doesn't allocate
+	magSamples
+	// whether CRA_REG has the temperature sensor on, degrees C at
+	// TEMP_OUT 0, and the temperature bias model
+	tempEnabled bool
+	tempOffset  float32
+	tempComp    tempCompensation
+	// how the chip is mounted on the board
+	orientation Orientation
+	// hard and soft iron calibration
+	calibration ironCalibration
 }
 
 // Return a new Device
 func NewLSM303MAG() (bp *LSM303MAG, err error) {
+	bp, err = NewLSM303MAGWith()
+	return
+}
+
+// Return a new Device on the given bus
+func NewLSM303MAGOnBus(bus i2c.Transport) (bp *LSM303MAG, err error) {
+	bp, err = NewLSM303MAGWith(WithTransport(bus))
+	return
+}
+
+// Return a new Device set up by the options, or a DriverError saying why
+// there isn't one
+func NewLSM303MAGWith(opts ...Option) (bp *LSM303MAG, err error) {
+	var o options
+	if o, err = applyOptions(LSM303MAG_ADDR, opts); err != nil {
+		err = driverError("LSM303MAG", o.addr, err)
+		return
+	}
+	// Make sure it's the chip before writing to it
+	if _, err = identify(o.bus, o.addr, "LSM303MAG"); err != nil {
+		return
+	}
 	bp = new(LSM303MAG)
-	bp.bus, err = i2c.Bus(1)
+	bp.bus = o.bus
+	bp.addr = o.addr
+	bp.orientation = o.orientation
+	bp.tempOffset = LSM303MAG_TEMP_OFFSET
+	// Turn it on, measuring continuously at 15Hz with the gain at a known level
+	err = bp.Configure(DefaultLSM303MAGConfig)
 	if err == nil {
-		// Turn it on
-		err = bp.bus.WriteByte(LSM303MAG_ADDR, LSM303MAG_MR_REG, 0x00)
-		if err == nil {
-			// Set the gain to a known level
-			err = bp.SetGain(LSM303MAG_GAIN_1_3)
-		}
+		err = o.writeRegisters(bp.WriteRegister)
+	}
+	if err != nil {
+		bp, err = nil, driverError("LSM303MAG", o.addr, err)
 	}
 	return
 }
 
 // Read a byte from the specified register
 func (bp *LSM303MAG) ReadRegister(reg byte) (value int8, err error) {
-	var bytes []byte
-	bytes, err = bp.bus.ReadByteBlock(LSM303MAG_ADDR, reg, 1)
+	bytes := bp.buffer[:1]
+	err = i2c.ReadBlockInto(bp.bus, bp.addr, reg, bytes)
 	if err == nil {
 		value = int8(bytes[0])
 	}
@@ -71,46 +120,81 @@ func (bp *LSM303MAG) ReadRegister(reg byte) (value int8, err error) {
 
 // Write a byte to the specified register
 func (bp *LSM303MAG) WriteRegister(reg byte, data byte) (err error) {
-	err = bp.bus.WriteByte(LSM303MAG_ADDR, reg, data)
+	err = bp.bus.WriteByte(bp.addr, reg, data)
+	if err == nil && reg == LSM303MAG_CRB_REG {
+		bp.setGain(data)
+	}
+	if err == nil && reg == LSM303MAG_CRA_REG {
+		bp.tempEnabled = data&LSM303MAG_CRA_TEMP_EN != 0
+		bp.dataRate = LSM303MAGDataRates[(data&LSM303MAG_CRA_DO)>>2]
+	}
 	return
 }
 
 // Set the magnetometer's gain
 func (bp *LSM303MAG) SetGain(gain byte) (err error) {
 	err = bp.WriteRegister(LSM303MAG_CRB_REG, gain)
-	if err == nil {
-		bp.gain = gain
-		switch gain {
-		case LSM303MAG_GAIN_1_3:
-			bp.gauss_lsb_xy = 1100.0
-			bp.gauss_lsb_z = 980.0
-		case LSM303MAG_GAIN_1_9:
-			bp.gauss_lsb_xy = 855.0
-			bp.gauss_lsb_z = 760.0
-		case LSM303MAG_GAIN_2_5:
-			bp.gauss_lsb_xy = 670.0
-			bp.gauss_lsb_z = 600.0
-		case LSM303MAG_GAIN_4_0:
-			bp.gauss_lsb_xy = 450.0
-			bp.gauss_lsb_z = 400.0
-		case LSM303MAG_GAIN_4_7:
-			bp.gauss_lsb_xy = 400.0
-			bp.gauss_lsb_z = 255.0
-		case LSM303MAG_GAIN_5_6:
-			bp.gauss_lsb_xy = 330.0
-			bp.gauss_lsb_z = 295.0
-		case LSM303MAG_GAIN_8_1:
-			bp.gauss_lsb_xy = 230.0
-			bp.gauss_lsb_z = 205.0
+	return
+}
+
+// Track the gain written to CRB_REG.  A new gain applies from the chip's
+// next measurement, until then the outputs are stale.
+func (bp *LSM303MAG) setGain(gain byte) {
+	bp.stale = bp.stale || (bp.gain != 0 && gain != bp.gain)
+	bp.gain = gain
+	switch gain {
+	case LSM303MAG_GAIN_1_3:
+		bp.gauss_lsb_xy = 1100.0
+		bp.gauss_lsb_z = 980.0
+	case LSM303MAG_GAIN_1_9:
+		bp.gauss_lsb_xy = 855.0
+		bp.gauss_lsb_z = 760.0
+	case LSM303MAG_GAIN_2_5:
+		bp.gauss_lsb_xy = 670.0
+		bp.gauss_lsb_z = 600.0
+	case LSM303MAG_GAIN_4_0:
+		bp.gauss_lsb_xy = 450.0
+		bp.gauss_lsb_z = 400.0
+	case LSM303MAG_GAIN_4_7:
+		bp.gauss_lsb_xy = 400.0
+		bp.gauss_lsb_z = 355.0
+	case LSM303MAG_GAIN_5_6:
+		bp.gauss_lsb_xy = 330.0
+		bp.gauss_lsb_z = 295.0
+	case LSM303MAG_GAIN_8_1:
+		bp.gauss_lsb_xy = 230.0
+		bp.gauss_lsb_z = 205.0
+	}
+}
+
+// Return ErrOverflow if an axis read as LSM303MAG_OVERFLOW, having
+// stepped the gain up so the next measurement fits, unless it's as
+// coarse as it goes already.  Wait for the measurement at the new gain
+// before reading again.
+func (bp *LSM303MAG) overflowed(x, y, z int16) (err error) {
+	if x != LSM303MAG_OVERFLOW && y != LSM303MAG_OVERFLOW && z != LSM303MAG_OVERFLOW {
+		return
+	}
+	old, gain := bp.gain, bp.gain
+	for i, g := range LSM303MAGGains[:len(LSM303MAGGains)-1] {
+		if g == old {
+			gain = LSM303MAGGains[i+1]
 		}
 	}
+	if gain == old {
+		err = fmt.Errorf("LSM303MAG: %w at gain 0x%02X, the coarsest", ErrOverflow, old)
+		return
+	}
+	if err = bp.SetGain(gain); err == nil {
+		err = fmt.Errorf("LSM303MAG: %w at gain 0x%02X, stepped up to 0x%02X", ErrOverflow, old, gain)
+	}
 	return
 }
 
 // Read the raw x, y, z values from their registers
 func (bp *LSM303MAG) ReadRaw() (x, y, z int16, err error) {
-	var bytes []byte
-	bytes, err = bp.bus.ReadByteBlock(LSM303MAG_ADDR, LSM303MAG_OUT_X_H|0x80, 6)
+	bytes := bp.buffer[:6]
+	err = i2c.ReadBlockInto(bp.bus, bp.addr, LSM303MAG_OUT_X_H|0x80, bytes)
 	if err == nil {
 		// Extract the values (higb byte first) and x, z, y order
 		x = int16(uint16(bytes[1]) | (uint16(bytes[0]) << 8))
@@ -120,18 +204,134 @@ func (bp *LSM303MAG) ReadRaw() (x, y, z int16, err error) {
 	return
 }
 
-// Read the X, Y, and Z values from their registers,
-// and adjust them according to the magnetic gain setting
-func (bp *LSM303MAG) ReadXYZ() (x, y, z float32, err error) {
+// Read the X, Y, and Z values from their registers, adjusted according
+// to the magnetic gain setting.  An overflowed reading is returned as
+// ErrOverflow, not a value, and until there's a measurement at a new
+// gain the reading is ErrNotReady, rather than scaled with the wrong one.
+func (bp *LSM303MAG) readScaled() (x, y, z float32, err error) {
 	var (
 		xi, yi, zi int16
+		ready      bool
 	)
+	if bp.stale {
+		if ready, err = bp.DataReady(); err == nil && !ready {
+			err = fmt.Errorf("LSM303MAG: %w at gain 0x%02X", ErrNotReady, bp.gain)
+		}
+		if err != nil {
+			return
+		}
+		bp.stale = false
+	}
 	xi, yi, zi, err = bp.ReadRaw()
+	if err == nil {
+		err = bp.overflowed(xi, yi, zi)
+	}
 	if err == nil {
 		// Apply the gain
 		x = float32(xi) / bp.gauss_lsb_xy * LSM303MAG_SENSORS_GAUSS_TO_MICROTESLA
 		y = float32(yi) / bp.gauss_lsb_xy * LSM303MAG_SENSORS_GAUSS_TO_MICROTESLA
-		z = float32(zi) / bp.gauss_lsb_z  * LSM303MAG_SENSORS_GAUSS_TO_MICROTESLA
+		z = float32(zi) / bp.gauss_lsb_z * LSM303MAG_SENSORS_GAUSS_TO_MICROTESLA
+	}
+	return
+}
+
+// Read the X, Y, and Z values from their registers, adjusted according
+// to the magnetic gain setting and the temperature, and turned into the
+// board's axes, but not the iron calibration
+func (bp *LSM303MAG) readUncalibrated() (x, y, z float32, err error) {
+	x, y, z, err = bp.readScaled()
+	if err == nil {
+		tx, ty, tz := bp.tempComp.bias()
+		x, y, z = bp.orientation.Apply(x, y, z)
+		x, y, z = x-tx, y-ty, z-tz
+	} else {
+		x, y, z = 0, 0, 0
+	}
+	return
+}
+
+// Read the X, Y, and Z values from their registers,
+// and adjust them according to the magnetic gain setting, the temperature
+// and the iron calibration.
+// An overflowed reading is returned as ErrOverflow, not a value.
+func (bp *LSM303MAG) ReadXYZ() (x, y, z float32, err error) {
+	x, y, z, err = bp.readUncalibrated()
+	if err == nil {
+		x, y, z = bp.calibration.apply(x, y, z)
+	}
+	return
+}
+
+// Read the temperature in degrees C, from the last measurement
+func (bp *LSM303MAG) ReadCelsius() (deg float32, err error) {
+	if !bp.tempEnabled {
+		err = errors.New("LSM303MAG: the temperature sensor is off")
+		return
+	}
+	bytes := bp.buffer[:2]
+	if err = i2c.ReadBlockInto(bp.bus, bp.addr, LSM303MAG_TEMP_OUT_H, bytes); err == nil {
+		// 12 bits, left justified
+		raw := int16(uint16(bytes[1])|(uint16(bytes[0])<<8)) >> 4
+		deg = bp.tempOffset + float32(raw)/LSM303MAG_TEMP_LSB_PER_DEG
+	}
+	return
+}
+
+// Calibrate ReadCelsius against the actual temperature, in degrees C
+func (bp *LSM303MAG) CalibrateTemperature(actual float32) (err error) {
+	var deg float32
+	if deg, err = bp.ReadCelsius(); err == nil {
+		bp.tempOffset += actual - deg
+	}
+	return
+}
+
+// Take the bias model's bias at the chip's temperature off what's
+// read from now on, nil turns it off
+func (bp *LSM303MAG) SetTempModel(model *TempModel) {
+	bp.tempComp.set(model)
+}
+
+// Take a sample, a failed read is returned rather than counted as a sample
+func (bp *LSM303MAG) Measure() (err error) {
+	var (
+		x, y, z float32
+	)
+	if err = bp.tempComp.refresh(bp.ReadCelsius); err != nil {
+		return
+	}
+	x, y, z, err = bp.readScaled()
+	if err == nil {
+		bp.add(x, y, z)
+	}
+	return
+}
+
+// Evaluate the samples
+func (bp *LSM303MAG) Evaluate() (x, y, z float32, err error) {
+	if bp.sampleCnt > 0 {
+		tx, ty, tz := bp.tempComp.bias()
+		x, y, z = bp.orientation.Apply(bp.mean())
+		x, y, z = x-tx, y-ty, z-tz
+		x, y, z = bp.calibration.apply(x, y, z)
+	} else {
+		err = errors.New("No magnetometer samples to Evaluate")
 	}
 	return
 }
+
+// Return the driver's name
+func (bp *LSM303MAG) Name() string {
+	return "LSM303MAG"
+}
+
+// Return the chip's address on its bus
+func (bp *LSM303MAG) Address() byte {
+	return bp.addr
+}
+
+// Read the chip's IRA, IRB and IRC registers
+func (bp *LSM303MAG) Identity() (id Identity, err error) {
+	id, err = identify(bp.bus, bp.addr, "LSM303MAG")
+	return
+}
@@ -0,0 +1,173 @@
+package sensors
+
+import (
+	"fmt"
+	"time"
+)
+
+/**
+* Typed configuration of the LSM303 magnetometer's output data rate,
+* temperature sensor, gain and measurement mode, as laid out in CRA_REG,
+* CRB_REG and MR_REG.
+* In continuous mode the chip measures at the data rate, in single mode
+* it measures once when told to, with Trigger, and goes back to sleep.
+* Either way SR_REG's DRDY says when there's a new measurement to read.
+**/
+const (
+	LSM303MAG_SR_REG = 0x09 // LSM303MAG_SR_REGg, spelt correctly
+
+	LSM303MAG_CRA_DO      = 0x1C // data output rate
+	LSM303MAG_CRA_TEMP_EN = 0x80 // temperature sensor on
+	LSM303MAG_SR_DRDY     = 0x01 // a new measurement is ready
+	LSM303MAG_SR_LOCK     = 0x02 // the output registers are locked part way through a read
+	LSM303MAG_MR_MODE     = 0x03
+	LSM303MAG_OVERFLOW    = -4096 // what an axis out of range for the gain reads
+
+	// MR_REG MD, the measurement mode
+	LSM303MAG_MODE_CONTINUOUS = 0x00
+	LSM303MAG_MODE_SINGLE     = 0x01
+	LSM303MAG_MODE_SLEEP      = 0x03
+)
+
+type LSM303MAGConfig struct {
+	DataRate    float32 // output data rate in Hz, one of LSM303MAGDataRates
+	Temperature bool    // measure the temperature too
+	Gain        byte    // LSM303MAG_GAIN_...
+	Mode        byte    // LSM303MAG_MODE_CONTINUOUS, _SINGLE or _SLEEP
+}
+
+// The data rates, in the order of CRA_REG's DO bits
+var LSM303MAGDataRates = []float32{0.75, 1.5, 3, 7.5, 15, 30, 75, 220}
+
+// The gains, each coarser than the one before
+var LSM303MAGGains = []byte{
+	LSM303MAG_GAIN_1_3, LSM303MAG_GAIN_1_9, LSM303MAG_GAIN_2_5, LSM303MAG_GAIN_4_0,
+	LSM303MAG_GAIN_4_7, LSM303MAG_GAIN_5_6, LSM303MAG_GAIN_8_1,
+}
+
+// What NewLSM303MAG sets the chip up as
+var DefaultLSM303MAGConfig = LSM303MAGConfig{
+	DataRate:    15,
+	Temperature: true,
+	Gain:        LSM303MAG_GAIN_1_3,
+	Mode:        LSM303MAG_MODE_CONTINUOUS,
+}
+
+// Return the register bits for the configuration, or why it's invalid
+func (config LSM303MAGConfig) registers() (cra, crb, mr byte, err error) {
+	do := indexOf(LSM303MAGDataRates, config.DataRate)
+	if do < 0 {
+		err = fmt.Errorf("LSM303MAG: data rate %vHz isn't one of %v", config.DataRate, LSM303MAGDataRates)
+		return
+	}
+	valid := false
+	for _, gain := range LSM303MAGGains {
+		valid = valid || gain == config.Gain
+	}
+	if !valid {
+		err = fmt.Errorf("LSM303MAG: invalid gain 0x%02X", config.Gain)
+		return
+	}
+	if config.Mode != LSM303MAG_MODE_CONTINUOUS && config.Mode != LSM303MAG_MODE_SINGLE && config.Mode != LSM303MAG_MODE_SLEEP {
+		err = fmt.Errorf("LSM303MAG: invalid mode 0x%02X", config.Mode)
+		return
+	}
+	cra = byte(do) << 2
+	if config.Temperature {
+		cra |= LSM303MAG_CRA_TEMP_EN
+	}
+	crb = config.Gain
+	mr = config.Mode
+	return
+}
+
+// Check the configuration is one the chip can do
+func (config LSM303MAGConfig) Validate() (err error) {
+	_, _, _, err = config.registers()
+	return
+}
+
+// Set the chip up, nothing is written if the configuration is invalid
+func (bp *LSM303MAG) Configure(config LSM303MAGConfig) (err error) {
+	var cra, crb, mr byte
+	if cra, crb, mr, err = config.registers(); err != nil {
+		return
+	}
+	if err = bp.WriteRegister(LSM303MAG_CRA_REG, cra); err != nil {
+		return
+	}
+	if err = bp.SetGain(crb); err != nil {
+		return
+	}
+	err = bp.WriteRegister(LSM303MAG_MR_REG, mr)
+	return
+}
+
+// Read back how the chip is set up.  After a single measurement the
+// chip is back asleep, so Mode reads as LSM303MAG_MODE_SLEEP.
+func (bp *LSM303MAG) ReadConfig() (config LSM303MAGConfig, err error) {
+	var regs [3]int8
+	for i, reg := range []byte{LSM303MAG_CRA_REG, LSM303MAG_CRB_REG, LSM303MAG_MR_REG} {
+		if regs[i], err = bp.ReadRegister(reg); err != nil {
+			return
+		}
+	}
+	config.DataRate = LSM303MAGDataRates[(byte(regs[0])&LSM303MAG_CRA_DO)>>2]
+	config.Temperature = byte(regs[0])&LSM303MAG_CRA_TEMP_EN != 0
+	config.Gain = byte(regs[1]) & 0xE0
+	config.Mode = byte(regs[2]) & LSM303MAG_MR_MODE
+	if config.Mode == 0x02 {
+		// MD 10 is sleep too
+		config.Mode = LSM303MAG_MODE_SLEEP
+	}
+	return
+}
+
+// Start a single measurement, read it once DataReady
+func (bp *LSM303MAG) Trigger() (err error) {
+	err = bp.WriteRegister(LSM303MAG_MR_REG, LSM303MAG_MODE_SINGLE)
+	return
+}
+
+// Report whether there's a measurement that hasn't been read yet
+func (bp *LSM303MAG) DataReady() (ready bool, err error) {
+	var sr int8
+	if sr, err = bp.ReadRegister(LSM303MAG_SR_REG); err == nil {
+		ready = byte(sr)&LSM303MAG_SR_DRDY != 0
+	}
+	return
+}
+
+// Poll DataReady until there's a measurement, or return ErrNotReady
+// once timeout has passed
+func (bp *LSM303MAG) WaitReady(timeout time.Duration) (err error) {
+	var ready bool
+	deadline := time.Now().Add(timeout)
+	for {
+		if ready, err = bp.DataReady(); err != nil || ready {
+			return
+		}
+		if time.Now().After(deadline) {
+			err = fmt.Errorf("LSM303MAG: no measurement after %v: %w", timeout, ErrNotReady)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Return how long a measurement takes at the data rate
+func (bp *LSM303MAG) measurePeriod() time.Duration {
+	return time.Duration(float32(time.Second) / bp.dataRate)
+}
+
+// Take a single measurement, waiting up to timeout for it
+func (bp *LSM303MAG) ReadSingle(timeout time.Duration) (x, y, z float32, err error) {
+	if err = bp.Trigger(); err != nil {
+		return
+	}
+	if err = bp.WaitReady(timeout); err != nil {
+		return
+	}
+	x, y, z, err = bp.ReadXYZ()
+	return
+}
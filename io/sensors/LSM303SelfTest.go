@@ -0,0 +1,82 @@
+package sensors
+
+import (
+	"errors"
+	"time"
+)
+
+/**
+* The LSM303DLHC has no self-test bits, unlike the LSM303DLH before it,
+* so its SelfTests check it reads something plausible at rest: the
+* accelerometer about 1g, whatever its attitude, and the magnetometer a
+* field the strength of the Earth's.  An axis that's stuck or has lost
+* its sensitivity throws the total out.  Nothing is written to the chip.
+**/
+const (
+	// The limits of gravity, in g, allowing for the chip's zero-g offset
+	LSM303ACCEL_SELFTEST_MIN = 0.85
+	LSM303ACCEL_SELFTEST_MAX = 1.15
+
+	// The limits of the field, in microtesla.  The Earth's is 25 to 65
+	// depending on where you are, the copter's own iron shifts it some.
+	LSM303MAG_SELFTEST_MIN = 20
+	LSM303MAG_SELFTEST_MAX = 80
+
+	// How long a single measurement may take, at the slowest data rate
+	LSM303MAG_SINGLE_TIMEOUT = 1500 * time.Millisecond
+)
+
+// Check the accelerometer reads 1g, without the bias, with it still
+func (bp *LSM303ACCEL) SelfTest() (report SelfTestReport, err error) {
+	report = newSelfTestReport(bp.Name(), false)
+	if bp.dataRate == 0 {
+		err = errors.New("LSM303ACCEL: can't self-test powered down")
+		return
+	}
+	period := time.Second / time.Duration(bp.dataRate)
+	var x, y, z float32
+	for i := 0; i < SELFTEST_SAMPLES; i++ {
+		var xi, yi, zi int16
+		if xi, yi, zi, err = bp.ReadRaw(); err != nil {
+			return
+		}
+		x += float32(xi)
+		y += float32(yi)
+		z += float32(zi)
+		time.Sleep(period)
+	}
+	scale := bp.scale() / SELFTEST_SAMPLES
+	g := magnitude(x*scale, y*scale, z*scale)
+	report.check("gravity", g, LSM303ACCEL_SELFTEST_MIN*LSM303ACCEL_GRAVITY_EARTH, LSM303ACCEL_SELFTEST_MAX*LSM303ACCEL_GRAVITY_EARTH, "m/s^2")
+	return
+}
+
+// Check the magnetometer reads a field the strength of the Earth's, less
+// the bias.  In single or sleep mode each sample is a single measurement.
+func (bp *LSM303MAG) SelfTest() (report SelfTestReport, err error) {
+	report = newSelfTestReport(bp.Name(), false)
+	var config LSM303MAGConfig
+	if config, err = bp.ReadConfig(); err != nil {
+		return
+	}
+	period := time.Duration(float32(time.Second) / config.DataRate)
+	var x, y, z float32
+	for i := 0; i < SELFTEST_SAMPLES; i++ {
+		var sx, sy, sz float32
+		if config.Mode == LSM303MAG_MODE_CONTINUOUS {
+			sx, sy, sz, err = bp.ReadXYZ()
+			time.Sleep(period)
+		} else {
+			sx, sy, sz, err = bp.ReadSingle(LSM303MAG_SINGLE_TIMEOUT)
+		}
+		if err != nil {
+			return
+		}
+		x += sx
+		y += sy
+		z += sz
+	}
+	field := magnitude(x, y, z) / SELFTEST_SAMPLES
+	report.check("field", field, LSM303MAG_SELFTEST_MIN, LSM303MAG_SELFTEST_MAX, "uT")
+	return
+}
@@ -0,0 +1,505 @@
+package sensors
+
+import (
+	"errors"
+	"fmt"
+	"goPiCopter/io/sensors/i2c"
+	"strings"
+	"time"
+)
+
+/**
+* The InvenSense MPU-6050 is a triple-axis Gyroscope and Accelerometer in
+* one chip, and the MPU-9250 the same with an AK8963 Magnetometer beside
+* them.  The driver is the chip's, its Gyroscope and Accelerometer are
+* views onto it that each take their own samples and keep their own bias,
+* so the rest of the program sees them as it sees the L3GD20 and the
+* LSM303.  The MPU-9250's AK8963 is a chip of its own, reached through
+* the MPU's bypass, see Magnetometer.  Output is big endian, accelerometer
+* then temperature then gyroscope.
+**/
+const (
+	MPU6050_ADDR     = 0x68
+	MPU6050_ADDR_ALT = 0x69 // AD0 pulled high
+	MPU6050_ID       = 0x68 // WHO_AM_I of the MPU-6050
+	MPU9250_ID       = 0x71 // WHO_AM_I of the MPU-9250
+
+	MPU6050_SMPLRT_DIV    = 0x19
+	MPU6050_CONFIG        = 0x1A
+	MPU6050_GYRO_CONFIG   = 0x1B
+	MPU6050_ACCEL_CONFIG  = 0x1C
+	MPU9250_ACCEL_CONFIG2 = 0x1D // the MPU-9250's accelerometer low pass filter
+	MPU6050_FIFO_EN       = 0x23
+	MPU6050_INT_PIN_CFG   = 0x37
+	MPU6050_INT_ENABLE    = 0x38
+	MPU6050_INT_STATUS    = 0x3A
+	MPU6050_ACCEL_XOUT_H  = 0x3B
+	MPU6050_TEMP_OUT_H    = 0x41
+	MPU6050_GYRO_XOUT_H   = 0x43
+	MPU6050_USER_CTRL     = 0x6A
+	MPU6050_PWR_MGMT_1    = 0x6B
+	MPU6050_PWR_MGMT_2    = 0x6C
+	MPU6050_FIFO_COUNTH   = 0x72
+	MPU6050_FIFO_COUNTL   = 0x73
+	MPU6050_FIFO_R_W      = 0x74
+	MPU6050_WHO_AM_I      = 0x75
+
+	MPU6050_PWR_MGMT_1_RESET      = 0x80
+	MPU6050_PWR_MGMT_1_SLEEP      = 0x40
+	MPU6050_CLOCK_PLL_XGYRO       = 0x01 // clocked from the X gyroscope, steadier than the internal oscillator
+	MPU6050_INT_PIN_CFG_BYPASS_EN = 0x02 // the auxiliary bus joined onto the host's
+	MPU6050_USER_CTRL_I2C_MST_EN  = 0x20 // the MPU masters the auxiliary bus itself
+
+	// GYRO_CONFIG FS_SEL and ACCEL_CONFIG AFS_SEL, bits 4:3
+	MPU6050_GYRO_RANGE_250DPS  = 0x00
+	MPU6050_GYRO_RANGE_500DPS  = 0x01
+	MPU6050_GYRO_RANGE_1000DPS = 0x02
+	MPU6050_GYRO_RANGE_2000DPS = 0x03
+	MPU6050_ACCEL_RANGE_2G     = 0x00
+	MPU6050_ACCEL_RANGE_4G     = 0x01
+	MPU6050_ACCEL_RANGE_8G     = 0x02
+	MPU6050_ACCEL_RANGE_16G    = 0x03
+
+	// TEMP_OUT in degrees C, raw / LSB_PER_DEG + OFFSET
+	MPU6050_TEMP_LSB_PER_DEG = 340
+	MPU6050_TEMP_OFFSET      = 36.53
+	MPU9250_TEMP_LSB_PER_DEG = 333.87
+	MPU9250_TEMP_OFFSET      = 21
+
+	// How long the chip takes to come back from a reset
+	MPU6050_RESET_DELAY = 100 * time.Millisecond
+)
+
+// LSB per degree/s for each gyroscope range, and per g for each
+// accelerometer range
+var (
+	MPU6050GyroSensitivities  = []float32{131, 65.5, 32.8, 16.4}
+	MPU6050AccelSensitivities = []float32{16384, 8192, 4096, 2048}
+)
+
+// How the MPU-9250's AK8963 is turned relative to the accelerometer and
+// gyroscope, its X along their Y, its Y along their X, and its Z down
+var MPU9250_MAG_AXES = Orientation{{0, 1, 0}, {1, 0, 0}, {0, 0, -1}}
+
+// The models the driver drives, by their WHO_AM_I
+var MPUModels = map[byte]string{MPU6050_ID: "MPU6050", MPU9250_ID: "MPU9250"}
+
+type MPU6050 struct {
+	bus        i2c.Transport
+	addr       byte
+	model      string // MPU6050 or MPU9250
+	gyroRange  byte
+	accelRange byte
+	dlpf       byte // CONFIG's DLPF_CFG
+	smplrtDiv  byte
+	buffer     [6]byte // every read goes here, so reading doesn't allocate
+	fifo       mpuFIFO
+	// how the chip is mounted on the board
+	orientation Orientation
+	gyro        MPU6050Gyro
+	accel       MPU6050Accel
+}
+
+// The sums of the samples a view has taken, and its bias, in raw digits
+type mpuSamples struct {
+	biasX     float32
+	biasY     float32
+	biasZ     float32
+	sampleX   int
+	sampleY   int
+	sampleZ   int
+	sampleCnt int
+}
+
+// The MPU's Gyroscope, in degrees/s
+type MPU6050Gyro struct {
+	chip *MPU6050
+	mpuSamples
+}
+
+// The MPU's Accelerometer, in m/s^2
+type MPU6050Accel struct {
+	chip *MPU6050
+	mpuSamples
+	// the six position calibration, nil for none
+	calibration *AccelCalibration
+}
+
+// Return a new Device
+func NewMPU6050() (bp *MPU6050, err error) {
+	bp, err = NewMPU6050With()
+	return
+}
+
+// Return a new Device on the given bus
+func NewMPU6050OnBus(bus i2c.Transport) (bp *MPU6050, err error) {
+	bp, err = NewMPU6050With(WithTransport(bus))
+	return
+}
+
+// Return a new Device set up by the options, or a DriverError saying why
+// there isn't one
+func NewMPU6050With(opts ...Option) (bp *MPU6050, err error) {
+	bp, err = newMPU("MPU6050", opts)
+	return
+}
+
+// Return a new MPU-9250
+func NewMPU9250() (bp *MPU6050, err error) {
+	bp, err = NewMPU9250With()
+	return
+}
+
+// Return a new MPU-9250 on the given bus
+func NewMPU9250OnBus(bus i2c.Transport) (bp *MPU6050, err error) {
+	bp, err = NewMPU9250With(WithTransport(bus))
+	return
+}
+
+// Return a new MPU-9250 set up by the options, or a DriverError saying
+// why there isn't one.  Its magnetometer is had from Magnetometer.
+func NewMPU9250With(opts ...Option) (bp *MPU6050, err error) {
+	bp, err = newMPU("MPU9250", opts)
+	return
+}
+
+// Return a new model, reset, woken up and set up as DefaultMPU6050Config
+func newMPU(model string, opts []Option) (bp *MPU6050, err error) {
+	var o options
+	if o, err = applyOptions(MPU6050_ADDR, opts); err != nil {
+		err = driverError(model, o.addr, err)
+		return
+	}
+	// Make sure it's the model before writing to it, the probe's detail
+	// ends with the model WHO_AM_I named
+	var id Identity
+	if id, err = identify(o.bus, o.addr, "MPU6050"); err != nil {
+		return
+	}
+	if !strings.HasSuffix(id.Detail, " "+model) {
+		err = &DriverError{Driver: model, Addr: o.addr, Kind: ErrWrongChip, Detail: id.Detail}
+		return
+	}
+	bp = new(MPU6050)
+	bp.bus = o.bus
+	bp.addr = o.addr
+	bp.model = model
+	bp.orientation = o.orientation
+	bp.gyro.chip = bp
+	bp.accel.chip = bp
+	// Reset, then wake it up clocked from the gyroscope
+	if err = bp.WriteRegister(MPU6050_PWR_MGMT_1, MPU6050_PWR_MGMT_1_RESET); err == nil {
+		time.Sleep(MPU6050_RESET_DELAY)
+		err = bp.WriteRegister(MPU6050_PWR_MGMT_1, MPU6050_CLOCK_PLL_XGYRO)
+	}
+	if err == nil {
+		err = bp.Configure(DefaultMPU6050Config)
+	}
+	if err == nil {
+		err = o.writeRegisters(bp.WriteRegister)
+	}
+	if err != nil {
+		bp, err = nil, driverError(model, o.addr, err)
+	}
+	return
+}
+
+// Read a byte from the specified register
+func (bp *MPU6050) ReadRegister(reg byte) (value int8, err error) {
+	bytes := bp.buffer[:1]
+	err = i2c.ReadBlockInto(bp.bus, bp.addr, reg, bytes)
+	if err == nil {
+		value = int8(bytes[0])
+	}
+	return
+}
+
+// Write a byte to the specified register
+func (bp *MPU6050) WriteRegister(reg byte, data byte) (err error) {
+	err = bp.bus.WriteByte(bp.addr, reg, data)
+	if err != nil {
+		return
+	}
+	switch reg {
+	case MPU6050_GYRO_CONFIG:
+		bp.gyroRange = (data >> 3) & 0x03
+	case MPU6050_ACCEL_CONFIG:
+		bp.accelRange = (data >> 3) & 0x03
+	case MPU6050_CONFIG:
+		bp.dlpf = data & MPU6050_CONFIG_DLPF
+	case MPU6050_SMPLRT_DIV:
+		bp.smplrtDiv = data
+	case MPU6050_PWR_MGMT_1:
+		if data&MPU6050_PWR_MGMT_1_RESET != 0 {
+			bp.gyroRange, bp.accelRange, bp.dlpf, bp.smplrtDiv = 0, 0, 0, 0
+		}
+	}
+	return
+}
+
+// Return the sample rate in Hz, the gyroscope's output rate divided by
+// SMPLRT_DIV + 1
+func (bp *MPU6050) sampleRate() int {
+	return mpuGyroRate(bp.dlpf) / (int(bp.smplrtDiv) + 1)
+}
+
+// Read the raw x, y, z values from the three registers starting at reg
+func (bp *MPU6050) readRaw(reg byte) (x, y, z int16, err error) {
+	bytes := bp.buffer[:6]
+	err = i2c.ReadBlockInto(bp.bus, bp.addr, reg, bytes)
+	if err == nil {
+		// Extract the values, high byte first, in the chip's axes
+		x = int16(uint16(bytes[1]) | (uint16(bytes[0]) << 8))
+		y = int16(uint16(bytes[3]) | (uint16(bytes[2]) << 8))
+		z = int16(uint16(bytes[5]) | (uint16(bytes[4]) << 8))
+	}
+	return
+}
+
+// Read the temperature in degrees C
+func (bp *MPU6050) ReadCelsius() (deg float32, err error) {
+	bytes := bp.buffer[:2]
+	if err = i2c.ReadBlockInto(bp.bus, bp.addr, MPU6050_TEMP_OUT_H, bytes); err == nil {
+		raw := float32(int16(uint16(bytes[1]) | (uint16(bytes[0]) << 8)))
+		if bp.model == "MPU9250" {
+			deg = raw/MPU9250_TEMP_LSB_PER_DEG + MPU9250_TEMP_OFFSET
+		} else {
+			deg = raw/MPU6050_TEMP_LSB_PER_DEG + MPU6050_TEMP_OFFSET
+		}
+	}
+	return
+}
+
+// Return the chip's Gyroscope
+func (bp *MPU6050) Gyroscope() *MPU6050Gyro {
+	return &bp.gyro
+}
+
+// Return the chip's Accelerometer
+func (bp *MPU6050) Accelerometer() *MPU6050Accel {
+	return &bp.accel
+}
+
+// Return the MPU-9250's AK8963, having turned the bypass on so it's on
+// the host's bus.  It's mounted as the MPU is, turned by
+// MPU9250_MAG_AXES, on the MPU's bus, unless the options say otherwise.
+func (bp *MPU6050) Magnetometer(opts ...Option) (mag *AK8963, err error) {
+	if bp.model != "MPU9250" {
+		err = fmt.Errorf("%s: has no magnetometer", bp.model)
+		return
+	}
+	var userCtrl int8
+	if userCtrl, err = bp.ReadRegister(MPU6050_USER_CTRL); err != nil {
+		return
+	}
+	// the MPU can't master the auxiliary bus while it's bypassed
+	if err = bp.WriteRegister(MPU6050_USER_CTRL, byte(userCtrl)&^MPU6050_USER_CTRL_I2C_MST_EN); err != nil {
+		return
+	}
+	if err = setBits(bp.ReadRegister, bp.WriteRegister, MPU6050_INT_PIN_CFG, MPU6050_INT_PIN_CFG_BYPASS_EN, true); err != nil {
+		return
+	}
+	defaults := []Option{WithTransport(bp.bus), WithOrientation(bp.orientation.times(MPU9250_MAG_AXES))}
+	mag, err = NewAK8963With(append(defaults, opts...)...)
+	return
+}
+
+// Return the driver's name, MPU6050 or MPU9250
+func (bp *MPU6050) Name() string {
+	return bp.model
+}
+
+// Return the chip's address on its bus
+func (bp *MPU6050) Address() byte {
+	return bp.addr
+}
+
+// Read the chip's WHO_AM_I register
+func (bp *MPU6050) Identity() (id Identity, err error) {
+	id, err = identify(bp.bus, bp.addr, "MPU6050")
+	return
+}
+
+// Add a sample
+func (s *mpuSamples) add(x, y, z int16) {
+	s.sampleX += int(x)
+	s.sampleY += int(y)
+	s.sampleZ += int(z)
+	s.sampleCnt++
+}
+
+// Return the mean of the samples and start again
+func (s *mpuSamples) mean() (x, y, z float32) {
+	n := float32(s.sampleCnt)
+	x, y, z = float32(s.sampleX)/n, float32(s.sampleY)/n, float32(s.sampleZ)/n
+	s.sampleCnt, s.sampleX, s.sampleY, s.sampleZ = 0, 0, 0, 0
+	return
+}
+
+// Read the raw x, y, z values from their registers
+func (g *MPU6050Gyro) ReadRaw() (x, y, z int16, err error) {
+	x, y, z, err = g.chip.readRaw(MPU6050_GYRO_XOUT_H)
+	return
+}
+
+// Return raw values in degrees/s in the board's axes, less the bias
+func (g *MPU6050Gyro) convert(xi, yi, zi float32) (x, y, z float32) {
+	sensitivity := MPU6050GyroSensitivities[g.chip.gyroRange]
+	x = (xi - g.biasX) / sensitivity
+	y = (yi - g.biasY) / sensitivity
+	z = (zi - g.biasZ) / sensitivity
+	x, y, z = g.chip.orientation.Apply(x, y, z)
+	return
+}
+
+// Return adjusted x, y, z values in degrees/s
+func (g *MPU6050Gyro) ReadXYZ() (x, y, z float32, err error) {
+	var (
+		xi, yi, zi int16
+	)
+	xi, yi, zi, err = g.ReadRaw()
+	if err == nil {
+		x, y, z = g.convert(float32(xi), float32(yi), float32(zi))
+	}
+	return
+}
+
+// Take a sample, a failed read is returned rather than counted as a sample
+func (g *MPU6050Gyro) Measure() (err error) {
+	var (
+		x, y, z int16
+	)
+	x, y, z, err = g.ReadRaw()
+	if err == nil {
+		g.add(x, y, z)
+	}
+	return
+}
+
+// Evaluate the samples
+func (g *MPU6050Gyro) Evaluate() (x, y, z float32, err error) {
+	if g.sampleCnt > 0 {
+		x, y, z = g.convert(g.mean())
+	} else {
+		err = errors.New("No gyroscope samples to Evaluate")
+	}
+	return
+}
+
+// Compute bias from samples taken with the copter still
+func (g *MPU6050Gyro) ComputeBias() (err error) {
+	if g.sampleCnt > 0 {
+		g.biasX, g.biasY, g.biasZ = g.mean()
+	} else {
+		err = errors.New("No gyroscope samples to ComputeBias")
+	}
+	return
+}
+
+// Return the driver's name
+func (g *MPU6050Gyro) Name() string {
+	return g.chip.Name()
+}
+
+// Return the chip's address on its bus
+func (g *MPU6050Gyro) Address() byte {
+	return g.chip.Address()
+}
+
+// Read the chip's WHO_AM_I register
+func (g *MPU6050Gyro) Identity() (id Identity, err error) {
+	id, err = g.chip.Identity()
+	return
+}
+
+// Read the raw x, y, z values from their registers
+func (a *MPU6050Accel) ReadRaw() (x, y, z int16, err error) {
+	x, y, z, err = a.chip.readRaw(MPU6050_ACCEL_XOUT_H)
+	return
+}
+
+// Return the m/s^2 per digit for the range set in ACCEL_CONFIG
+func (a *MPU6050Accel) scale() float32 {
+	return GRAVITY_EARTH / MPU6050AccelSensitivities[a.chip.accelRange]
+}
+
+// Return raw values in m/s^2 in the board's axes, less the bias, calibrated
+func (a *MPU6050Accel) convert(xi, yi, zi float32) (x, y, z float32) {
+	scale := a.scale()
+	x = (xi - a.biasX) * scale
+	y = (yi - a.biasY) * scale
+	z = (zi - a.biasZ) * scale
+	x, y, z = a.chip.orientation.Apply(x, y, z)
+	if a.calibration != nil {
+		x, y, z = a.calibration.Apply(x, y, z)
+	}
+	return
+}
+
+// Correct what's read from now on with the calibration, nil turns it off
+func (a *MPU6050Accel) SetCalibration(cal *AccelCalibration) {
+	a.calibration = cal
+}
+
+// Return adjusted x, y, z values in m/s^2
+func (a *MPU6050Accel) ReadXYZ() (x, y, z float32, err error) {
+	var (
+		xi, yi, zi int16
+	)
+	xi, yi, zi, err = a.ReadRaw()
+	if err == nil {
+		x, y, z = a.convert(float32(xi), float32(yi), float32(zi))
+	}
+	return
+}
+
+// Take a sample, a failed read is returned rather than counted as a sample
+func (a *MPU6050Accel) Measure() (err error) {
+	var (
+		x, y, z int16
+	)
+	x, y, z, err = a.ReadRaw()
+	if err == nil {
+		a.add(x, y, z)
+	}
+	return
+}
+
+// Evaluate the samples, in m/s^2
+func (a *MPU6050Accel) Evaluate() (x, y, z float32, err error) {
+	if a.sampleCnt > 0 {
+		x, y, z = a.convert(a.mean())
+	} else {
+		err = errors.New("No accelerometer samples to Evaluate")
+	}
+	return
+}
+
+// Compute bias from samples taken with the copter level and still, less
+// the 1g of gravity on the board's Z
+func (a *MPU6050Accel) ComputeBias() (err error) {
+	if a.sampleCnt > 0 {
+		gx, gy, gz := a.chip.orientation.ToChip(0, 0, GRAVITY_EARTH/a.scale())
+		x, y, z := a.mean()
+		a.biasX, a.biasY, a.biasZ = x-gx, y-gy, z-gz
+	} else {
+		err = errors.New("No accelerometer samples to ComputeBias")
+	}
+	return
+}
+
+// Return the driver's name
+func (a *MPU6050Accel) Name() string {
+	return a.chip.Name()
+}
+
+// Return the chip's address on its bus
+func (a *MPU6050Accel) Address() byte {
+	return a.chip.Address()
+}
+
+// Read the chip's WHO_AM_I register
+func (a *MPU6050Accel) Identity() (id Identity, err error) {
+	id, err = a.chip.Identity()
+	return
+}
@@ -0,0 +1,124 @@
+package sensors
+
+import (
+	"fmt"
+)
+
+/**
+* Typed configuration of the MPU's sample rate, digital low pass filter
+* and full scale ranges, as laid out in SMPLRT_DIV, CONFIG, GYRO_CONFIG
+* and ACCEL_CONFIG, and on the MPU-9250 ACCEL_CONFIG2.  The gyroscope
+* runs at 8kHz with the filter at its widest and 1kHz otherwise, and the
+* sample rate divides that down, so it has to go into it evenly.  The
+* MPU-9250's cutoffs for each DLPF setting are close to the MPU-6050's,
+* its accelerometer is given the same setting as its gyroscope.
+**/
+const (
+	MPU6050_CONFIG_DLPF = 0x07 // CONFIG's DLPF_CFG
+
+	// DLPF_CFG, named by the MPU-6050's gyroscope cutoff
+	MPU6050_DLPF_256HZ = 0x00
+	MPU6050_DLPF_188HZ = 0x01
+	MPU6050_DLPF_98HZ  = 0x02
+	MPU6050_DLPF_42HZ  = 0x03
+	MPU6050_DLPF_20HZ  = 0x04
+	MPU6050_DLPF_10HZ  = 0x05
+	MPU6050_DLPF_5HZ   = 0x06
+)
+
+type MPU6050Config struct {
+	SampleRate int  // Hz, 8000 or 1000 with DLPF_256HZ, 1000 otherwise, divided by 1 to 256
+	DLPF       byte // MPU6050_DLPF_...
+	GyroRange  byte // MPU6050_GYRO_RANGE_...
+	AccelRange byte // MPU6050_ACCEL_RANGE_...
+}
+
+// What NewMPU6050 sets the chip up as, 100Hz filtered to 42Hz, +/-500
+// degrees/s and +/-4g
+var DefaultMPU6050Config = MPU6050Config{
+	SampleRate: 100,
+	DLPF:       MPU6050_DLPF_42HZ,
+	GyroRange:  MPU6050_GYRO_RANGE_500DPS,
+	AccelRange: MPU6050_ACCEL_RANGE_4G,
+}
+
+// Return the gyroscope's output rate in Hz for a DLPF_CFG
+func mpuGyroRate(dlpf byte) int {
+	if dlpf == MPU6050_DLPF_256HZ || dlpf > MPU6050_DLPF_5HZ {
+		return 8000
+	}
+	return 1000
+}
+
+// Return the register bits for the configuration, or why it's invalid
+func (config MPU6050Config) registers() (smplrtDiv, cfg, gyroConfig, accelConfig byte, err error) {
+	if config.DLPF > MPU6050_DLPF_5HZ {
+		err = fmt.Errorf("MPU6050: invalid DLPF 0x%02X", config.DLPF)
+		return
+	}
+	if config.GyroRange > MPU6050_GYRO_RANGE_2000DPS {
+		err = fmt.Errorf("MPU6050: invalid gyroscope range 0x%02X", config.GyroRange)
+		return
+	}
+	if config.AccelRange > MPU6050_ACCEL_RANGE_16G {
+		err = fmt.Errorf("MPU6050: invalid accelerometer range 0x%02X", config.AccelRange)
+		return
+	}
+	rate := mpuGyroRate(config.DLPF)
+	if config.SampleRate <= 0 || rate%config.SampleRate != 0 || rate/config.SampleRate > 256 {
+		err = fmt.Errorf("MPU6050: sample rate %vHz doesn't divide %vHz by 1 to 256", config.SampleRate, rate)
+		return
+	}
+	smplrtDiv = byte(rate/config.SampleRate - 1)
+	cfg = config.DLPF
+	gyroConfig = config.GyroRange << 3
+	accelConfig = config.AccelRange << 3
+	return
+}
+
+// Check the configuration is one the chip can do
+func (config MPU6050Config) Validate() (err error) {
+	_, _, _, _, err = config.registers()
+	return
+}
+
+// Set the chip up, nothing is written if the configuration is invalid
+func (bp *MPU6050) Configure(config MPU6050Config) (err error) {
+	var smplrtDiv, cfg, gyroConfig, accelConfig byte
+	if smplrtDiv, cfg, gyroConfig, accelConfig, err = config.registers(); err != nil {
+		return
+	}
+	settings := []registerSetting{
+		{MPU6050_CONFIG, cfg},
+		{MPU6050_SMPLRT_DIV, smplrtDiv},
+		{MPU6050_GYRO_CONFIG, gyroConfig},
+		{MPU6050_ACCEL_CONFIG, accelConfig},
+	}
+	if bp.model == "MPU9250" {
+		// A_DLPF_CFG, with ACCEL_FCHOICE_B clear so it's used
+		settings = append(settings, registerSetting{MPU9250_ACCEL_CONFIG2, config.DLPF})
+	}
+	for _, setting := range settings {
+		if err = bp.WriteRegister(setting.reg, setting.value); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Read back how the chip is set up
+func (bp *MPU6050) ReadConfig() (config MPU6050Config, err error) {
+	var regs [4]int8
+	for i, reg := range []byte{MPU6050_SMPLRT_DIV, MPU6050_CONFIG, MPU6050_GYRO_CONFIG, MPU6050_ACCEL_CONFIG} {
+		if regs[i], err = bp.ReadRegister(reg); err != nil {
+			return
+		}
+	}
+	smplrtDiv, cfg, gyroConfig, accelConfig := byte(regs[0]), byte(regs[1]), byte(regs[2]), byte(regs[3])
+
+	config.DLPF = cfg & MPU6050_CONFIG_DLPF
+	config.SampleRate = mpuGyroRate(config.DLPF) / (int(smplrtDiv) + 1)
+	config.GyroRange = (gyroConfig >> 3) & 0x03
+	config.AccelRange = (accelConfig >> 3) & 0x03
+	return
+}
@@ -0,0 +1,230 @@
+package sensors
+
+import (
+	"errors"
+	"goPiCopter/io/sensors/i2c"
+	"time"
+)
+
+/**
+* The MPU's FIFO, 1024 bytes on the MPU-6050 and 512 on the MPU-9250.
+* Unlike the ST chips' it's a stream of bytes, read one after another
+* from FIFO_R_W, with FIFO_COUNT saying how many are waiting.  The driver
+* has it keep the accelerometer's and gyroscope's samples, 12 bytes at a
+* sample rate tick, so reading the FIFO for either view takes samples for
+* both.  Once it's filled up the oldest bytes are overwritten, losing
+* track of where the samples start, so it's reset and what was in it
+* thrown away.  The chip doesn't stamp its samples, the newest is taken
+* to be from when the FIFO was read and the rest one sample period
+* apart before it.
+**/
+const (
+	MPU6050_FIFO_SIZE = 1024
+	MPU9250_FIFO_SIZE = 512
+
+	MPU6050_USER_CTRL_FIFO_EN    = 0x40
+	MPU6050_USER_CTRL_FIFO_RESET = 0x04
+
+	// FIFO_EN, what goes into the FIFO
+	MPU6050_FIFO_EN_TEMP  = 0x80
+	MPU6050_FIFO_EN_XG    = 0x40
+	MPU6050_FIFO_EN_YG    = 0x20
+	MPU6050_FIFO_EN_ZG    = 0x10
+	MPU6050_FIFO_EN_ACCEL = 0x08
+
+	// INT_STATUS
+	MPU6050_INT_STATUS_FIFO_OFLOW = 0x10
+	MPU6050_INT_STATUS_DATA_RDY   = 0x01
+
+	// Bytes a sample takes in the FIFO, the accelerometer's then the gyroscope's
+	MPU6050_FIFO_SAMPLE = 12
+	// The most samples read in one go
+	MPU6050_FIFO_READ_SAMPLES = 40
+
+	// the most read in one block read when the bus can't do a combined transaction
+	mpuFIFOChunk = i2c.I2C_SMBUS_BLOCK_MAX / MPU6050_FIFO_SAMPLE * MPU6050_FIFO_SAMPLE
+)
+
+// A sample from the FIFO
+type MPU6050Sample struct {
+	When  int64      // nanoseconds, estimated from the sample rate
+	Gyro  [3]float32 // degrees/s, less the bias
+	Accel [3]float32 // m/s^2, less the bias
+}
+
+// Where FIFO reads go, so reading doesn't allocate
+type mpuFIFO struct {
+	data [MPU6050_FIFO_READ_SAMPLES * MPU6050_FIFO_SAMPLE]byte
+	reg  [1]byte
+	msgs [2]i2c.Msg
+}
+
+// Start keeping the accelerometer's and gyroscope's samples in the FIFO,
+// emptying it first
+func (bp *MPU6050) EnableFIFO() (err error) {
+	var userCtrl int8
+	if userCtrl, err = bp.ReadRegister(MPU6050_USER_CTRL); err != nil {
+		return
+	}
+	settings := []registerSetting{
+		{MPU6050_USER_CTRL, byte(userCtrl) &^ MPU6050_USER_CTRL_FIFO_EN},
+		{MPU6050_FIFO_EN, MPU6050_FIFO_EN_ACCEL | MPU6050_FIFO_EN_XG | MPU6050_FIFO_EN_YG | MPU6050_FIFO_EN_ZG},
+		{MPU6050_USER_CTRL, byte(userCtrl)&^MPU6050_USER_CTRL_FIFO_EN | MPU6050_USER_CTRL_FIFO_RESET},
+		{MPU6050_USER_CTRL, byte(userCtrl) | MPU6050_USER_CTRL_FIFO_EN},
+	}
+	for _, setting := range settings {
+		if err = bp.WriteRegister(setting.reg, setting.value); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Turn the FIFO off, back to reading a sample at a time
+func (bp *MPU6050) DisableFIFO() (err error) {
+	var userCtrl int8
+	if userCtrl, err = bp.ReadRegister(MPU6050_USER_CTRL); err != nil {
+		return
+	}
+	if err = bp.WriteRegister(MPU6050_USER_CTRL, byte(userCtrl)&^MPU6050_USER_CTRL_FIFO_EN); err == nil {
+		err = bp.WriteRegister(MPU6050_FIFO_EN, 0)
+	}
+	return
+}
+
+// Return how many whole samples are waiting in the FIFO, up to max, and
+// whether it filled up, in which case it's been reset and there are none
+func (bp *MPU6050) fifoLevel(max int) (n int, overrun bool, err error) {
+	var status int8
+	if status, err = bp.ReadRegister(MPU6050_INT_STATUS); err != nil {
+		return
+	}
+	if byte(status)&MPU6050_INT_STATUS_FIFO_OFLOW != 0 {
+		overrun = true
+		err = bp.resetFIFO()
+		return
+	}
+	bytes := bp.buffer[:2]
+	if err = i2c.ReadBlockInto(bp.bus, bp.addr, MPU6050_FIFO_COUNTH, bytes); err != nil {
+		return
+	}
+	if n = int(uint16(bytes[1])|uint16(bytes[0])<<8) / MPU6050_FIFO_SAMPLE; n > max {
+		n = max
+	}
+	return
+}
+
+// Empty the FIFO, turning it off while it's reset so the chip doesn't
+// write part of a sample into it, and the samples after line up
+func (bp *MPU6050) resetFIFO() (err error) {
+	var userCtrl int8
+	if userCtrl, err = bp.ReadRegister(MPU6050_USER_CTRL); err != nil {
+		return
+	}
+	off := byte(userCtrl) &^ MPU6050_USER_CTRL_FIFO_EN
+	for _, value := range []byte{off, off | MPU6050_USER_CTRL_FIFO_RESET, byte(userCtrl)} {
+		if err = bp.WriteRegister(MPU6050_USER_CTRL, value); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Read n samples from FIFO_R_W into bp.fifo, in one combined transaction
+// if the bus can, otherwise as many block reads as it takes
+func (bp *MPU6050) readFIFO(n int) (err error) {
+	f := &bp.fifo
+	data := f.data[:n*MPU6050_FIFO_SAMPLE]
+	if t, ok := bp.bus.(i2c.Transferer); ok {
+		f.reg[0] = MPU6050_FIFO_R_W
+		f.msgs[0] = i2c.Msg{Addr: bp.addr, Buf: f.reg[:]}
+		f.msgs[1] = i2c.Msg{Addr: bp.addr, Flags: i2c.I2C_M_RD, Buf: data}
+		if err = t.Transfer(f.msgs[:]...); !errors.Is(err, i2c.ErrNotSupported) {
+			return
+		}
+	}
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > mpuFIFOChunk {
+			chunk = chunk[:mpuFIFOChunk]
+		}
+		// FIFO_R_W doesn't increment, every byte comes from the FIFO
+		if err = i2c.ReadBlockInto(bp.bus, bp.addr, MPU6050_FIFO_R_W, chunk); err != nil {
+			return
+		}
+		data = data[len(chunk):]
+	}
+	return
+}
+
+// Return the raw accelerometer and gyroscope values of the i-th sample
+// read into bp.fifo
+func (bp *MPU6050) fifoSample(i int) (accel, gyro [3]int16) {
+	bytes := bp.fifo.data[i*MPU6050_FIFO_SAMPLE : (i+1)*MPU6050_FIFO_SAMPLE]
+	for axis := 0; axis < 3; axis++ {
+		accel[axis] = int16(uint16(bytes[2*axis+1]) | (uint16(bytes[2*axis]) << 8))
+		gyro[axis] = int16(uint16(bytes[2*axis+7]) | (uint16(bytes[2*axis+6]) << 8))
+	}
+	return
+}
+
+// Read every sample waiting in the FIFO, up to len(samples) and
+// MPU6050_FIFO_READ_SAMPLES, read at now.  overrun reports the FIFO had
+// filled up, and been emptied.
+func (bp *MPU6050) ReadFIFO(now int64, samples []MPU6050Sample) (n int, overrun bool, err error) {
+	max := len(samples)
+	if max > MPU6050_FIFO_READ_SAMPLES {
+		max = MPU6050_FIFO_READ_SAMPLES
+	}
+	if n, overrun, err = bp.fifoLevel(max); err != nil || n == 0 {
+		return
+	}
+	if err = bp.readFIFO(n); err != nil {
+		n = 0
+		return
+	}
+	interval := int64(time.Second) / int64(bp.sampleRate())
+	for i := 0; i < n; i++ {
+		accel, gyro := bp.fifoSample(i)
+		s := &samples[i]
+		s.When = now - int64(n-1-i)*interval
+		s.Gyro[0], s.Gyro[1], s.Gyro[2] = bp.gyro.convert(float32(gyro[0]), float32(gyro[1]), float32(gyro[2]))
+		s.Accel[0], s.Accel[1], s.Accel[2] = bp.accel.convert(float32(accel[0]), float32(accel[1]), float32(accel[2]))
+	}
+	return
+}
+
+// Take every sample waiting in the FIFO, for both views, as Measure
+// takes one
+func (bp *MPU6050) MeasureFIFO(now int64) (n int, overrun bool, err error) {
+	if n, overrun, err = bp.fifoLevel(MPU6050_FIFO_READ_SAMPLES); err != nil || n == 0 {
+		return
+	}
+	if err = bp.readFIFO(n); err != nil {
+		n = 0
+		return
+	}
+	for i := 0; i < n; i++ {
+		accel, gyro := bp.fifoSample(i)
+		bp.accel.add(accel[0], accel[1], accel[2])
+		bp.gyro.add(gyro[0], gyro[1], gyro[2])
+	}
+	return
+}
+
+// Turn the chip's FIFO on, for both views
+func (g *MPU6050Gyro) EnableFIFO() (err error) {
+	err = g.chip.EnableFIFO()
+	return
+}
+
+// Take every sample waiting in the chip's FIFO, the accelerometer's too
+func (g *MPU6050Gyro) MeasureFIFO(now int64) (n int, overrun bool, err error) {
+	n, overrun, err = g.chip.MeasureFIFO(now)
+	return
+}
+
+// The accelerometer's samples come in the gyroscope's FIFO
+func (a *MPU6050Accel) SharedFIFO() Buffered {
+	return &a.chip.gyro
+}
@@ -0,0 +1,379 @@
+package sensors
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+/**
+* Hard and soft iron calibration of a magnetometer.  Iron on the copter,
+* the motors, ESCs and battery leads, adds its own field, an offset, and
+* bends the Earth's, so as the copter turns the readings trace out an
+* ellipsoid rather than a sphere about the origin.  An ellipsoid is fitted
+* by least squares to readings taken while the copter is turned through
+* every direction, and the calibration takes the offset off and maps the
+* ellipsoid back onto a sphere of the same volume, keeping the field's
+* strength.  The fit's Residual says how well the readings fit the
+* ellipsoid and its Coverage how many directions they came from, a fit to
+* readings from only a few directions can't be trusted.
+**/
+const (
+	MAG_CAL_MIN_SAMPLES = 9 // the ellipsoid's degrees of freedom
+	// The directions are counted in equal area bins, this many bands of
+	// latitude by this many of longitude
+	MAG_CAL_BANDS      = 6
+	MAG_CAL_LONGITUDES = 12
+)
+
+var errNoEllipsoid = errors.New("sensors: the magnetometer samples don't fit an ellipsoid, turn it through more directions")
+
+// A magnetometer calibration, corrected = Matrix * (reading - Offset)
+type MagCalibration struct {
+	Offset [3]float32    // hard iron, in microtesla
+	Matrix [3][3]float32 // soft iron correction
+	Field  float32       // strength of the field it was fitted to, in microtesla
+}
+
+// A MagCalibration and how good it is
+type MagFit struct {
+	MagCalibration
+	Samples  int
+	Residual float32 // RMS of the corrected readings' distance from the sphere, in microtesla
+	Coverage float32 // fraction of directions the readings came from, 0 to 1
+}
+
+// Return the calibration that changes nothing
+func IdentityMagCalibration() (cal MagCalibration) {
+	for axis := 0; axis < 3; axis++ {
+		cal.Matrix[axis][axis] = 1
+	}
+	return
+}
+
+// Return the calibrated x, y, z
+func (cal *MagCalibration) Apply(x, y, z float32) (cx, cy, cz float32) {
+	dx, dy, dz := x-cal.Offset[0], y-cal.Offset[1], z-cal.Offset[2]
+	m := &cal.Matrix
+	cx = m[0][0]*dx + m[0][1]*dy + m[0][2]*dz
+	cy = m[1][0]*dx + m[1][1]*dy + m[1][2]*dz
+	cz = m[2][0]*dx + m[2][1]*dy + m[2][2]*dz
+	return
+}
+
+// A magnetometer driver's samples to Evaluate, in microtesla, kept scaled
+// so the gain can change between them
+type magSamples struct {
+	sampleX   float32
+	sampleY   float32
+	sampleZ   float32
+	sampleCnt int
+}
+
+// Add a sample
+func (s *magSamples) add(x, y, z float32) {
+	s.sampleX += x
+	s.sampleY += y
+	s.sampleZ += z
+	s.sampleCnt++
+}
+
+// Return the mean of the samples and start again
+func (s *magSamples) mean() (x, y, z float32) {
+	n := float32(s.sampleCnt)
+	x, y, z = s.sampleX/n, s.sampleY/n, s.sampleZ/n
+	s.sampleCnt, s.sampleX, s.sampleY, s.sampleZ = 0, 0, 0, 0
+	return
+}
+
+// A driver's iron calibration, which SetCalibration may change while
+// the magnetometer is read on another goroutine
+type ironCalibration struct {
+	lock sync.Mutex
+	cal  MagCalibration
+	on   bool
+}
+
+// Use a copy of cal, nil turns the calibration off
+func (ic *ironCalibration) set(cal *MagCalibration) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	ic.on = cal != nil
+	if cal != nil {
+		ic.cal = *cal
+	}
+}
+
+// Return x, y, z calibrated, or as they are with the calibration off
+func (ic *ironCalibration) apply(x, y, z float32) (cx, cy, cz float32) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	cx, cy, cz = x, y, z
+	if ic.on {
+		cx, cy, cz = ic.cal.Apply(x, y, z)
+	}
+	return
+}
+
+// Fit a calibration to readings taken while the magnetometer was turned
+// through every direction
+func FitMagCalibration(samples [][3]float32) (fit MagFit, err error) {
+	if len(samples) < MAG_CAL_MIN_SAMPLES {
+		err = errors.New("sensors: at least 9 samples are needed to fit a magnetometer calibration")
+		return
+	}
+	// Work about the mean and at unit scale, so the squares don't swamp the rest
+	var mean [3]float64
+	for _, s := range samples {
+		for axis := range mean {
+			mean[axis] += float64(s[axis])
+		}
+	}
+	for axis := range mean {
+		mean[axis] /= float64(len(samples))
+	}
+	var scale float64
+	for _, s := range samples {
+		for axis := range mean {
+			d := float64(s[axis]) - mean[axis]
+			scale += d * d
+		}
+	}
+	scale = math.Sqrt(scale / float64(len(samples)))
+	if scale == 0 {
+		err = errors.New("sensors: the magnetometer samples are all the same")
+		return
+	}
+
+	// a x^2 + b y^2 + c z^2 + 2d xy + 2e xz + 2f yz + 2g x + 2h y + 2i z = 1
+	normal := make([][]float64, 9)
+	for row := range normal {
+		normal[row] = make([]float64, 10)
+	}
+	for _, s := range samples {
+		x := (float64(s[0]) - mean[0]) / scale
+		y := (float64(s[1]) - mean[1]) / scale
+		z := (float64(s[2]) - mean[2]) / scale
+		terms := [9]float64{x * x, y * y, z * z, 2 * x * y, 2 * x * z, 2 * y * z, 2 * x, 2 * y, 2 * z}
+		for row, t := range terms {
+			for col, u := range terms {
+				normal[row][col] += t * u
+			}
+			normal[row][9] += t
+		}
+	}
+	p, ok := solve(normal)
+	if !ok {
+		err = errNoEllipsoid
+		return
+	}
+	a := [3][3]float64{{p[0], p[3], p[4]}, {p[3], p[1], p[5]}, {p[4], p[5], p[2]}}
+
+	// The centre, where the gradient is zero, A c = -v
+	centre := make([][]float64, 3)
+	for row := range centre {
+		centre[row] = []float64{a[row][0], a[row][1], a[row][2], -p[6+row]}
+	}
+	c, ok := solve(centre)
+	if !ok {
+		err = errNoEllipsoid
+		return
+	}
+	// (p - c)' A (p - c) = 1 + c' A c
+	k := 1.0
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			k += c[row] * a[row][col] * c[col]
+		}
+	}
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			a[row][col] /= k
+		}
+	}
+	values, vectors := eigenSymmetric(a)
+	radius := 1.0
+	for _, v := range values {
+		if v <= 0 || k <= 0 {
+			err = errNoEllipsoid
+			return
+		}
+		radius /= math.Sqrt(v)
+	}
+	// the radius of the sphere of the same volume
+	radius = math.Cbrt(radius)
+
+	// Matrix = V diag(sqrt(value) * radius) V'
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			var m float64
+			for i, v := range values {
+				m += vectors[row][i] * math.Sqrt(v) * radius * vectors[col][i]
+			}
+			fit.Matrix[row][col] = float32(m)
+		}
+		fit.Offset[row] = float32(c[row]*scale + mean[row])
+	}
+	fit.Field = float32(radius * scale)
+	fit.Samples = len(samples)
+	fit.Residual, fit.Coverage = fit.MagCalibration.quality(samples)
+	return
+}
+
+// Return the RMS distance of the calibrated samples from the sphere, and
+// the fraction of the directions they cover
+func (cal *MagCalibration) quality(samples [][3]float32) (residual, coverage float32) {
+	var hit [MAG_CAL_BANDS * MAG_CAL_LONGITUDES]bool
+	var sum float64
+	for _, s := range samples {
+		x, y, z := cal.Apply(s[0], s[1], s[2])
+		length := float64(magnitude(x, y, z))
+		d := length - float64(cal.Field)
+		sum += d * d
+		if length == 0 {
+			continue
+		}
+		// bands of equal height cut a sphere into equal areas
+		band := int((float64(z)/length + 1) / 2 * MAG_CAL_BANDS)
+		longitude := int((math.Atan2(float64(y), float64(x)) + math.Pi) / (2 * math.Pi) * MAG_CAL_LONGITUDES)
+		if band == MAG_CAL_BANDS {
+			band--
+		}
+		if longitude == MAG_CAL_LONGITUDES {
+			longitude--
+		}
+		hit[band*MAG_CAL_LONGITUDES+longitude] = true
+	}
+	n := 0
+	for _, h := range hit {
+		if h {
+			n++
+		}
+	}
+	residual = float32(math.Sqrt(sum / float64(len(samples))))
+	coverage = float32(n) / float32(len(hit))
+	return
+}
+
+// Solve the linear equations in the augmented matrix m, by Gaussian
+// elimination with partial pivoting, not ok if they're singular
+func solve(m [][]float64) (x []float64, ok bool) {
+	n := len(m)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		for row := col + 1; row < n; row++ {
+			f := m[row][col] / m[col][col]
+			for k := col; k <= n; k++ {
+				m[row][k] -= f * m[col][k]
+			}
+		}
+	}
+	x = make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := m[row][n]
+		for k := row + 1; k < n; k++ {
+			sum -= m[row][k] * x[k]
+		}
+		x[row] = sum / m[row][row]
+	}
+	ok = true
+	return
+}
+
+// Return the eigenvalues of the symmetric matrix a, and the eigenvectors
+// as the columns of vectors, by Jacobi rotations
+func eigenSymmetric(a [3][3]float64) (values [3]float64, vectors [3][3]float64) {
+	for i := 0; i < 3; i++ {
+		vectors[i][i] = 1
+	}
+	for sweep := 0; sweep < 50; sweep++ {
+		off := a[0][1]*a[0][1] + a[0][2]*a[0][2] + a[1][2]*a[1][2]
+		if off < 1e-30 {
+			break
+		}
+		for p := 0; p < 2; p++ {
+			for q := p + 1; q < 3; q++ {
+				if a[p][q] == 0 {
+					continue
+				}
+				// the rotation that zeroes a[p][q]
+				theta := (a[q][q] - a[p][p]) / (2 * a[p][q])
+				t := 1 / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+				if theta < 0 {
+					t = -t
+				}
+				c := 1 / math.Sqrt(t*t+1)
+				s := t * c
+				for k := 0; k < 3; k++ {
+					akp, akq := a[k][p], a[k][q]
+					a[k][p] = c*akp - s*akq
+					a[k][q] = s*akp + c*akq
+				}
+				for k := 0; k < 3; k++ {
+					apk, aqk := a[p][k], a[q][k]
+					a[p][k] = c*apk - s*aqk
+					a[q][k] = s*apk + c*aqk
+				}
+				for k := 0; k < 3; k++ {
+					vkp, vkq := vectors[k][p], vectors[k][q]
+					vectors[k][p] = c*vkp - s*vkq
+					vectors[k][q] = s*vkp + c*vkq
+				}
+			}
+		}
+	}
+	for i := 0; i < 3; i++ {
+		values[i] = a[i][i]
+	}
+	return
+}
+
+// Correct what's read from now on with a copy of the calibration, nil
+// turns it off.  It's safe to call while another goroutine reads.
+func (bp *LSM303MAG) SetCalibration(cal *MagCalibration) {
+	bp.calibration.set(cal)
+}
+
+// Take n readings, period apart, while the copter is turned through every
+// direction, fit a calibration to them and correct what's read with it
+// from then on.  The readings are as the chip measured them, in microtesla
+// so the gain can change between them, and the calibration's Offset is
+// the only hard iron correction.  Readings that overflow, stepping the
+// gain up, are taken again once the chip has measured at the new gain.
+// Check the fit's Residual and Coverage before trusting it.
+func (bp *LSM303MAG) Calibrate(n int, period time.Duration) (fit MagFit, err error) {
+	samples := make([][3]float32, 0, n)
+	for len(samples) < n {
+		var x, y, z float32
+		gain := bp.gain
+		x, y, z, err = bp.readUncalibrated()
+		if errors.Is(err, ErrOverflow) && bp.gain != gain {
+			// one measurement may be under way at the old gain
+			if err = bp.WaitReady(2 * bp.measurePeriod()); err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+		samples = append(samples, [3]float32{x, y, z})
+		time.Sleep(period)
+	}
+	if fit, err = FitMagCalibration(samples); err == nil {
+		bp.SetCalibration(&fit.MagCalibration)
+	}
+	return
+}
@@ -0,0 +1,112 @@
+package sensors
+
+import (
+	"goPiCopter/io/sensors/i2c"
+	"goPiCopter/io/sensors/spi"
+)
+
+/**
+* Options for the New...With constructors.  Without any, a driver
+* opens i2c bus 1, talks to its chip at the chip's usual address, and
+* sets it up the same way its plain constructor always has.  Chips
+* that also speak SPI, like the L3GD20, can be put on spidev instead.
+**/
+type Option func(*options)
+
+type registerSetting struct {
+	reg   byte
+	value byte
+}
+
+type options struct {
+	busNumber byte
+	bus       i2c.Transport
+	addr      byte
+	registers []registerSetting
+	// how the chip is mounted on the board
+	orientation Orientation
+	// spidev to open instead of an i2c bus
+	useSPI        bool
+	spiBus        byte
+	spiChipSelect byte
+	spiSpeed      uint32
+}
+
+// Open /dev/i2c-n rather than bus 1, the first RaspberryPis use bus 0
+func WithBus(n byte) Option {
+	return func(o *options) {
+		o.busNumber = n
+	}
+}
+
+// Use an already open bus, a FakeBus or a Recorder for example
+func WithTransport(bus i2c.Transport) Option {
+	return func(o *options) {
+		o.bus = bus
+	}
+}
+
+// Open /dev/spidevBus.ChipSelect rather than an i2c bus, clocked at up to speedHz
+func WithSPI(bus, chipSelect byte, speedHz uint32) Option {
+	return func(o *options) {
+		o.useSPI = true
+		o.spiBus = bus
+		o.spiChipSelect = chipSelect
+		o.spiSpeed = speedHz
+	}
+}
+
+// Talk to the chip at addr, for boards with its address pin strapped differently
+func WithAddress(addr byte) Option {
+	return func(o *options) {
+		o.addr = addr
+	}
+}
+
+// Write value to reg once the driver has set the chip up, settings
+// are written in the order given, after the driver's own
+func WithRegister(reg, value byte) Option {
+	return func(o *options) {
+		o.registers = append(o.registers, registerSetting{reg, value})
+	}
+}
+
+// Turn what's read from the chip's axes into the board's, for boards
+// that don't mount the chip square with the board's axes
+func WithOrientation(orientation Orientation) Option {
+	return func(o *options) {
+		o.orientation = orientation
+	}
+}
+
+// Apply the options over the defaults, and open the bus if one wasn't given
+func applyOptions(addr byte, opts []Option) (o options, err error) {
+	o.busNumber = 1
+	o.addr = addr
+	o.orientation = NoRotation
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.bus == nil && o.useSPI {
+		var dev *spi.SPIDev
+		if dev, err = spi.Open(o.spiBus, o.spiChipSelect, spi.SPI_MODE_3, o.spiSpeed); err == nil {
+			o.bus = spi.NewBus(dev)
+		}
+	} else if o.bus == nil {
+		var bus *i2c.I2CBus
+		if bus, err = i2c.Bus(o.busNumber); err == nil {
+			o.bus = bus
+		}
+	}
+	return
+}
+
+// Write the initial register settings through a driver's WriteRegister
+func (o *options) writeRegisters(write func(reg, data byte) error) (err error) {
+	for _, setting := range o.registers {
+		if err = write(setting.reg, setting.value); err != nil {
+			return
+		}
+	}
+	return
+}
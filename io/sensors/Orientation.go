@@ -0,0 +1,93 @@
+package sensors
+
+import (
+	"fmt"
+	"math"
+)
+
+/**
+* How a chip is mounted on the board.  The drivers decode their chips'
+* registers true to the datasheet, in the chip's axes, and turn what they
+* read into the board's axes before handing it out, so a board laid out
+* differently needs a different Orientation, not a different driver.
+* Most boards mount their chips square to the board, Rotation gives
+* those, CustomOrientation anything else.  The bias is kept in the chip's
+* axes, temperature models and calibrations are in the board's.
+**/
+
+// The matrix taking the chip's axes to the board's, board = Orientation * chip
+type Orientation [3][3]float32
+
+// The chip's axes are the board's
+var NoRotation = Orientation{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+// Return the orientation of a chip turned square to the board, rolled
+// about X, then pitched about Y, then yawed about Z, in degrees, each a
+// multiple of 90
+func Rotation(roll, pitch, yaw int) (o Orientation, err error) {
+	if roll%90 != 0 || pitch%90 != 0 || yaw%90 != 0 {
+		err = fmt.Errorf("sensors: rotation %v, %v, %v isn't in multiples of 90 degrees", roll, pitch, yaw)
+		return
+	}
+	// the cosine and sine of each quarter turn
+	turn := func(degrees int) (c, s float32) {
+		quarter := ((degrees/90)%4 + 4) % 4
+		return [4]float32{1, 0, -1, 0}[quarter], [4]float32{0, 1, 0, -1}[quarter]
+	}
+	cr, sr := turn(roll)
+	cp, sp := turn(pitch)
+	cy, sy := turn(yaw)
+	rx := Orientation{{1, 0, 0}, {0, cr, -sr}, {0, sr, cr}}
+	ry := Orientation{{cp, 0, sp}, {0, 1, 0}, {-sp, 0, cp}}
+	rz := Orientation{{cy, -sy, 0}, {sy, cy, 0}, {0, 0, 1}}
+	o = rz.times(ry.times(rx))
+	return
+}
+
+// Return an orientation given by its matrix, which must be orthonormal,
+// a rotation or a reflection, like swapping two axes, so it keeps lengths
+func CustomOrientation(matrix [3][3]float32) (o Orientation, err error) {
+	o = Orientation(matrix)
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			var dot float32
+			for k := 0; k < 3; k++ {
+				dot += o[row][k] * o[col][k]
+			}
+			if want := NoRotation[row][col]; math.Abs(float64(dot-want)) > 1e-3 {
+				err = fmt.Errorf("sensors: orientation %v isn't orthonormal", matrix)
+				o = NoRotation
+				return
+			}
+		}
+	}
+	return
+}
+
+// Return the product o * p
+func (o *Orientation) times(p Orientation) (product Orientation) {
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			for k := 0; k < 3; k++ {
+				product[row][col] += o[row][k] * p[k][col]
+			}
+		}
+	}
+	return
+}
+
+// Turn x, y, z in the chip's axes into the board's
+func (o *Orientation) Apply(x, y, z float32) (bx, by, bz float32) {
+	bx = o[0][0]*x + o[0][1]*y + o[0][2]*z
+	by = o[1][0]*x + o[1][1]*y + o[1][2]*z
+	bz = o[2][0]*x + o[2][1]*y + o[2][2]*z
+	return
+}
+
+// Turn x, y, z in the board's axes into the chip's
+func (o *Orientation) ToChip(x, y, z float32) (cx, cy, cz float32) {
+	cx = o[0][0]*x + o[1][0]*y + o[2][0]*z
+	cy = o[0][1]*x + o[1][1]*y + o[2][1]*z
+	cz = o[0][2]*x + o[1][2]*y + o[2][2]*z
+	return
+}
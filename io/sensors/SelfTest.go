@@ -0,0 +1,76 @@
+package sensors
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+/**
+* Self-tests, for preflight and for spotting a sensor damaged in a crash.
+* The L3GD20 has a hardware self-test, an electrostatic force that shifts
+* its output by an amount the datasheet gives limits for.  The LSM303DLHC
+* has none, its accelerometer and magnetometer are checked for plausible
+* readings at rest instead: gravity, and the Earth's field.
+**/
+
+const (
+	SELFTEST_SETTLE  = 5 // output periods to wait for a change of setting to settle
+	SELFTEST_SAMPLES = 5 // samples averaged for each reading
+)
+
+// One thing a SelfTest checked
+type SelfTestCheck struct {
+	Name     string
+	Value    float32
+	Min, Max float32
+	Units    string
+	Pass     bool
+}
+
+// What a SelfTest found
+type SelfTestReport struct {
+	Driver   string
+	Hardware bool // the chip's own self-test, rather than a plausibility check at rest
+	Checks   []SelfTestCheck
+	Pass     bool // every check passed
+}
+
+// Return an empty report for the driver, passing until a check fails
+func newSelfTestReport(driver string, hardware bool) SelfTestReport {
+	return SelfTestReport{Driver: driver, Hardware: hardware, Pass: true}
+}
+
+// Add a check of value against min and max to the report
+func (r *SelfTestReport) check(name string, value, min, max float32, units string) {
+	c := SelfTestCheck{Name: name, Value: value, Min: min, Max: max, Units: units}
+	c.Pass = value >= min && value <= max
+	r.Checks = append(r.Checks, c)
+	r.Pass = r.Pass && c.Pass
+}
+
+func (r SelfTestReport) String() string {
+	var b strings.Builder
+	method := "plausibility check"
+	if r.Hardware {
+		method = "hardware self-test"
+	}
+	result := "FAIL"
+	if r.Pass {
+		result = "PASS"
+	}
+	fmt.Fprintf(&b, "%s %s: %s", r.Driver, method, result)
+	for _, c := range r.Checks {
+		mark := "ok"
+		if !c.Pass {
+			mark = "out of range"
+		}
+		fmt.Fprintf(&b, "\n  %-10s %8.2f %s, %.2f to %.2f, %s", c.Name, c.Value, c.Units, c.Min, c.Max, mark)
+	}
+	return b.String()
+}
+
+// Return the length of x, y, z
+func magnitude(x, y, z float32) float32 {
+	return float32(math.Sqrt(float64(x*x + y*y + z*z)))
+}
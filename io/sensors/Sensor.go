@@ -0,0 +1,147 @@
+package sensors
+
+import (
+	"fmt"
+	"goPiCopter/io/sensors/i2c"
+)
+
+// Earth's standard gravity in m/s^2, what an Accelerometer reads at rest
+const GRAVITY_EARTH = 9.80665
+
+/**
+* What the rest of the program needs from the sensors, whichever chips
+* they are.  Every sensor takes samples with Measure and averages them
+* with Evaluate, and reads a single scaled value with ReadXYZ.  The
+* gyroscope and accelerometer compute their bias from the samples taken
+* since the last Evaluate, the magnetometer's hard iron bias is part of
+* its MagCalibration.
+**/
+type Sensor interface {
+	// The driver's name, L3GD20, LSM303ACCEL, ...
+	Name() string
+	// The chip's address on its bus
+	Address() byte
+	// Read the chip's identity registers, an error if they don't match the driver
+	Identity() (Identity, error)
+}
+
+// A three axis sensor, the axes as the board is laid out
+type Triaxial interface {
+	Sensor
+	// Take a sample, a failed read is returned rather than counted as a sample
+	Measure() error
+	// Return the average of the samples since the last Evaluate, corrected
+	Evaluate() (x, y, z float32, err error)
+	// Read a single value, corrected
+	ReadXYZ() (x, y, z float32, err error)
+}
+
+// A Gyroscope measures rate of rotation in degrees/s
+type Gyroscope interface {
+	Triaxial
+	// Compute the zero rate bias from the samples since the last Evaluate,
+	// taken while the copter was still
+	ComputeBias() error
+}
+
+// An Accelerometer measures acceleration, in m/s^2
+type Accelerometer interface {
+	Triaxial
+	// Compute the bias from the samples since the last Evaluate, taken
+	// with the copter level and still, leaving gravity on the board's Z
+	ComputeBias() error
+	// Correct what's read from now on with the calibration, nil turns it off
+	SetCalibration(cal *AccelCalibration)
+}
+
+// A Magnetometer measures the magnetic field in microtesla
+type Magnetometer interface {
+	Triaxial
+	// Correct what's read from now on with the hard and soft iron
+	// calibration, nil turns it off
+	SetCalibration(cal *MagCalibration)
+}
+
+// A sensor with a FIFO, read in bursts rather than a sample at a time
+type Buffered interface {
+	// Start buffering samples in the chip's FIFO
+	EnableFIFO() error
+	// Take every sample waiting in the FIFO, as Measure takes one, and
+	// report whether it had filled up so samples may have been lost
+	MeasureFIFO(now int64) (n int, overrun bool, err error)
+}
+
+// A sensor whose samples come in another sensor's FIFO, as the MPU's
+// accelerometer's come in with its gyroscope's, so it has none of its own
+type FIFOSharer interface {
+	// The Buffered whose MeasureFIFO takes this sensor's samples too
+	SharedFIFO() Buffered
+}
+
+// A sensor that can raise an interrupt pin when it has a new sample
+type DataReadySignaller interface {
+	// Raise the pin with each new sample, until the sample's read
+	EnableDataReady() error
+	DisableDataReady() error
+}
+
+// A sensor that can read its own temperature, to compensate for it
+type Thermometer interface {
+	// Read the temperature in degrees C
+	ReadCelsius() (deg float32, err error)
+	// Take the bias model's bias at the sensor's temperature off what's
+	// read from now on, nil turns it off
+	SetTempModel(model *TempModel)
+}
+
+// A sensor that can test itself, for preflight and after a crash.  Bus
+// errors are returned as errors, readings out of limits fail the report.
+type SelfTester interface {
+	Sensor
+	SelfTest() (report SelfTestReport, err error)
+}
+
+// Read the identity registers of the driver's chip at addr, a
+// DriverError says why it isn't there
+func identify(bus i2c.Transport, addr byte, driver string) (id Identity, err error) {
+	id.Addr = addr
+	for _, probe := range Probes {
+		if probe.Driver != driver {
+			continue
+		}
+		var ok bool
+		ok, id.Detail, err = probe.Match(bus, addr)
+		switch {
+		case err != nil:
+			err = driverError(driver, addr, err)
+		case ok:
+			id.Driver = driver
+		default:
+			err = &DriverError{Driver: driver, Addr: addr, Kind: ErrWrongChip, Detail: id.Detail}
+		}
+		return
+	}
+	err = fmt.Errorf("sensors: no probe for %s", driver)
+	return
+}
+
+// The drivers in this package
+var (
+	_ Gyroscope          = (*L3GD20)(nil)
+	_ Accelerometer      = (*LSM303ACCEL)(nil)
+	_ Magnetometer       = (*LSM303MAG)(nil)
+	_ Gyroscope          = (*MPU6050Gyro)(nil)
+	_ Accelerometer      = (*MPU6050Accel)(nil)
+	_ Magnetometer       = (*AK8963)(nil)
+	_ Buffered           = (*L3GD20)(nil)
+	_ Buffered           = (*LSM303ACCEL)(nil)
+	_ Buffered           = (*MPU6050Gyro)(nil)
+	_ FIFOSharer         = (*MPU6050Accel)(nil)
+	_ Thermometer        = (*L3GD20)(nil)
+	_ Thermometer        = (*LSM303MAG)(nil)
+	_ DataReadySignaller = (*L3GD20)(nil)
+	_ DataReadySignaller = (*LSM303ACCEL)(nil)
+	_ SelfTester         = (*L3GD20)(nil)
+	_ SelfTester         = (*LSM303ACCEL)(nil)
+	_ SelfTester         = (*LSM303MAG)(nil)
+)
@@ -0,0 +1,118 @@
+package sensors
+
+import (
+	"errors"
+)
+
+/**
+* A linear model of how a sensor's bias drifts with its temperature,
+* fitted by least squares to readings logged with the sensor held still,
+* and subtracted from what the driver reports once it's given one.  The
+* model is in the driver's units, degrees/s for the gyroscope and
+* microtesla for the magnetometer.  The temperature changes slowly, so
+* the driver reads it again only every TEMP_REFRESH calls to Measure or
+* MeasureFIFO, one more bus read each time.  Everything else, ReadXYZ and
+* ReadFIFO included, uses the temperature last read and costs no bus
+* reads.  Until the first Measure the model's Reference is assumed.
+**/
+const TEMP_REFRESH = 50
+
+type TempModel struct {
+	Reference float32    // degrees C the Offset is at
+	Offset    [3]float32 // X, Y and Z bias at the Reference temperature
+	Slope     [3]float32 // X, Y and Z bias change per degree C
+}
+
+// A reading logged to fit a TempModel to
+type TempReading struct {
+	Temp    float32 // degrees C
+	X, Y, Z float32
+}
+
+// Return the modelled bias at temp
+func (m *TempModel) Bias(temp float32) (x, y, z float32) {
+	d := temp - m.Reference
+	x = m.Offset[0] + m.Slope[0]*d
+	y = m.Offset[1] + m.Slope[1]*d
+	z = m.Offset[2] + m.Slope[2]*d
+	return
+}
+
+// Fit a TempModel to readings taken over a range of temperatures,
+// referenced to their mean temperature
+func FitTempModel(readings []TempReading) (model TempModel, err error) {
+	if len(readings) < 2 {
+		err = errors.New("sensors: at least 2 readings are needed to fit a temperature model")
+		return
+	}
+	var mean [4]float64 // temperature, x, y and z
+	for _, r := range readings {
+		mean[0] += float64(r.Temp)
+		mean[1] += float64(r.X)
+		mean[2] += float64(r.Y)
+		mean[3] += float64(r.Z)
+	}
+	for i := range mean {
+		mean[i] /= float64(len(readings))
+	}
+	var variance float64
+	var covariance [3]float64
+	for _, r := range readings {
+		d := float64(r.Temp) - mean[0]
+		variance += d * d
+		covariance[0] += d * (float64(r.X) - mean[1])
+		covariance[1] += d * (float64(r.Y) - mean[2])
+		covariance[2] += d * (float64(r.Z) - mean[3])
+	}
+	if variance == 0 {
+		err = errors.New("sensors: the readings must cover a range of temperatures to fit a temperature model")
+		return
+	}
+	model.Reference = float32(mean[0])
+	for axis := 0; axis < 3; axis++ {
+		model.Offset[axis] = float32(mean[axis+1])
+		model.Slope[axis] = float32(covariance[axis] / variance)
+	}
+	return
+}
+
+// A driver's temperature compensation, off until it has a model
+type tempCompensation struct {
+	model *TempModel
+	temp  float32
+	reads int
+}
+
+// Use model, nil turns compensation off
+func (c *tempCompensation) set(model *TempModel) {
+	c.model = model
+	c.reads = 0
+	if model != nil {
+		c.temp = model.Reference
+	}
+}
+
+// Read the temperature with read every TEMP_REFRESH calls, called as
+// samples are measured.  A failed read is tried again on the next call.
+func (c *tempCompensation) refresh(read func() (float32, error)) (err error) {
+	if c.model == nil {
+		return
+	}
+	if c.reads%TEMP_REFRESH == 0 {
+		var temp float32
+		if temp, err = read(); err != nil {
+			return
+		}
+		c.temp = temp
+	}
+	c.reads++
+	return
+}
+
+// Return the bias to take off a reading, at the temperature last read
+func (c *tempCompensation) bias() (x, y, z float32) {
+	if c.model != nil {
+		x, y, z = c.model.Bias(c.temp)
+	}
+	return
+}
@@ -0,0 +1,169 @@
+package emulator
+
+import (
+	"goPiCopter/io/sensors"
+	"sync"
+	"time"
+)
+
+/**
+* Emulates the AK8963 magnetometer's register file.
+* CNTL1 selects the mode and 14 or 16 bit output.  Single measurement
+* mode measures once and powers down again, the continuous modes measure
+* at 8Hz or 100Hz, and reads starting at HXL latch a new measurement.
+* Output is little endian, each axis divided by its sensitivity
+* adjustment, and ST2's HOFL is set when the field is beyond what the
+* chip can measure.  ST1's DRDY is set by a measurement and cleared by
+* reading ST2.  The adjustments read from ASAX..ASAZ only in fuse ROM
+* mode.  The register address always auto-increments.
+**/
+const (
+	// the field beyond which HOFL is set, |X|+|Y|+|Z| in microtesla
+	ak8963Overflow = 4912
+)
+
+type AK8963 struct {
+	lock      sync.Mutex
+	motion    Motion
+	registers [0x20]byte
+	asa       [3]byte
+	now       time.Duration // time of the latched sample
+	started   bool
+	truth     Sample
+}
+
+// Return a new emulated AK8963 driven by a Motion profile, in its own axes
+func NewAK8963(motion Motion) (em *AK8963) {
+	em = new(AK8963)
+	em.motion = motion
+	em.asa = [3]byte{0xB0, 0xB2, 0xA8}
+	em.reset()
+	return
+}
+
+// Put the registers back as they come out of reset, powered down
+func (em *AK8963) reset() {
+	em.registers = [0x20]byte{}
+	em.registers[sensors.AK8963_WIA] = sensors.AK8963_ID
+	em.registers[sensors.AK8963_INFO] = 0x9A
+}
+
+// Give the chip other sensitivity adjustments in its fuse ROM
+func (em *AK8963) SetAdjustments(asa [3]byte) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	em.asa = asa
+}
+
+// Return the Sample behind the most recently latched output
+func (em *AK8963) Truth() (sample Sample) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	sample = em.truth
+	return
+}
+
+// Return CNTL1's mode
+func (em *AK8963) mode() byte {
+	return em.registers[sensors.AK8963_CNTL1] & sensors.AK8963_CNTL1_MODE
+}
+
+// Take a measurement and latch it into the output registers
+func (em *AK8963) measure(rate float64) {
+	if em.started {
+		em.now += period(rate)
+	}
+	em.started = true
+	em.truth = em.motion.At(em.now)
+
+	bits16 := em.registers[sensors.AK8963_CNTL1]&sensors.AK8963_CNTL1_16BIT != 0
+	sensitivity := float32(sensors.AK8963_SENSITIVITY_14BIT)
+	if bits16 {
+		sensitivity = sensors.AK8963_SENSITIVITY_16BIT
+	}
+	var total float32
+	for axis := 0; axis < 3; axis++ {
+		field := em.truth.Field[axis] * 100 // microtesla
+		if field < 0 {
+			total -= field
+		} else {
+			total += field
+		}
+		adjust := (float32(em.asa[axis])-128)/256 + 1
+		v := saturate(field / (sensitivity * adjust))
+		if !bits16 && v > 8190 {
+			v = 8190
+		} else if !bits16 && v < -8190 {
+			v = -8190
+		}
+		put16(em.registers[sensors.AK8963_HXL+2*axis:], v, false)
+	}
+	st2 := em.registers[sensors.AK8963_CNTL1] & sensors.AK8963_ST2_BITM
+	if total >= ak8963Overflow {
+		st2 |= sensors.AK8963_ST2_HOFL
+	}
+	em.registers[sensors.AK8963_ST2] = st2
+	em.registers[sensors.AK8963_ST1] |= sensors.AK8963_ST1_DRDY
+}
+
+func (em *AK8963) ReadRegisters(reg byte, data []byte) (err error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	reg &= 0x1F
+	if reg == sensors.AK8963_HXL {
+		switch em.mode() {
+		case sensors.AK8963_MODE_CONTINUOUS_8HZ:
+			em.measure(8)
+		case sensors.AK8963_MODE_CONTINUOUS_100HZ:
+			em.measure(100)
+		}
+	}
+	for i := range data {
+		switch {
+		case reg >= sensors.AK8963_ASAX && reg <= sensors.AK8963_ASAZ:
+			if em.mode() == sensors.AK8963_MODE_FUSE_ROM {
+				data[i] = em.asa[reg-sensors.AK8963_ASAX]
+			} else {
+				data[i] = 0
+			}
+		default:
+			data[i] = em.registers[reg]
+		}
+		// reading ST2 ends the read of the measurement
+		if reg == sensors.AK8963_ST2 {
+			em.registers[sensors.AK8963_ST1] &^= sensors.AK8963_ST1_DRDY
+		}
+		reg = (reg + 1) & 0x1F
+	}
+	return
+}
+
+func (em *AK8963) WriteRegisters(reg byte, data []byte) (err error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	reg &= 0x1F
+	for _, value := range data {
+		switch reg {
+		case sensors.AK8963_CNTL1:
+			em.registers[reg] = value
+			if value&sensors.AK8963_CNTL1_MODE == sensors.AK8963_MODE_SINGLE {
+				// a single measurement, then back to power down
+				em.measure(100)
+				em.registers[reg] = value &^ sensors.AK8963_CNTL1_MODE
+			}
+		case sensors.AK8963_CNTL2:
+			if value&sensors.AK8963_CNTL2_RST != 0 {
+				em.reset()
+			}
+		case sensors.AK8963_ASTC:
+			em.registers[reg] = value
+		}
+		// everything else is read only
+		reg = (reg + 1) & 0x1F
+	}
+	return
+}
@@ -0,0 +1,107 @@
+package emulator
+
+import (
+	"time"
+)
+
+/**
+* The 32 sample FIFO of the ST chips, the L3GD20 and the LSM303's
+* accelerometer.  It's filled at the output data rate as time passes on
+* its clock, wall clock time unless SetClock says otherwise.  The chip
+* it's in says when it's on, whether it stops once full, and how to take
+* a sample; FIFO_SRC_REG is laid out the same on both.
+**/
+const (
+	fifoSize = 32
+
+	fifoSrcWTM   = 0x80 // at or above the watermark
+	fifoSrcOVRN  = 0x40 // full
+	fifoSrcEMPTY = 0x20
+	fifoSrcFSS   = 0x1F // samples waiting
+)
+
+type fifo struct {
+	samples [fifoSize][6]byte
+	count   int
+	on      bool
+	from    time.Duration // where the clock was when the FIFO was turned on
+	at      time.Duration // and the time of the chip's sample then
+	clock   func() time.Duration
+}
+
+// Start the clock at the wall clock time now
+func (f *fifo) init() {
+	start := time.Now()
+	f.clock = func() time.Duration { return time.Since(start) }
+}
+
+// Fill from clock rather than the wall clock
+func (f *fifo) setClock(clock func() time.Duration) {
+	f.clock = clock
+	f.from = clock()
+}
+
+// Turn the FIFO on or off, now is the time of the chip's latest sample.
+// It's emptied whenever it goes off.
+func (f *fifo) turn(on bool, now time.Duration) {
+	if on && !f.on {
+		f.from = f.clock()
+		f.at = now
+	}
+	if !on {
+		f.count = 0
+	}
+	f.on = on
+}
+
+// Take the samples due since the FIFO was last filled, step apart,
+// advancing now to the time of the last one taken
+func (f *fifo) fill(now *time.Duration, step time.Duration, stopWhenFull bool, sample func() [6]byte) {
+	target := f.at + (f.clock() - f.from)
+	for *now+step <= target {
+		if f.count == fifoSize {
+			if stopWhenFull {
+				*now = target
+				break
+			}
+			// stream mode, the oldest sample is lost
+			copy(f.samples[:], f.samples[1:])
+			f.count--
+		}
+		*now += step
+		f.samples[f.count] = sample()
+		f.count++
+	}
+}
+
+// Return FIFO_SRC_REG for the samples in the FIFO and the watermark level
+func (f *fifo) source(wtm int) (src byte) {
+	switch f.count {
+	case 0:
+		src = fifoSrcEMPTY
+	case fifoSize:
+		src = fifoSrcOVRN | fifoSrcFSS
+	default:
+		src = byte(f.count)
+	}
+	if wtm > 0 && f.count >= wtm {
+		src |= fifoSrcWTM
+	}
+	return
+}
+
+// Read byte i of the oldest sample, reading the last byte takes it out
+// of the FIFO and into out, the output registers.  ok is false when the
+// FIFO is empty.
+func (f *fifo) read(i int, out []byte) (value byte, ok bool) {
+	if f.count == 0 {
+		return
+	}
+	value, ok = f.samples[0][i], true
+	if i == 5 {
+		copy(out, f.samples[0][:])
+		copy(f.samples[:], f.samples[1:])
+		f.count--
+	}
+	return
+}
@@ -0,0 +1,227 @@
+package emulator
+
+import (
+	"goPiCopter/io/sensors"
+	"math"
+	"sync"
+	"time"
+)
+
+/**
+* Emulates the L3GD20 gyroscope's register file.
+* CTRL_REG1 controls power, enabled axes and output data rate,
+* CTRL_REG4 controls full scale and endianness, and reads starting
+* at OUT_X_L latch a new sample.  Like the real part, the register
+* address only auto-increments when its high bit is set.  OUT_TEMP
+* reads the motion's temperature, 1 digit per degree, falling as the
+* temperature rises from L3GD20_TEMP_OFFSET.  CTRL_REG4's self-test
+* bits add selfTestShift to every axis, self-test 1 takes it away.
+*
+* With the FIFO on, samples are taken at the output data rate as time
+* passes on the emulator's clock, wall clock time unless SetClock says
+* otherwise, and reads of the output registers take them from the FIFO,
+* rolling back from OUT_Z_H to OUT_X_L.
+**/
+type L3GD20 struct {
+	lock      sync.Mutex
+	motion    Motion
+	registers [0x40]byte
+	now       time.Duration // time of the latched sample
+	started   bool
+	truth     Sample
+	fifo      fifo
+}
+
+// The self-test shift in degrees/s, the datasheet's typical value at 2000dps
+const selfTestShift = 530
+
+// Return a new emulated L3GD20 driven by a Motion profile
+func NewL3GD20(motion Motion) (em *L3GD20) {
+	em = new(L3GD20)
+	em.motion = motion
+	em.registers[sensors.L3GD20_WHO_AM_I] = sensors.L3GD20_ID
+	em.registers[sensors.L3GD20_CTRL_REG1] = 0x07 // power down, all axes enabled
+	em.fifo.init()
+	return
+}
+
+// Drive the FIFO from clock rather than the wall clock
+func (em *L3GD20) SetClock(clock func() time.Duration) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	em.fifo.setClock(clock)
+}
+
+// Return the Sample behind the most recently latched output
+func (em *L3GD20) Truth() (sample Sample) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	sample = em.truth
+	return
+}
+
+// Return the output data rate selected in CTRL_REG1
+func (em *L3GD20) rate() float64 {
+	return [4]float64{95, 190, 380, 760}[em.registers[sensors.L3GD20_CTRL_REG1]>>6]
+}
+
+// Return the sensitivity in dps/digit selected in CTRL_REG4
+func (em *L3GD20) sensitivity() float32 {
+	switch (em.registers[sensors.L3GD20_CTRL_REG4] >> 4) & 0x03 {
+	case sensors.L3GD20_RANGE_250DPS:
+		return sensors.L3GD20_SENSITIVITY_250DPS
+	case sensors.L3GD20_RANGE_500DPS:
+		return sensors.L3GD20_SENSITIVITY_500DPS
+	}
+	return sensors.L3GD20_SENSITIVITY_2000DPS
+}
+
+// Return whether the chip is powered up
+func (em *L3GD20) powered() bool {
+	return em.registers[sensors.L3GD20_CTRL_REG1]&0x08 != 0
+}
+
+// Take the sample at em.now, returning the output registers' bytes
+func (em *L3GD20) sample() (out [6]byte) {
+	ctrl1 := em.registers[sensors.L3GD20_CTRL_REG1]
+	em.truth = em.motion.At(em.now)
+
+	sensitivity := em.sensitivity()
+	ctrl4 := em.registers[sensors.L3GD20_CTRL_REG4]
+	bigEndian := ctrl4&0x40 != 0
+	var shift float32
+	switch ctrl4 & sensors.L3GD20_CTRL_REG4_ST {
+	case sensors.L3GD20_ST_POSITIVE:
+		shift = selfTestShift
+	case sensors.L3GD20_ST_NEGATIVE:
+		shift = -selfTestShift
+	}
+	for axis := 0; axis < 3; axis++ {
+		var v int16
+		if ctrl1&(1<<uint(axis)) != 0 {
+			v = saturate((em.truth.Rate[axis] + shift) / sensitivity)
+		}
+		put16(out[2*axis:2*axis+2], v, bigEndian)
+	}
+	return
+}
+
+// Latch the next sample into the output registers
+func (em *L3GD20) latch() {
+	if !em.powered() {
+		// powered down, output registers hold their last value
+		return
+	}
+	if em.started {
+		em.now += period(em.rate())
+	}
+	em.started = true
+	out := em.sample()
+	copy(em.registers[sensors.L3GD20_OUT_X_L:], out[:])
+	em.registers[sensors.L3GD20_STATUS_REG] = 0x0F // ZYXDA, ZDA, YDA, XDA
+}
+
+// Start or stop the FIFO when CTRL_REG5 or FIFO_CTRL_REG change
+func (em *L3GD20) fifoChanged() {
+	fm := em.registers[sensors.L3GD20_FIFO_CTRL_REG] &^ sensors.L3GD20_FIFO_WTM
+	on := em.registers[sensors.L3GD20_CTRL_REG5]&sensors.L3GD20_CTRL_REG5_FIFO_EN != 0 && fm != sensors.L3GD20_FM_BYPASS
+	em.fifo.turn(on, em.now)
+}
+
+// Take the samples due since the FIFO was last filled
+func (em *L3GD20) fill() {
+	if !em.powered() {
+		return
+	}
+	fm := em.registers[sensors.L3GD20_FIFO_CTRL_REG] &^ sensors.L3GD20_FIFO_WTM
+	em.fifo.fill(&em.now, period(em.rate()), fm == sensors.L3GD20_FM_FIFO, em.sample)
+}
+
+// Read the byte at reg with the FIFO on, reading OUT_Z_H takes the sample
+func (em *L3GD20) readFIFO(reg byte) (value byte) {
+	value, ok := em.fifo.read(int(reg-sensors.L3GD20_OUT_X_L), em.registers[sensors.L3GD20_OUT_X_L:sensors.L3GD20_OUT_Z_H+1])
+	if !ok {
+		// empty, the output registers hold the last sample
+		value = em.registers[reg]
+	}
+	return
+}
+
+func (em *L3GD20) ReadRegisters(reg byte, data []byte) (err error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	increment := reg&0x80 != 0
+	reg &= 0x7F
+	temp := em.motion.At(em.now).Temp
+	em.registers[sensors.L3GD20_OUT_TEMP] = byte(int8(math.Round(float64(sensors.L3GD20_TEMP_OFFSET - temp))))
+	if em.fifo.on {
+		em.fill()
+		for i := range data {
+			output := reg >= sensors.L3GD20_OUT_X_L && reg <= sensors.L3GD20_OUT_Z_H
+			switch {
+			case output:
+				data[i] = em.readFIFO(reg)
+			case reg == sensors.L3GD20_FIFO_SRC_REG:
+				data[i] = em.fifo.source(int(em.registers[sensors.L3GD20_FIFO_CTRL_REG] & sensors.L3GD20_FIFO_WTM))
+			default:
+				data[i] = em.registers[int(reg)%len(em.registers)]
+			}
+			if increment && output && reg == sensors.L3GD20_OUT_Z_H {
+				reg = sensors.L3GD20_OUT_X_L
+			} else if increment {
+				reg++
+			}
+		}
+		return
+	}
+
+	if reg == sensors.L3GD20_OUT_X_L {
+		em.latch()
+	}
+	consumed := false
+	for i := range data {
+		if reg == sensors.L3GD20_FIFO_SRC_REG {
+			data[i] = sensors.L3GD20_FIFO_SRC_EMPTY
+		} else {
+			data[i] = em.registers[int(reg)%len(em.registers)]
+		}
+		// reading the last output register consumes the sample
+		consumed = consumed || reg == sensors.L3GD20_OUT_Z_H
+		if increment {
+			reg++
+		}
+	}
+	if consumed {
+		em.registers[sensors.L3GD20_STATUS_REG] = 0
+	}
+	return
+}
+
+func (em *L3GD20) WriteRegisters(reg byte, data []byte) (err error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	increment := reg&0x80 != 0
+	reg &= 0x7F
+	for _, value := range data {
+		switch reg {
+		case sensors.L3GD20_CTRL_REG1, sensors.L3GD20_CTRL_REG2, sensors.L3GD20_CTRL_REG3,
+			sensors.L3GD20_CTRL_REG4, sensors.L3GD20_CTRL_REG5, sensors.L3GD20_REFERENCE,
+			sensors.L3GD20_FIFO_CTRL_REG:
+			em.registers[reg] = value
+		default:
+			if reg >= sensors.L3GD20_INT1_CFG && reg <= sensors.L3GD20_INT1_DURATION && reg != sensors.L3GD20_INT1_SRC {
+				em.registers[reg] = value
+			}
+			// everything else is read only
+		}
+		if increment {
+			reg++
+		}
+	}
+	em.fifoChanged()
+	return
+}
@@ -0,0 +1,250 @@
+package emulator
+
+import (
+	"goPiCopter/io/sensors"
+	"sync"
+	"time"
+)
+
+/**
+* Emulates the LSM303 accelerometer's register file.
+* CTRL_REG1 controls output data rate, low power mode and enabled axes,
+* CTRL_REG4 controls full scale, high resolution and endianness.
+* Output is left justified, 12 bits in high resolution mode, 10 bits
+* in normal mode and 8 bits in low power mode.  Reads starting at
+* OUT_X_L latch a new sample, and the register address only
+* auto-increments when its high bit is set.
+*
+* The FIFO works as the L3GD20's does, filled at the output data rate
+* as time passes on the emulator's clock.  SetDistortion gives the chip
+* the offset, scale and cross axis errors a real one has, the Truth stays
+* the undistorted acceleration.
+**/
+type LSM303ACCEL struct {
+	lock      sync.Mutex
+	motion    Motion
+	registers [0x40]byte
+	now       time.Duration // time of the latched sample
+	started   bool
+	truth     Sample
+	fifo      fifo
+	// measured = distortMatrix * acceleration + distortOffset
+	distort       bool
+	distortOffset [3]float32
+	distortMatrix [3][3]float32
+}
+
+// Return a new emulated LSM303 accelerometer driven by a Motion profile
+func NewLSM303ACCEL(motion Motion) (em *LSM303ACCEL) {
+	em = new(LSM303ACCEL)
+	em.motion = motion
+	em.registers[sensors.LSM303ACCEL_WHO_AM_I] = sensors.LSM303ACCEL_ID
+	em.registers[sensors.LSM303ACCEL_CTRL_REG1] = 0x07 // power down, all axes enabled
+	em.fifo.init()
+	return
+}
+
+// Drive the FIFO from clock rather than the wall clock
+func (em *LSM303ACCEL) SetClock(clock func() time.Duration) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	em.fifo.setClock(clock)
+}
+
+// Distort the acceleration measured, the offset in g
+func (em *LSM303ACCEL) SetDistortion(offset [3]float32, matrix [3][3]float32) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	em.distort, em.distortOffset, em.distortMatrix = true, offset, matrix
+}
+
+// Return the Sample behind the most recently latched output
+func (em *LSM303ACCEL) Truth() (sample Sample) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	sample = em.truth
+	return
+}
+
+// Return the output data rate selected in CTRL_REG1, 0 when powered down
+func (em *LSM303ACCEL) rate() float64 {
+	ctrl1 := em.registers[sensors.LSM303ACCEL_CTRL_REG1]
+	switch ctrl1 >> 4 {
+	case 8:
+		return 1620
+	case 9:
+		if ctrl1&0x08 != 0 {
+			return 5376
+		}
+		return 1344
+	}
+	return [16]float64{0, 1, 10, 25, 50, 100, 200, 400}[ctrl1>>4]
+}
+
+// Return the sensitivity in g/digit of the 12 bit value selected in CTRL_REG4
+func (em *LSM303ACCEL) sensitivity() float32 {
+	return [4]float32{0.001, 0.002, 0.004, 0.012}[(em.registers[sensors.LSM303ACCEL_CTRL_REG4]>>4)&0x03]
+}
+
+// Take the sample at em.now, returning the output registers' bytes
+func (em *LSM303ACCEL) sample() (out [6]byte) {
+	ctrl1 := em.registers[sensors.LSM303ACCEL_CTRL_REG1]
+	ctrl4 := em.registers[sensors.LSM303ACCEL_CTRL_REG4]
+	em.truth = em.motion.At(em.now)
+
+	// Resolution depends on the mode, drop the bits the chip wouldn't produce
+	var mask uint16 = 0xFFC0 // normal mode, 10 bits
+	if ctrl1&0x08 != 0 {
+		mask = 0xFF00 // low power mode, 8 bits
+	} else if ctrl4&0x08 != 0 {
+		mask = 0xFFF0 // high resolution mode, 12 bits
+	}
+
+	accel := em.truth.Accel
+	if em.distort {
+		for axis := 0; axis < 3; axis++ {
+			m := em.distortMatrix[axis]
+			accel[axis] = m[0]*em.truth.Accel[0] + m[1]*em.truth.Accel[1] + m[2]*em.truth.Accel[2] + em.distortOffset[axis]
+		}
+	}
+	sensitivity := em.sensitivity()
+	for axis := 0; axis < 3; axis++ {
+		var v int16
+		if ctrl1&(1<<uint(axis)) != 0 {
+			v = saturate(accel[axis] / sensitivity * 16)
+			v = int16(uint16(v) & mask)
+		}
+		put16(out[2*axis:2*axis+2], v, ctrl4&0x40 != 0)
+	}
+	return
+}
+
+// Latch the next sample into the output registers
+func (em *LSM303ACCEL) latch() {
+	rate := em.rate()
+	if rate == 0 {
+		// powered down, output registers hold their last value
+		return
+	}
+	if em.started {
+		em.now += period(rate)
+	}
+	em.started = true
+	out := em.sample()
+	copy(em.registers[sensors.LSM303ACCEL_OUT_X_L:], out[:])
+	em.registers[sensors.LSM303ACCEL_STATUS_REG] = 0x0F // ZYXDA, ZDA, YDA, XDA
+}
+
+// Return FIFO_CTRL_REG's FIFO mode
+func (em *LSM303ACCEL) fifoMode() byte {
+	return em.registers[sensors.LSM303ACCEL_FIFO_CTRL_REG] &^ (sensors.LSM303ACCEL_FIFO_TR | sensors.LSM303ACCEL_FIFO_FTH)
+}
+
+// Start or stop the FIFO when CTRL_REG5 or FIFO_CTRL_REG change
+func (em *LSM303ACCEL) fifoChanged() {
+	on := em.registers[sensors.LSM303ACCEL_CTRL_REG5]&sensors.LSM303ACCEL_CTRL_REG5_FIFO_EN != 0 &&
+		em.fifoMode() != sensors.LSM303ACCEL_FM_BYPASS
+	em.fifo.turn(on, em.now)
+}
+
+// Take the samples due since the FIFO was last filled
+func (em *LSM303ACCEL) fill() {
+	rate := em.rate()
+	if rate == 0 {
+		return
+	}
+	// trigger mode is taken to be triggered from the start
+	em.fifo.fill(&em.now, period(rate), em.fifoMode() != sensors.LSM303ACCEL_FM_STREAM, em.sample)
+}
+
+// Read the byte at reg with the FIFO on, reading OUT_Z_H takes the sample
+func (em *LSM303ACCEL) readFIFO(reg byte) (value byte) {
+	value, ok := em.fifo.read(int(reg-sensors.LSM303ACCEL_OUT_X_L), em.registers[sensors.LSM303ACCEL_OUT_X_L:sensors.LSM303ACCEL_OUT_Z_H+1])
+	if !ok {
+		// empty, the output registers hold the last sample
+		value = em.registers[reg]
+	}
+	return
+}
+
+// Return true for the registers the host may write, the rest are read only
+func accelWritable(reg byte) bool {
+	switch reg {
+	case sensors.LSM303ACCEL_INT1_SOURCE, sensors.LSM303ACCEL_INT2_SOURCE, sensors.LSM303ACCEL_CLICK_SRC:
+		return false
+	case sensors.LSM303ACCEL_FIFO_CTRL_REG:
+		return true
+	}
+	return (reg >= sensors.LSM303ACCEL_CTRL_REG1 && reg <= sensors.LSM303ACCEL_REFERENCE) ||
+		(reg >= sensors.LSM303ACCEL_INT1_CFG && reg <= sensors.LSM303ACCEL_TIME_WINDOW)
+}
+
+func (em *LSM303ACCEL) ReadRegisters(reg byte, data []byte) (err error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	increment := reg&0x80 != 0
+	reg &= 0x7F
+	if em.fifo.on {
+		em.fill()
+		for i := range data {
+			output := reg >= sensors.LSM303ACCEL_OUT_X_L && reg <= sensors.LSM303ACCEL_OUT_Z_H
+			switch {
+			case output:
+				data[i] = em.readFIFO(reg)
+			case reg == sensors.LSM303ACCEL_FIFO_SRC_REG:
+				data[i] = em.fifo.source(int(em.registers[sensors.LSM303ACCEL_FIFO_CTRL_REG] & sensors.LSM303ACCEL_FIFO_FTH))
+			default:
+				data[i] = em.registers[int(reg)%len(em.registers)]
+			}
+			if increment && output && reg == sensors.LSM303ACCEL_OUT_Z_H {
+				reg = sensors.LSM303ACCEL_OUT_X_L
+			} else if increment {
+				reg++
+			}
+		}
+		return
+	}
+
+	if reg == sensors.LSM303ACCEL_OUT_X_L {
+		em.latch()
+	}
+	consumed := false
+	for i := range data {
+		if reg == sensors.LSM303ACCEL_FIFO_SRC_REG {
+			data[i] = sensors.LSM303ACCEL_FIFO_SRC_EMPTY
+		} else {
+			data[i] = em.registers[int(reg)%len(em.registers)]
+		}
+		// reading the last output register consumes the sample
+		consumed = consumed || reg == sensors.LSM303ACCEL_OUT_Z_H
+		if increment {
+			reg++
+		}
+	}
+	if consumed {
+		em.registers[sensors.LSM303ACCEL_STATUS_REG] = 0
+	}
+	return
+}
+
+func (em *LSM303ACCEL) WriteRegisters(reg byte, data []byte) (err error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	increment := reg&0x80 != 0
+	reg &= 0x7F
+	for _, value := range data {
+		if accelWritable(reg) {
+			em.registers[reg] = value
+		}
+		if increment {
+			reg++
+		}
+	}
+	em.fifoChanged()
+	return
+}
@@ -0,0 +1,197 @@
+package emulator
+
+import (
+	"goPiCopter/io/sensors"
+	"math"
+	"sync"
+	"time"
+)
+
+/**
+* Emulates the LSM303 magnetometer's register file.
+* CRA_REG controls the output data rate, CRB_REG the gain and
+* MR_REG continuous, single and sleep modes.  Output is big endian
+* in X, Z, Y order, and an axis that is out of range for the selected
+* gain reads as the -4096 overflow value.  SR_REG's DRDY is set by a
+* measurement and cleared by reading it, and always set in continuous
+* mode, which measures whenever the outputs are read.  With CRA_REG's
+* TEMP_EN set, TEMP_OUT reads the motion's temperature, 12 bits left
+* justified, 8 digits per degree from LSM303MAG_TEMP_OFFSET.  Unlike
+* the accelerometer, the register address always auto-increments, and
+* rolls over from OUT_Y_L back to OUT_X_H so the outputs can be read
+* continuously.  SetIron distorts the field measured as iron on the
+* copter would, the Truth stays the undistorted field.  A gain written
+* to CRB_REG applies from the next measurement, so in continuous mode the
+* next read still finds the outputs measured at the old gain, and DRDY
+* clear.
+**/
+
+type LSM303MAG struct {
+	lock      sync.Mutex
+	motion    Motion
+	registers [0x40]byte
+	now       time.Duration // time of the latched sample
+	started   bool
+	truth     Sample
+	regain    bool // the gain changed since the last measurement
+	// hard and soft iron, measured = ironMatrix * field + ironOffset
+	iron       bool
+	ironOffset [3]float32
+	ironMatrix [3][3]float32
+}
+
+// Return a new emulated LSM303 magnetometer driven by a Motion profile
+func NewLSM303MAG(motion Motion) (em *LSM303MAG) {
+	em = new(LSM303MAG)
+	em.motion = motion
+	em.registers[sensors.LSM303MAG_CRA_REG] = 0x10 // 15 Hz
+	em.registers[sensors.LSM303MAG_CRB_REG] = sensors.LSM303MAG_GAIN_1_3
+	em.registers[sensors.LSM303MAG_MR_REG] = 0x03 // sleep
+	em.registers[sensors.LSM303MAG_IRA_REG] = 'H'
+	em.registers[sensors.LSM303MAG_IRB_REG] = '4'
+	em.registers[sensors.LSM303MAG_IRC_REG] = '3'
+	return
+}
+
+// Distort the field measured, the offset in gauss
+func (em *LSM303MAG) SetIron(offset [3]float32, matrix [3][3]float32) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	em.iron, em.ironOffset, em.ironMatrix = true, offset, matrix
+}
+
+// Return the Sample behind the most recently latched output
+func (em *LSM303MAG) Truth() (sample Sample) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	sample = em.truth
+	return
+}
+
+// Return the output data rate selected in CRA_REG
+func (em *LSM303MAG) rate() float64 {
+	return [8]float64{0.75, 1.5, 3, 7.5, 15, 30, 75, 220}[(em.registers[sensors.LSM303MAG_CRA_REG]>>2)&0x07]
+}
+
+// Return the X/Y and Z gains in LSB/gauss selected in CRB_REG
+func (em *LSM303MAG) gain() (xy, z float32) {
+	switch em.registers[sensors.LSM303MAG_CRB_REG] & 0xE0 {
+	case sensors.LSM303MAG_GAIN_1_9:
+		return 855, 760
+	case sensors.LSM303MAG_GAIN_2_5:
+		return 670, 600
+	case sensors.LSM303MAG_GAIN_4_0:
+		return 450, 400
+	case sensors.LSM303MAG_GAIN_4_7:
+		return 400, 355
+	case sensors.LSM303MAG_GAIN_5_6:
+		return 330, 295
+	case sensors.LSM303MAG_GAIN_8_1:
+		return 230, 205
+	}
+	return 1100, 980
+}
+
+// Take a measurement and latch it into the output registers
+func (em *LSM303MAG) measure() {
+	if em.started {
+		em.now += period(em.rate())
+	}
+	em.started = true
+	em.truth = em.motion.At(em.now)
+	em.regain = false
+
+	field := em.truth.Field
+	if em.iron {
+		for axis := 0; axis < 3; axis++ {
+			m := em.ironMatrix[axis]
+			field[axis] = m[0]*em.truth.Field[0] + m[1]*em.truth.Field[1] + m[2]*em.truth.Field[2] + em.ironOffset[axis]
+		}
+	}
+	xy, z := em.gain()
+	gains := [3]float32{xy, xy, z}
+	var out [3]int16
+	for axis := 0; axis < 3; axis++ {
+		out[axis] = saturate(field[axis] * gains[axis])
+		if out[axis] < -2048 || out[axis] > 2047 {
+			out[axis] = sensors.LSM303MAG_OVERFLOW
+		}
+	}
+	put16(em.registers[sensors.LSM303MAG_OUT_X_H:], out[0], true)
+	put16(em.registers[sensors.LSM303MAG_OUT_Z_H:], out[2], true)
+	put16(em.registers[sensors.LSM303MAG_OUT_Y_H:], out[1], true)
+	var temp int16
+	if em.registers[sensors.LSM303MAG_CRA_REG]&sensors.LSM303MAG_CRA_TEMP_EN != 0 {
+		temp = int16(math.Round(float64((em.truth.Temp - sensors.LSM303MAG_TEMP_OFFSET) * sensors.LSM303MAG_TEMP_LSB_PER_DEG)))
+	}
+	put16(em.registers[sensors.LSM303MAG_TEMP_OUT_H:], temp<<4, true)
+	em.registers[sensors.LSM303MAG_SR_REG] |= sensors.LSM303MAG_SR_DRDY
+}
+
+// Return the register address that follows reg
+func (em *LSM303MAG) next(reg byte) byte {
+	switch reg {
+	case sensors.LSM303MAG_OUT_Y_L:
+		return sensors.LSM303MAG_OUT_X_H
+	case sensors.LSM303MAG_IRC_REG:
+		return sensors.LSM303MAG_CRA_REG
+	}
+	return reg + 1
+}
+
+func (em *LSM303MAG) ReadRegisters(reg byte, data []byte) (err error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	reg &= 0x7F
+	continuous := em.registers[sensors.LSM303MAG_MR_REG]&sensors.LSM303MAG_MR_MODE == sensors.LSM303MAG_MODE_CONTINUOUS
+	if continuous && em.regain {
+		// the chip's measuring at the new gain, the outputs are the old one's
+		em.regain = false
+	} else if continuous {
+		// continuous conversion mode always has a fresh sample
+		em.registers[sensors.LSM303MAG_SR_REG] |= sensors.LSM303MAG_SR_DRDY
+		if reg == sensors.LSM303MAG_OUT_X_H {
+			em.measure()
+		}
+	}
+	consumed := false
+	for i := range data {
+		data[i] = em.registers[int(reg)%len(em.registers)]
+		// reading the last output register consumes the sample
+		consumed = consumed || reg == sensors.LSM303MAG_OUT_Y_L
+		reg = em.next(reg)
+	}
+	if consumed {
+		em.registers[sensors.LSM303MAG_SR_REG] &^= sensors.LSM303MAG_SR_DRDY
+	}
+	return
+}
+
+func (em *LSM303MAG) WriteRegisters(reg byte, data []byte) (err error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	reg &= 0x7F
+	for _, value := range data {
+		switch reg {
+		case sensors.LSM303MAG_CRA_REG:
+			em.registers[reg] = value
+		case sensors.LSM303MAG_CRB_REG:
+			em.regain = em.regain || value&0xE0 != em.registers[reg]&0xE0
+			em.registers[reg] = value
+		case sensors.LSM303MAG_MR_REG:
+			em.registers[reg] = value
+			if value&sensors.LSM303MAG_MR_MODE == sensors.LSM303MAG_MODE_SINGLE {
+				// single conversion, then back to sleep
+				em.measure()
+				em.registers[reg] = value | sensors.LSM303MAG_MODE_SLEEP
+			}
+		}
+		// everything else is read only
+		reg = em.next(reg)
+	}
+	return
+}
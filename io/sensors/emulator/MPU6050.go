@@ -0,0 +1,339 @@
+package emulator
+
+import (
+	"errors"
+	"goPiCopter/io/sensors"
+	"goPiCopter/io/sensors/i2c"
+	"sync"
+	"time"
+)
+
+/**
+* Emulates the MPU-6050's register file, or the MPU-9250's.
+* It comes out of reset asleep, PWR_MGMT_1's SLEEP set, and sleeping it
+* holds its outputs.  SMPLRT_DIV divides the gyroscope's output rate,
+* 8kHz with CONFIG's DLPF_CFG at 0 and 1kHz otherwise, down to the sample
+* rate, GYRO_CONFIG and ACCEL_CONFIG select the ranges.  Output is big
+* endian, the accelerometer then the temperature then the gyroscope, and
+* reads starting at ACCEL_XOUT_H, TEMP_OUT_H or GYRO_XOUT_H latch a new
+* sample.  The register address always auto-increments, except at
+* FIFO_R_W so the FIFO can be read off in one go.
+*
+* With USER_CTRL's FIFO_EN set the FIFO is filled at the sample rate as
+* time passes on the emulator's clock, with what FIFO_EN selects, and the
+* outputs follow the latest sample rather than latching.  Once full the
+* oldest bytes are lost and INT_STATUS's FIFO_OFLOW is set, reading
+* INT_STATUS clears it.  Resetting the FIFO with FIFO_EN still set
+* catches the chip part way through writing a sample, and the rest of it
+* lands in the emptied FIFO, so the samples after it are misaligned.
+*
+* The MPU-9250's AK8963 sits on the auxiliary bus, Bypass is how it looks
+* on the host's bus, answering only with INT_PIN_CFG's BYPASS_EN set and
+* USER_CTRL's I2C_MST_EN clear.
+**/
+type MPU6050 struct {
+	lock      sync.Mutex
+	motion    Motion
+	id        byte // WHO_AM_I
+	registers [0x80]byte
+	now       time.Duration // time of the latched sample
+	started   bool
+	truth     Sample
+	// the FIFO, and the clock filling it
+	queue    []byte
+	size     int
+	overflow bool
+	on       bool
+	from     time.Duration // where the clock was when the FIFO was turned on
+	at       time.Duration // and the time of the chip's sample then
+	clock    func() time.Duration
+	// the MPU-9250's magnetometer
+	mag *AK8963
+}
+
+// Return a new emulated MPU-6050 driven by a Motion profile
+func NewMPU6050(motion Motion) (em *MPU6050) {
+	em = newMPU(motion, sensors.MPU6050_ID, sensors.MPU6050_FIFO_SIZE)
+	return
+}
+
+// Return a new emulated MPU-9250 driven by a Motion profile, its AK8963
+// feeling the profile's field in its own axes
+func NewMPU9250(motion Motion) (em *MPU6050) {
+	em = newMPU(motion, sensors.MPU9250_ID, sensors.MPU9250_FIFO_SIZE)
+	em.mag = NewAK8963(MotionFunc(func(t time.Duration) (sample Sample) {
+		sample = motion.At(t)
+		sample.Field = [3]float32{sample.Field[1], sample.Field[0], -sample.Field[2]}
+		return
+	}))
+	return
+}
+
+func newMPU(motion Motion, id byte, size int) (em *MPU6050) {
+	em = new(MPU6050)
+	em.motion = motion
+	em.id = id
+	em.size = size
+	em.queue = make([]byte, 0, size)
+	em.reset()
+	start := time.Now()
+	em.clock = func() time.Duration { return time.Since(start) }
+	return
+}
+
+// Put the registers back as they come out of reset, the FIFO empty
+func (em *MPU6050) reset() {
+	em.registers = [0x80]byte{}
+	em.registers[sensors.MPU6050_WHO_AM_I] = em.id
+	em.registers[sensors.MPU6050_PWR_MGMT_1] = sensors.MPU6050_PWR_MGMT_1_SLEEP
+	em.queue = em.queue[:0]
+	em.overflow = false
+	em.on = false
+}
+
+// Drive the FIFO from clock rather than the wall clock
+func (em *MPU6050) SetClock(clock func() time.Duration) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	em.clock = clock
+	em.from = clock()
+}
+
+// Return the Sample behind the most recently latched output
+func (em *MPU6050) Truth() (sample Sample) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	sample = em.truth
+	return
+}
+
+// Return the MPU-9250's AK8963, nil on the MPU-6050
+func (em *MPU6050) Magnetometer() *AK8963 {
+	return em.mag
+}
+
+// Return the AK8963 as the host's bus sees it, there only while bypassed
+func (em *MPU6050) Bypass() i2c.FakeDevice {
+	return bypass{em}
+}
+
+// Return the sample rate in Hz, 0 asleep
+func (em *MPU6050) rate() float64 {
+	if em.registers[sensors.MPU6050_PWR_MGMT_1]&sensors.MPU6050_PWR_MGMT_1_SLEEP != 0 {
+		return 0
+	}
+	gyroRate := 1000.0
+	if dlpf := em.registers[sensors.MPU6050_CONFIG] & sensors.MPU6050_CONFIG_DLPF; dlpf == 0 || dlpf == 7 {
+		gyroRate = 8000
+	}
+	return gyroRate / float64(1+int(em.registers[sensors.MPU6050_SMPLRT_DIV]))
+}
+
+// Take the sample at em.now into the output registers
+func (em *MPU6050) sample() {
+	em.truth = em.motion.At(em.now)
+	out := em.registers[sensors.MPU6050_ACCEL_XOUT_H:]
+	accel := sensors.MPU6050AccelSensitivities[(em.registers[sensors.MPU6050_ACCEL_CONFIG]>>3)&0x03]
+	gyro := sensors.MPU6050GyroSensitivities[(em.registers[sensors.MPU6050_GYRO_CONFIG]>>3)&0x03]
+	for axis := 0; axis < 3; axis++ {
+		put16(out[2*axis:], saturate(em.truth.Accel[axis]*accel), true)
+		put16(out[8+2*axis:], saturate(em.truth.Rate[axis]*gyro), true)
+	}
+	temp := (em.truth.Temp - sensors.MPU6050_TEMP_OFFSET) * sensors.MPU6050_TEMP_LSB_PER_DEG
+	if em.id == sensors.MPU9250_ID {
+		temp = (em.truth.Temp - sensors.MPU9250_TEMP_OFFSET) * sensors.MPU9250_TEMP_LSB_PER_DEG
+	}
+	put16(out[6:], saturate(temp), true)
+	em.registers[sensors.MPU6050_INT_STATUS] |= sensors.MPU6050_INT_STATUS_DATA_RDY
+}
+
+// Latch the next sample into the output registers
+func (em *MPU6050) latch() {
+	rate := em.rate()
+	if rate == 0 {
+		// asleep, output registers hold their last value
+		return
+	}
+	if em.started {
+		em.now += period(rate)
+	}
+	em.started = true
+	em.sample()
+}
+
+// Start or stop filling the FIFO when USER_CTRL changes
+func (em *MPU6050) fifoChanged() {
+	userCtrl := em.registers[sensors.MPU6050_USER_CTRL]
+	on := userCtrl&sensors.MPU6050_USER_CTRL_FIFO_EN != 0
+	if userCtrl&sensors.MPU6050_USER_CTRL_FIFO_RESET != 0 {
+		em.queue = em.queue[:0]
+		em.overflow = false
+		em.registers[sensors.MPU6050_USER_CTRL] &^= sensors.MPU6050_USER_CTRL_FIFO_RESET
+		if on && em.on {
+			// still filling, the second half of a sample is written
+			em.push()
+			em.queue = em.queue[len(em.queue)/2:]
+		}
+	}
+	if on && !em.on {
+		em.from = em.clock()
+		em.at = em.now
+	}
+	em.on = on
+}
+
+// Put the bytes FIFO_EN selects from the output registers into the FIFO
+func (em *MPU6050) push() {
+	enabled := em.registers[sensors.MPU6050_FIFO_EN]
+	for _, field := range []struct {
+		bit   byte
+		reg   byte
+		bytes int
+	}{
+		{sensors.MPU6050_FIFO_EN_ACCEL, sensors.MPU6050_ACCEL_XOUT_H, 6},
+		{sensors.MPU6050_FIFO_EN_TEMP, sensors.MPU6050_TEMP_OUT_H, 2},
+		{sensors.MPU6050_FIFO_EN_XG, sensors.MPU6050_GYRO_XOUT_H, 2},
+		{sensors.MPU6050_FIFO_EN_YG, sensors.MPU6050_GYRO_XOUT_H + 2, 2},
+		{sensors.MPU6050_FIFO_EN_ZG, sensors.MPU6050_GYRO_XOUT_H + 4, 2},
+	} {
+		if enabled&field.bit == 0 {
+			continue
+		}
+		if lost := len(em.queue) + field.bytes - em.size; lost > 0 {
+			// full, the oldest bytes are lost
+			em.queue = append(em.queue[:0], em.queue[lost:]...)
+			em.overflow = true
+		}
+		em.queue = append(em.queue, em.registers[field.reg:int(field.reg)+field.bytes]...)
+	}
+}
+
+// Take the samples due since the FIFO was last filled
+func (em *MPU6050) fill() {
+	rate := em.rate()
+	if rate == 0 {
+		return
+	}
+	step := period(rate)
+	target := em.at + (em.clock() - em.from)
+	for em.now+step <= target {
+		em.now += step
+		em.started = true
+		em.sample()
+		em.push()
+	}
+}
+
+// Take the next byte out of the FIFO, 0 when it's empty
+func (em *MPU6050) pop() (value byte) {
+	if len(em.queue) > 0 {
+		value = em.queue[0]
+		em.queue = em.queue[1:]
+	}
+	return
+}
+
+func (em *MPU6050) ReadRegisters(reg byte, data []byte) (err error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	reg &= 0x7F
+	if em.on {
+		em.fill()
+	} else if reg == sensors.MPU6050_ACCEL_XOUT_H || reg == sensors.MPU6050_TEMP_OUT_H || reg == sensors.MPU6050_GYRO_XOUT_H {
+		em.latch()
+	}
+	count := len(em.queue)
+	for i := range data {
+		switch reg {
+		case sensors.MPU6050_FIFO_R_W:
+			data[i] = em.pop()
+			// FIFO_R_W doesn't increment
+			continue
+		case sensors.MPU6050_FIFO_COUNTH:
+			data[i] = byte(count >> 8)
+		case sensors.MPU6050_FIFO_COUNTL:
+			data[i] = byte(count)
+		case sensors.MPU6050_INT_STATUS:
+			data[i] = em.registers[reg]
+			if em.overflow {
+				data[i] |= sensors.MPU6050_INT_STATUS_FIFO_OFLOW
+			}
+			// reading it clears it
+			em.registers[reg] = 0
+			em.overflow = false
+		default:
+			data[i] = em.registers[reg]
+		}
+		reg = (reg + 1) & 0x7F
+	}
+	return
+}
+
+func (em *MPU6050) WriteRegisters(reg byte, data []byte) (err error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	reg &= 0x7F
+	for _, value := range data {
+		switch reg {
+		case sensors.MPU6050_WHO_AM_I, sensors.MPU6050_INT_STATUS, sensors.MPU6050_FIFO_COUNTH, sensors.MPU6050_FIFO_COUNTL:
+			// read only
+		case sensors.MPU6050_FIFO_R_W:
+			// the host's bytes aren't kept
+			continue
+		case sensors.MPU6050_PWR_MGMT_1:
+			if value&sensors.MPU6050_PWR_MGMT_1_RESET != 0 {
+				em.reset()
+			} else {
+				em.registers[reg] = value
+			}
+		case sensors.MPU6050_USER_CTRL:
+			em.registers[reg] = value
+			em.fifoChanged()
+		default:
+			if reg < sensors.MPU6050_ACCEL_XOUT_H || reg > sensors.MPU6050_GYRO_XOUT_H+5 {
+				em.registers[reg] = value
+			}
+		}
+		reg = (reg + 1) & 0x7F
+	}
+	return
+}
+
+// Whether the AK8963 is joined onto the host's bus
+func (em *MPU6050) bypassed() bool {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	return em.mag != nil &&
+		em.registers[sensors.MPU6050_INT_PIN_CFG]&sensors.MPU6050_INT_PIN_CFG_BYPASS_EN != 0 &&
+		em.registers[sensors.MPU6050_USER_CTRL]&sensors.MPU6050_USER_CTRL_I2C_MST_EN == 0
+}
+
+// The AK8963 through the MPU's bypass, with the bypass off nothing
+// acknowledges its address
+type bypass struct {
+	em *MPU6050
+}
+
+func (b bypass) nack(reg byte) error {
+	return &i2c.Error{Op: "FakeBus", Addr: sensors.AK8963_ADDR, Reg: reg, Kind: i2c.ErrNack,
+		Err: errors.New("the AK8963 is on the MPU's auxiliary bus, not bypassed")}
+}
+
+func (b bypass) ReadRegisters(reg byte, data []byte) (err error) {
+	if !b.em.bypassed() {
+		return b.nack(reg)
+	}
+	return b.em.mag.ReadRegisters(reg, data)
+}
+
+func (b bypass) WriteRegisters(reg byte, data []byte) (err error) {
+	if !b.em.bypassed() {
+		return b.nack(reg)
+	}
+	return b.em.mag.WriteRegisters(reg, data)
+}
@@ -0,0 +1,107 @@
+package emulator
+
+import (
+	"sort"
+	"time"
+)
+
+/**
+* The emulated chips don't measure anything, they sample a Motion
+* profile at their own output data rate and encode the result the
+* same way the real part would.  The profile is the known truth the
+* driver output can be compared against.
+**/
+
+// What the sensors would feel at an instant
+type Sample struct {
+	Rate  [3]float32 // angular rate in degrees per second
+	Accel [3]float32 // acceleration in g
+	Field [3]float32 // magnetic field in gauss
+	Temp  float32    // the chips' temperature in degrees C
+}
+
+// A Motion profile returns the Sample at a time since the start of the run
+type Motion interface {
+	At(t time.Duration) Sample
+}
+
+// Adapts an ordinary function to a generated Motion profile
+type MotionFunc func(t time.Duration) Sample
+
+// A Keyframe of a Script
+type Keyframe struct {
+	When time.Duration
+	Sample
+}
+
+// A scripted Motion profile, linearly interpolated between keyframes
+// and held constant before the first and after the last one
+type Script []Keyframe
+
+// A Motion profile that never changes
+type Still Sample
+
+func (f MotionFunc) At(t time.Duration) Sample {
+	return f(t)
+}
+
+func (s Still) At(t time.Duration) Sample {
+	return Sample(s)
+}
+
+// Return a Script with the keyframes sorted by time
+func NewScript(frames ...Keyframe) (s Script) {
+	s = append(s, frames...)
+	sort.Slice(s, func(i, j int) bool { return s[i].When < s[j].When })
+	return
+}
+
+func (s Script) At(t time.Duration) (sample Sample) {
+	if len(s) == 0 {
+		return
+	}
+	i := sort.Search(len(s), func(i int) bool { return s[i].When > t })
+	switch {
+	case i == 0:
+		sample = s[0].Sample
+	case i == len(s):
+		sample = s[len(s)-1].Sample
+	default:
+		a, b := s[i-1], s[i]
+		f := float32(t-a.When) / float32(b.When-a.When)
+		for n := 0; n < 3; n++ {
+			sample.Rate[n] = a.Rate[n] + (b.Rate[n]-a.Rate[n])*f
+			sample.Accel[n] = a.Accel[n] + (b.Accel[n]-a.Accel[n])*f
+			sample.Field[n] = a.Field[n] + (b.Field[n]-a.Field[n])*f
+		}
+		sample.Temp = a.Temp + (b.Temp-a.Temp)*f
+	}
+	return
+}
+
+// Convert to a signed 16 bit count, saturating like the chip's ADC
+func saturate(v float32) int16 {
+	switch {
+	case v >= 32767:
+		return 32767
+	case v <= -32768:
+		return -32768
+	case v < 0:
+		return int16(v - 0.5)
+	}
+	return int16(v + 0.5)
+}
+
+// Store v little endian (or big endian) into two bytes
+func put16(b []byte, v int16, bigEndian bool) {
+	if bigEndian {
+		b[0], b[1] = byte(uint16(v)>>8), byte(v)
+	} else {
+		b[0], b[1] = byte(v), byte(uint16(v)>>8)
+	}
+}
+
+// Return the output data rate period for a rate in Hz
+func period(hz float64) time.Duration {
+	return time.Duration(float64(time.Second) / hz)
+}
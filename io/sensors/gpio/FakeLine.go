@@ -0,0 +1,109 @@
+package gpio
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+/**
+* FakeLine is an in-memory EventSource, for testing without the hardware.
+* Edges are queued with Raise or Edge, up to FAKE_LINE_QUEUE of them, as
+* the kernel queues them, and Wait hands them back in order.  Fail makes
+* Wait fail at once, as reading a line that's gone bad does, and closing
+* it twice fails as closing a Line twice does.
+**/
+const FAKE_LINE_QUEUE = 16
+
+type FakeLine struct {
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+	lock   sync.Mutex
+	fail   error // what Wait fails with, nil to wait for an edge
+	waits  int
+}
+
+// Return a new FakeLine with no edges waiting
+func NewFakeLine() (line *FakeLine) {
+	line = new(FakeLine)
+	line.events = make(chan Event, FAKE_LINE_QUEUE)
+	line.done = make(chan struct{})
+	return
+}
+
+// Queue a rising edge stamped timestamp, dropping it if the queue's full,
+// false once the line is closed
+func (line *FakeLine) Raise(timestamp int64) bool {
+	return line.Edge(Event{Timestamp: timestamp, Rising: true})
+}
+
+// Queue an edge, dropping it if the queue's full, false once the line is closed
+func (line *FakeLine) Edge(event Event) bool {
+	select {
+	case <-line.done:
+		return false
+	default:
+	}
+	select {
+	case line.events <- event:
+	default:
+		// the kernel drops events too when nobody reads them
+	}
+	return true
+}
+
+// Make Wait fail with err, nil makes it wait for edges again
+func (line *FakeLine) Fail(err error) {
+	line.lock.Lock()
+	defer line.lock.Unlock()
+
+	line.fail = err
+}
+
+// Return how many times Wait has been called
+func (line *FakeLine) Waits() (waits int) {
+	line.lock.Lock()
+	defer line.lock.Unlock()
+
+	waits = line.waits
+	return
+}
+
+func (line *FakeLine) Wait(timeout time.Duration) (event Event, err error) {
+	line.lock.Lock()
+	line.waits++
+	fail := line.fail
+	line.lock.Unlock()
+	select {
+	case <-line.done:
+		err = ErrClosed
+		return
+	default:
+	}
+	if fail != nil {
+		err = fail
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-line.done:
+		err = ErrClosed
+	case event = <-line.events:
+	case <-timer.C:
+		err = ErrTimeout
+	}
+	return
+}
+
+func (line *FakeLine) Close() (err error) {
+	err = fmt.Errorf("gpio: fake line: %w", os.ErrClosed)
+	line.once.Do(func() {
+		close(line.done)
+		err = nil
+	})
+	return
+}
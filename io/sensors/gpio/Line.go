@@ -0,0 +1,125 @@
+package gpio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+/**
+* Edge events on a GPIO line through the Linux GPIO character device,
+* /dev/gpiochipN, rather than the deprecated sysfs interface.  The kernel
+* stamps each edge as its interrupt comes in, so an event says when the
+* chip raised its pin, not when the program got round to reading it.
+* Kernels from 5.7 on stamp events with CLOCK_MONOTONIC, earlier ones
+* with CLOCK_REALTIME, either way every event on a machine shares a clock.
+**/
+const (
+	// as defined in /usr/include/linux/gpio.h, the v1 ABI
+	GPIO_GET_LINEEVENT_IOCTL       = 0xC030B404 // _IOWR(0xB4, 0x04, struct gpioevent_request)
+	GPIOHANDLE_REQUEST_INPUT       = 0x01
+	GPIOEVENT_REQUEST_RISING_EDGE  = 0x01
+	GPIOEVENT_REQUEST_FALLING_EDGE = 0x02
+	GPIOEVENT_REQUEST_BOTH_EDGES   = 0x03
+	GPIOEVENT_EVENT_RISING_EDGE    = 0x01
+	GPIOEVENT_EVENT_FALLING_EDGE   = 0x02
+
+	GPIO_MAX_NAME_SIZE = 32
+	// sizeof(struct gpioevent_data), padded to its 64 bit timestamp
+	GPIOEVENT_DATA_SIZE = 16
+)
+
+// as defined in /usr/include/linux/gpio.h
+type gpioevent_request struct {
+	lineoffset     uint32
+	handleflags    uint32
+	eventflags     uint32
+	consumer_label [GPIO_MAX_NAME_SIZE]byte
+	fd             int32
+}
+
+var (
+	// Returned by Wait when no edge came in time
+	ErrTimeout = errors.New("gpio: timed out waiting for an edge")
+	// Returned by Wait once the source is closed
+	ErrClosed = errors.New("gpio: closed")
+)
+
+// An edge on a line
+type Event struct {
+	Timestamp int64 // nanoseconds, on the kernel's clock
+	Rising    bool
+}
+
+// Something that delivers a line's edges, a real line or a fake one
+type EventSource interface {
+	// Wait up to timeout for the next edge, ErrTimeout if none came
+	Wait(timeout time.Duration) (event Event, err error)
+	Close() error
+}
+
+// A Line is an EventSource through /dev/gpiochipN
+type Line struct {
+	file   *os.File
+	buffer [GPIOEVENT_DATA_SIZE]byte // every event is read here, so waiting doesn't allocate
+}
+
+// Request edge events, one of the GPIOEVENT_REQUEST flags, on line offset
+// of /dev/gpiochipChip, labelled consumer while it's held
+func OpenLine(chip, offset uint32, edges uint32, consumer string) (line *Line, err error) {
+	var file *os.File
+	if file, err = os.OpenFile(fmt.Sprintf("/dev/gpiochip%v", chip), os.O_RDWR, 0); err != nil {
+		return
+	}
+	// the event fd outlives the chip's
+	defer file.Close()
+
+	request := gpioevent_request{
+		lineoffset:  offset,
+		handleflags: GPIOHANDLE_REQUEST_INPUT,
+		eventflags:  edges,
+	}
+	copy(request.consumer_label[:GPIO_MAX_NAME_SIZE-1], consumer)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), GPIO_GET_LINEEVENT_IOCTL, uintptr(unsafe.Pointer(&request))); errno != 0 {
+		err = fmt.Errorf("gpio: requesting events on gpiochip%v line %v: %w", chip, offset, syscall.Errno(errno))
+		return
+	}
+	// non-blocking, so the runtime's poller can time reads out
+	if err = syscall.SetNonblock(int(request.fd), true); err != nil {
+		syscall.Close(int(request.fd))
+		return
+	}
+	line = new(Line)
+	line.file = os.NewFile(uintptr(request.fd), fmt.Sprintf("gpiochip%v:%v", chip, offset))
+	return
+}
+
+func (line *Line) Wait(timeout time.Duration) (event Event, err error) {
+	if err = line.file.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+	var n int
+	n, err = line.file.Read(line.buffer[:])
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		err = ErrTimeout
+	case errors.Is(err, os.ErrClosed):
+		err = ErrClosed
+	case err == nil && n != GPIOEVENT_DATA_SIZE:
+		err = fmt.Errorf("gpio: short event, %v bytes", n)
+	case err == nil:
+		// struct gpioevent_data, the timestamp then the id
+		event.Timestamp = int64(binary.LittleEndian.Uint64(line.buffer[0:8]))
+		event.Rising = binary.LittleEndian.Uint32(line.buffer[8:12]) == GPIOEVENT_EVENT_RISING_EDGE
+	}
+	return
+}
+
+// Release the line
+func (line *Line) Close() error {
+	return line.file.Close()
+}
@@ -0,0 +1,68 @@
+package i2c
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// The kinds of bus failure, test for them with errors.Is
+var (
+	ErrNack      = errors.New("i2c: no acknowledge")
+	ErrTimeout   = errors.New("i2c: timeout")
+	ErrBadLength = errors.New("i2c: bad length")
+)
+
+// Returned by a Transport asked to do something its bus can't
+var ErrNotSupported = errors.New("i2c: not supported by this bus")
+
+// An Error describes a failed transaction
+type Error struct {
+	Op   string // the I2CBus method that failed
+	Addr byte
+	Reg  byte
+	Kind error // ErrNack, ErrTimeout, ErrBadLength or nil if it's none of those
+	Err  error // the underlying error, usually a syscall.Errno
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("i2c: %s addr=0x%02X reg=0x%02X", e.Op, e.Addr, e.Reg)
+	if e.Kind != nil {
+		msg += ": " + e.Kind.Error()
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap err in an Error, working out which kind of failure it was
+func newError(op string, addr, reg byte, err error) *Error {
+	var (
+		errno syscall.Errno
+		kind  error
+	)
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ENXIO, syscall.EREMOTEIO:
+			// no device answered, or it stopped acknowledging
+			kind = ErrNack
+		case syscall.ETIMEDOUT:
+			kind = ErrTimeout
+		}
+	}
+	return &Error{Op: op, Addr: addr, Reg: reg, Kind: kind, Err: err}
+}
+
+// Return an Error for a transfer of the wrong size
+func lengthError(op string, addr, reg byte, format string, args ...interface{}) *Error {
+	return &Error{Op: op, Addr: addr, Reg: reg, Kind: ErrBadLength, Err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,250 @@
+package i2c
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A FakeDevice is a chip attached to a FakeBus.  It answers
+// register reads and writes the same way the real part would.
+type FakeDevice interface {
+	ReadRegisters(reg byte, data []byte) error
+	WriteRegisters(reg byte, data []byte) error
+}
+
+// RegisterFile is the simplest FakeDevice, 128 plain registers.
+// Like the ST parts, the high bit of the register address requests
+// auto-increment; the register file always increments, so it ignores
+// that bit, and wraps around at the end of the register space.
+type RegisterFile struct {
+	Registers [128]byte
+}
+
+// FakeBus is an in-memory Transport.  Devices are attached at
+// an address, and every transaction is routed to the device at
+// that address, or fails if nothing is attached there.  Devices
+// behind a FakeTCA9548A answer while their channel is enabled, and
+// NewTCA9548A switches the channels the way it does on an I2CBus.
+type FakeBus struct {
+	devices map[byte]FakeDevice
+	// each device's register pointer, as left by the last write
+	pointers map[FakeDevice]byte
+	// serialize transactions the way the I2CBus lock does
+	lock sync.Mutex
+	// what each FakeTCA9548A was last told to enable
+	muxSelected muxSelection
+}
+
+// Return a new, empty, register file
+func NewRegisterFile() (rf *RegisterFile) {
+	rf = new(RegisterFile)
+	return
+}
+
+func (rf *RegisterFile) ReadRegisters(reg byte, data []byte) (err error) {
+	for i := range data {
+		data[i] = rf.Registers[(int(reg&0x7F)+i)%len(rf.Registers)]
+	}
+	return
+}
+
+func (rf *RegisterFile) WriteRegisters(reg byte, data []byte) (err error) {
+	for i, value := range data {
+		rf.Registers[(int(reg&0x7F)+i)%len(rf.Registers)] = value
+	}
+	return
+}
+
+// Return a new FakeBus with nothing attached
+func NewFakeBus() (fb *FakeBus) {
+	fb = new(FakeBus)
+	fb.devices = make(map[byte]FakeDevice)
+	fb.pointers = make(map[FakeDevice]byte)
+	fb.muxSelected = make(muxSelection)
+	return
+}
+
+// Attach a device at the given address, replacing any device already there
+func (fb *FakeBus) Attach(addr byte, dev FakeDevice) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	fb.devices[addr] = dev
+}
+
+// Remove the device at the given address
+func (fb *FakeBus) Detach(addr byte) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	delete(fb.devices, addr)
+}
+
+// Return the device attached at the given address, or nil
+func (fb *FakeBus) Device(addr byte) (dev FakeDevice) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	dev = fb.devices[addr]
+	return
+}
+
+// Find the one device answering at addr, directly on the bus or
+// behind an enabled mux channel, called with the bus lock held
+func (fb *FakeBus) device(addr byte) (dev FakeDevice, err error) {
+	var found []FakeDevice
+	if dev = fb.devices[addr]; dev != nil {
+		found = append(found, dev)
+	}
+	for _, attached := range fb.devices {
+		if mux, ok := attached.(*FakeTCA9548A); ok {
+			found = append(found, mux.devicesAt(addr)...)
+		}
+	}
+	switch len(found) {
+	case 0:
+		dev, err = nil, &Error{Op: "FakeBus", Addr: addr, Kind: ErrNack, Err: fmt.Errorf("no device at address 0x%02X", addr)}
+	case 1:
+		dev = found[0]
+	default:
+		dev, err = nil, &Error{Op: "FakeBus", Addr: addr, Err: fmt.Errorf("%v devices answered at address 0x%02X", len(found), addr)}
+	}
+	return
+}
+
+// Run a transaction with the bus lock held, through the mux channel when
+// one is given, and forget what the mux enabled if it fails
+func (fb *FakeBus) run(channel *MuxChannel, op string, transaction func() error) (err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	if err = fb.muxSelected.route(channel, op, fb.writeMux); err == nil {
+		err = transaction()
+	}
+	fb.muxSelected.failed(channel, err)
+	return
+}
+
+// Write a FakeTCA9548A's control register, called with the bus lock held
+func (fb *FakeBus) writeMux(addr, control byte) (err error) {
+	mux, ok := fb.devices[addr].(*FakeTCA9548A)
+	if !ok {
+		err = &Error{Op: "SelectChannel", Addr: addr, Kind: ErrNack, Err: fmt.Errorf("no TCA9548A at address 0x%02X", addr)}
+		return
+	}
+	err = mux.WriteRegisters(control, nil)
+	return
+}
+
+func (fb *FakeBus) switchMux(addr, control byte) (err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	err = fb.muxSelected.write(addr, control, fb.writeMux)
+	return
+}
+
+func (fb *FakeBus) WriteByte(addr, reg, value byte) (err error) {
+	err = fb.writeByte(nil, addr, reg, value)
+	return
+}
+
+func (fb *FakeBus) ReadByteBlock(addr, reg byte, readLength byte) (data []byte, err error) {
+	data = make([]byte, readLength)
+	if err = fb.ReadBlockInto(addr, reg, data); err != nil {
+		data = nil
+	}
+	return
+}
+
+func (fb *FakeBus) ReadBlockInto(addr, reg byte, data []byte) (err error) {
+	err = fb.readBlock(nil, addr, reg, data)
+	return
+}
+
+func (fb *FakeBus) WriteByteBlock(addr, reg byte, list []byte) (err error) {
+	err = fb.writeByteBlock(nil, addr, reg, list)
+	return
+}
+
+// Run the messages as one combined transaction.  A write message sets
+// the device's register pointer from its first byte and writes the rest,
+// a read message reads from wherever the register pointer was left.
+func (fb *FakeBus) Transfer(msgs ...Msg) (err error) {
+	err = fb.transfer(nil, msgs)
+	return
+}
+
+// The transactions themselves, through a mux channel when one is given
+
+func (fb *FakeBus) writeByte(channel *MuxChannel, addr, reg, value byte) (err error) {
+	err = fb.run(channel, "WriteByte", func() (err error) {
+		var dev FakeDevice
+		if dev, err = fb.device(addr); err == nil {
+			err = dev.WriteRegisters(reg, []byte{value})
+		}
+		return
+	})
+	return
+}
+
+func (fb *FakeBus) readBlock(channel *MuxChannel, addr, reg byte, data []byte) (err error) {
+	// same limit the SMBus block read on a real bus has
+	if len(data) > I2C_SMBUS_BLOCK_MAX {
+		err = lengthError("ReadByteBlock", addr, reg, "read length %v exceeds I2C_SMBUS_BLOCK_MAX", len(data))
+		return
+	}
+
+	err = fb.run(channel, "ReadByteBlock", func() (err error) {
+		var dev FakeDevice
+		if dev, err = fb.device(addr); err == nil {
+			err = dev.ReadRegisters(reg, data)
+		}
+		return
+	})
+	return
+}
+
+func (fb *FakeBus) writeByteBlock(channel *MuxChannel, addr, reg byte, list []byte) (err error) {
+	if len(list) > I2C_SMBUS_BLOCK_MAX {
+		err = lengthError("WriteByteBlock", addr, reg, "write length %v exceeds I2C_SMBUS_BLOCK_MAX", len(list))
+		return
+	}
+
+	err = fb.run(channel, "WriteByteBlock", func() (err error) {
+		var dev FakeDevice
+		if dev, err = fb.device(addr); err == nil {
+			err = dev.WriteRegisters(reg, list)
+		}
+		return
+	})
+	return
+}
+
+func (fb *FakeBus) transfer(channel *MuxChannel, msgs []Msg) (err error) {
+	if err = checkMsgs(msgs); err != nil {
+		return
+	}
+
+	err = fb.run(channel, "Transfer", func() (err error) {
+		for _, msg := range msgs {
+			var dev FakeDevice
+			if dev, err = fb.device(msg.Addr); err != nil {
+				return
+			}
+			if msg.Flags&I2C_M_RD != 0 {
+				err = dev.ReadRegisters(fb.pointers[dev], msg.Buf)
+			} else if len(msg.Buf) > 0 {
+				fb.pointers[dev] = msg.Buf[0]
+				if len(msg.Buf) > 1 {
+					err = dev.WriteRegisters(msg.Buf[0], msg.Buf[1:])
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+	return
+}
@@ -0,0 +1,98 @@
+package i2c
+
+import (
+	"sync"
+)
+
+// FakeTCA9548A is a TCA9548A mux to attach to a FakeBus, with devices
+// attached behind its channels.  They answer on the FakeBus only while
+// their channel is enabled.
+type FakeTCA9548A struct {
+	lock     sync.Mutex
+	control  byte
+	switches int
+	channels [TCA9548A_CHANNELS]map[byte]FakeDevice
+}
+
+// Return a new FakeTCA9548A with every channel disabled and nothing attached
+func NewFakeTCA9548A() (mux *FakeTCA9548A) {
+	mux = new(FakeTCA9548A)
+	for channel := range mux.channels {
+		mux.channels[channel] = make(map[byte]FakeDevice)
+	}
+	return
+}
+
+// Attach a device at the given address behind a channel,
+// replacing any device already there
+func (mux *FakeTCA9548A) Attach(channel, addr byte, dev FakeDevice) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	mux.channels[channel][addr] = dev
+}
+
+// Return the control register, a bit set for each enabled channel
+func (mux *FakeTCA9548A) Control() (control byte) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	control = mux.control
+	return
+}
+
+// Return how many times the control register has been written
+func (mux *FakeTCA9548A) Switches() (switches int) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	switches = mux.switches
+	return
+}
+
+// Disable every channel, the way pulling RESET low does, without
+// whoever switched the channels knowing about it
+func (mux *FakeTCA9548A) Reset() {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	mux.control = 0
+}
+
+// Return the devices at addr behind the enabled channels
+func (mux *FakeTCA9548A) devicesAt(addr byte) (devs []FakeDevice) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	for channel, devices := range mux.channels {
+		if mux.control&(1<<uint(channel)) != 0 && devices[addr] != nil {
+			devs = append(devs, devices[addr])
+		}
+	}
+	return
+}
+
+// The chip has no register address, every byte read is the control register
+func (mux *FakeTCA9548A) ReadRegisters(reg byte, data []byte) (err error) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	for i := range data {
+		data[i] = mux.control
+	}
+	return
+}
+
+// Every byte written, reg included, goes to the control register,
+// so the last one is what's enabled
+func (mux *FakeTCA9548A) WriteRegisters(reg byte, data []byte) (err error) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	mux.control = reg
+	if len(data) > 0 {
+		mux.control = data[len(data)-1]
+	}
+	mux.switches++
+	return
+}
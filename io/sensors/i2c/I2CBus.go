@@ -29,7 +29,6 @@ type i2c_smbus_ioctl_data struct {
 
 var busMap map[byte]*I2CBus
 var busMapLock sync.Mutex
-var readBuffer []byte
 
 type I2CBus struct {
 	// i2c-dev file pointer
@@ -42,24 +41,46 @@ type I2CBus struct {
 	// simple bus access lock to ensure address
 	// set and data writes occur atomically
 	lock sync.Mutex
+	// the ioctl argument and the i2c_smbus_data block it
+	// points at, reused for every read under the lock
+	smbus  i2c_smbus_ioctl_data
+	buffer [I2C_SMBUS_BLOCK_MAX + 2]byte
+	// bus number, n in /dev/i2c-n
+	number byte
+	// how failed transactions are retried, and
+	// the per address counters of how that went
+	policy    RetryPolicy
+	stats     map[byte]*Stats
+	latencies map[LatencyKey]*Latency
+	statsLock sync.Mutex
+	// what each TCA9548A mux on the bus was last told to
+	// enable, so channels are only switched when they change
+	muxSelected muxSelection
 }
 
 func init() {
 	busMap = make(map[byte]*I2CBus)
-	readBuffer = make([]byte, 256)
 }
 
 // Returns an instance to an I2CBus.  If we already have an I2CBus
 // created for the requested bus number, just return that, otherwise
-// set up a new one and open up its associated i2c-dev file
+// set up a new one and open up its associated i2c-dev file, there's
+// no I2CBus if it can't be opened
 func Bus(bus byte) (i2cbus *I2CBus, err error) {
 	busMapLock.Lock()
 	defer busMapLock.Unlock()
 
 	if i2cbus = busMap[bus]; i2cbus == nil {
 		i2cbus = new(I2CBus)
-		if i2cbus.file, err = os.OpenFile(fmt.Sprintf("/dev/i2c-%v", bus), os.O_RDWR, os.ModeExclusive); err != nil {
+		i2cbus.number = bus
+		i2cbus.policy = DefaultRetryPolicy
+		i2cbus.stats = make(map[byte]*Stats)
+		i2cbus.latencies = make(map[LatencyKey]*Latency)
+		i2cbus.muxSelected = make(muxSelection)
+		if i2cbus.file, err = os.OpenFile(fmt.Sprintf("/dev/i2c-%v", bus), os.O_RDWR, os.ModeExclusive); err == nil {
 			busMap[bus] = i2cbus
+		} else {
+			i2cbus = nil
 		}
 	}
 
@@ -80,55 +101,104 @@ func (i2cbus *I2CBus) setAddress(addr byte) (err error) {
 }
 
 func (i2cbus *I2CBus) WriteByte(addr, reg, value byte) (err error) {
-	i2cbus.lock.Lock()
-	defer i2cbus.lock.Unlock()
+	err = i2cbus.writeByte(nil, addr, reg, value)
+	return
+}
 
-	if err = i2cbus.setAddress(addr); err != nil {
-		return
+func (i2cbus *I2CBus) ReadByteBlock(addr, reg byte, readLength byte) (data []byte, err error) {
+	data = make([]byte, readLength)
+	if err = i2cbus.readBlock(nil, addr, reg, data); err != nil {
+		data = nil
 	}
+	return
+}
+
+func (i2cbus *I2CBus) ReadBlockInto(addr, reg byte, data []byte) (err error) {
+	err = i2cbus.readBlock(nil, addr, reg, data)
+	return
+}
 
-	// If we're only writing a single byte, we can just write it directly
-	// to the i2c-dev file as a 2-tuple with the register
-	var n int
+func (i2cbus *I2CBus) WriteByteBlock(addr, reg byte, list []byte) (err error) {
+	err = i2cbus.writeByteBlock(nil, addr, reg, list)
+	return
+}
 
-	n, err = i2cbus.file.Write([]byte{reg, value})
+// The transactions themselves, through a mux channel when one is given
 
-	if n != 2 {
-		err = fmt.Errorf("i2c: Unexpected number (%v) of bytes written in I2CBus.WriteByte", n)
-	}
+func (i2cbus *I2CBus) writeByte(channel *MuxChannel, addr, reg, value byte) (err error) {
+	err = i2cbus.do("WriteByte", channel, addr, true, func() (err error) {
+		if err = i2cbus.setAddress(addr); err != nil {
+			return newError("WriteByte", addr, reg, err)
+		}
+
+		// If we're only writing a single byte, we can just write it directly
+		// to the i2c-dev file as a 2-tuple with the register
+		var n int
+
+		if n, err = i2cbus.file.Write([]byte{reg, value}); err != nil {
+			err = newError("WriteByte", addr, reg, err)
+		} else if n != 2 {
+			err = lengthError("WriteByte", addr, reg, "unexpected number (%v) of bytes written", n)
+		}
+
+		return
+	})
 
 	return
 }
 
-func (i2cbus *I2CBus) ReadByteBlock(addr, reg byte, readLength byte) (data []byte, err error) {
-	i2cbus.lock.Lock()
-	defer i2cbus.lock.Unlock()
+func (i2cbus *I2CBus) readBlock(channel *MuxChannel, addr, reg byte, data []byte) (err error) {
+	if len(data) > I2C_SMBUS_BLOCK_MAX {
+		err = lengthError("ReadByteBlock", addr, reg, "read length %v exceeds I2C_SMBUS_BLOCK_MAX", len(data))
+		return
+	}
+
+	err = i2cbus.do("ReadByteBlock", channel, addr, false, func() error {
+		return i2cbus.smbusRead(addr, reg, data)
+	})
+
+	return
+}
 
+// Read data from reg at addr, with the bus lock held
+func (i2cbus *I2CBus) smbusRead(addr, reg byte, data []byte) (err error) {
 	if err = i2cbus.setAddress(addr); err != nil {
-		return
+		return newError("ReadByteBlock", addr, reg, err)
 	}
 
-	readBuffer[0] = readLength
+	i2cbus.buffer[0] = byte(len(data))
+	i2cbus.smbus = i2c_smbus_ioctl_data{
+		readWrite: I2C_SMBUS_READ,
+		command:   reg,
+		size:      I2C_SMBUS_I2C_BLOCK_DATA,
+		data:      uintptr(unsafe.Pointer(&i2cbus.buffer[0]))}
 	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
-		i2cbus.file.Fd(), I2C_SMBUS, uintptr(unsafe.Pointer(&i2c_smbus_ioctl_data{
-			readWrite: I2C_SMBUS_READ,
-			command:   reg,
-			size:      I2C_SMBUS_I2C_BLOCK_DATA,
-			data:      uintptr(unsafe.Pointer(&readBuffer[0]))}))); errno != 0 {
-		err = syscall.Errno(errno)
+		i2cbus.file.Fd(), I2C_SMBUS, uintptr(unsafe.Pointer(&i2cbus.smbus))); errno != 0 {
+		return newError("ReadByteBlock", addr, reg, syscall.Errno(errno))
+	}
+	if int(i2cbus.buffer[0]) < len(data) {
+		return lengthError("ReadByteBlock", addr, reg, "read %v of %v bytes", i2cbus.buffer[0], len(data))
 	}
 
-	data = make([]byte, readLength)
-	copy(data, readBuffer[1:])
+	copy(data, i2cbus.buffer[1:])
 
 	return
 }
 
-func (i2cbus *I2CBus) WriteByteBlock(addr, reg byte, list []byte) (err error) {
+// Read a byte of register 0 at addr for Scan, without retrying it or
+// counting it in the stats, as every empty address fails
+func (i2cbus *I2CBus) probe(addr byte) (err error) {
+	var data [1]byte
 	i2cbus.lock.Lock()
 	defer i2cbus.lock.Unlock()
 
-	if err = i2cbus.setAddress(addr); err != nil {
+	err = i2cbus.smbusRead(addr, 0, data[:])
+	return
+}
+
+func (i2cbus *I2CBus) writeByteBlock(channel *MuxChannel, addr, reg byte, list []byte) (err error) {
+	if len(list) > I2C_SMBUS_BLOCK_MAX {
+		err = lengthError("WriteByteBlock", addr, reg, "write length %v exceeds I2C_SMBUS_BLOCK_MAX", len(list))
 		return
 	}
 
@@ -136,14 +206,22 @@ func (i2cbus *I2CBus) WriteByteBlock(addr, reg byte, list []byte) (err error) {
 	blockData[0] = byte(len(list))
 	copy(blockData[1:], list)
 
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
-		i2cbus.file.Fd(), I2C_SMBUS, uintptr(unsafe.Pointer(&i2c_smbus_ioctl_data{
-			readWrite: I2C_SMBUS_WRITE,
-			command:   reg,
-			size:      I2C_SMBUS_I2C_BLOCK_DATA,
-			data:      uintptr(unsafe.Pointer(&blockData[0]))}))); errno != 0 {
-		err = syscall.Errno(errno)
-	}
+	err = i2cbus.do("WriteByteBlock", channel, addr, true, func() (err error) {
+		if err = i2cbus.setAddress(addr); err != nil {
+			return newError("WriteByteBlock", addr, reg, err)
+		}
+
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
+			i2cbus.file.Fd(), I2C_SMBUS, uintptr(unsafe.Pointer(&i2c_smbus_ioctl_data{
+				readWrite: I2C_SMBUS_WRITE,
+				command:   reg,
+				size:      I2C_SMBUS_I2C_BLOCK_DATA,
+				data:      uintptr(unsafe.Pointer(&blockData[0]))}))); errno != 0 {
+			err = newError("WriteByteBlock", addr, reg, syscall.Errno(errno))
+		}
+
+		return
+	})
 
 	return
 }
@@ -0,0 +1,153 @@
+package i2c
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+)
+
+/**
+* Latency histograms, kept per device address and operation, so it's
+* possible to tell whether one device's transactions are starving
+* another's.  Bucket 0 counts anything under a microsecond, bucket n
+* counts [2^(n-1), 2^n) microseconds, and the last bucket everything
+* from there up.
+**/
+const (
+	LATENCY_BUCKETS = 24
+)
+
+type Histogram struct {
+	Buckets [LATENCY_BUCKETS]uint64
+	Count   uint64
+	Sum     time.Duration
+	Max     time.Duration
+}
+
+// Which histograms a transaction is counted in
+type LatencyKey struct {
+	Addr byte
+	Op   string // the I2CBus method, ReadByteBlock, Transfer, ...
+}
+
+// The latency of one kind of transaction
+type Latency struct {
+	Wait  Histogram // waiting for the bus lock, summed over any retries
+	Bus   Histogram // holding the bus lock, summed over any retries
+	Total Histogram // from the call to the return, backoff included
+}
+
+func init() {
+	// Export a summary of every open bus's latencies at /debug/vars
+	expvar.Publish("i2c_latency", expvar.Func(func() interface{} {
+		busMapLock.Lock()
+		defer busMapLock.Unlock()
+
+		all := make(map[string]map[string]map[string]string)
+		for number, i2cbus := range busMap {
+			latencies := make(map[string]map[string]string)
+			for key, l := range i2cbus.Latencies() {
+				latencies[fmt.Sprintf("0x%02X %s", key.Addr, key.Op)] = map[string]string{
+					"wait":  l.Wait.String(),
+					"bus":   l.Bus.String(),
+					"total": l.Total.String(),
+				}
+			}
+			all[fmt.Sprintf("i2c-%v", number)] = latencies
+		}
+		return all
+	}))
+}
+
+// Return the upper bound of a bucket, the last bucket has none
+func BucketBound(bucket int) time.Duration {
+	if bucket >= LATENCY_BUCKETS-1 {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Microsecond << uint(bucket)
+}
+
+// Count one duration
+func (h *Histogram) Add(d time.Duration) {
+	bucket := 0
+	for bucket < LATENCY_BUCKETS-1 && d >= BucketBound(bucket) {
+		bucket++
+	}
+	h.Buckets[bucket]++
+	h.Count++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+// Return the mean duration
+func (h *Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Return the upper bound of the bucket holding the p'th percentile,
+// p from 0 to 100, or the maximum if that's smaller
+func (h *Histogram) Percentile(p float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	want := uint64(p / 100 * float64(h.Count))
+	if want >= h.Count {
+		want = h.Count - 1
+	}
+	var seen uint64
+	for bucket, n := range h.Buckets {
+		if seen += n; seen > want {
+			if bound := BucketBound(bucket); bound < h.Max {
+				return bound
+			}
+			break
+		}
+	}
+	return h.Max
+}
+
+func (h *Histogram) String() string {
+	return fmt.Sprintf("n=%v mean=%v p50<%v p99<%v max=%v",
+		h.Count, h.Mean(), h.Percentile(50), h.Percentile(99), h.Max)
+}
+
+// Return a copy of the latencies for every address and operation used on this bus
+func (i2cbus *I2CBus) Latencies() (latencies map[LatencyKey]Latency) {
+	i2cbus.statsLock.Lock()
+	defer i2cbus.statsLock.Unlock()
+
+	latencies = make(map[LatencyKey]Latency, len(i2cbus.latencies))
+	for key, l := range i2cbus.latencies {
+		latencies[key] = *l
+	}
+	return
+}
+
+// Empty every latency histogram
+func (i2cbus *I2CBus) ResetLatencies() {
+	i2cbus.statsLock.Lock()
+	defer i2cbus.statsLock.Unlock()
+
+	i2cbus.latencies = make(map[LatencyKey]*Latency)
+}
+
+// Count one transaction's latencies
+func (i2cbus *I2CBus) addLatency(op string, addr byte, wait, bus, total time.Duration) {
+	i2cbus.statsLock.Lock()
+	defer i2cbus.statsLock.Unlock()
+
+	key := LatencyKey{Addr: addr, Op: op}
+	l := i2cbus.latencies[key]
+	if l == nil {
+		l = new(Latency)
+		i2cbus.latencies[key] = l
+	}
+	l.Wait.Add(wait)
+	l.Bus.Add(bus)
+	l.Total.Add(total)
+}
@@ -0,0 +1,164 @@
+package i2c
+
+import (
+	"fmt"
+)
+
+/**
+* The TCA9548A is an 8 channel i2c multiplexer.  Writing a byte to it
+* enables the downstream channels whose bits are set.  A MuxChannel
+* is a Transport for the devices behind one channel, it switches the
+* mux to its channel, when needed, and then runs the transaction, all
+* under the bus lock so nothing else gets in between.  A transaction
+* that fails switches the mux again next time, in case the mux was
+* reset or never saw the last switch.  Only one
+* channel of one mux is enabled at a time, so devices with the same
+* address can sit behind different channels.  Devices directly on the
+* bus must not share an address with anything behind a mux.
+**/
+const (
+	TCA9548A_ADDR     = 0x70 // A2-A0 low, up to 0x77
+	TCA9548A_CHANNELS = 8
+)
+
+// A bus TCA9548A muxes can sit on, an I2CBus, or a FakeBus for testing
+type MuxBus interface {
+	// write a mux's control register, with the bus to itself
+	switchMux(addr, control byte) error
+	// the transactions, through a mux channel when one is given
+	writeByte(channel *MuxChannel, addr, reg, value byte) error
+	readBlock(channel *MuxChannel, addr, reg byte, data []byte) error
+	writeByteBlock(channel *MuxChannel, addr, reg byte, list []byte) error
+	transfer(channel *MuxChannel, msgs []Msg) error
+}
+
+type Mux struct {
+	bus  MuxBus
+	addr byte
+}
+
+type MuxChannel struct {
+	mux     *Mux
+	channel byte
+}
+
+// What each TCA9548A mux on a bus was last told to enable,
+// so channels are only switched when they change
+type muxSelection map[byte]byte
+
+// Return the TCA9548A at addr on the bus, with every channel disabled
+func NewTCA9548A(bus MuxBus, addr byte) (mux *Mux, err error) {
+	mux = new(Mux)
+	mux.bus = bus
+	mux.addr = addr
+	err = bus.switchMux(addr, 0)
+	return
+}
+
+// Return a Transport for the devices behind one channel
+func (mux *Mux) Channel(channel byte) (mc *MuxChannel, err error) {
+	if channel >= TCA9548A_CHANNELS {
+		err = fmt.Errorf("i2c: TCA9548A has no channel %v", channel)
+		return
+	}
+	mc = new(MuxChannel)
+	mc.mux = mux
+	mc.channel = channel
+	return
+}
+
+// Enable only the channel's bit, writing control registers with
+// writeMux, called with the bus lock held.  Any other mux with a
+// channel enabled is switched off first.
+func (selected muxSelection) route(channel *MuxChannel, op string, writeMux func(addr, control byte) error) (err error) {
+	if channel == nil {
+		return
+	}
+	for addr, control := range selected {
+		if addr != channel.mux.addr && control != 0 {
+			if err = selected.write(addr, 0, writeMux); err != nil {
+				return newError(op, addr, 0, err)
+			}
+		}
+	}
+	want := byte(1) << channel.channel
+	if control, ok := selected[channel.mux.addr]; !ok || control != want {
+		if err = selected.write(channel.mux.addr, want, writeMux); err != nil {
+			return newError(op, channel.mux.addr, 0, err)
+		}
+	}
+	return
+}
+
+// Write a mux's control register with writeMux, remembering what it enabled
+func (selected muxSelection) write(addr, control byte, writeMux func(addr, control byte) error) (err error) {
+	// what's enabled is unknown until the write succeeds
+	delete(selected, addr)
+	if err = writeMux(addr, control); err == nil {
+		selected[addr] = control
+	}
+	return
+}
+
+// Forget what the channel's mux has enabled when a transaction through it
+// failed.  The mux may have been reset, or missed the last switch, so
+// the next transaction writes its control register again.
+func (selected muxSelection) failed(channel *MuxChannel, err error) {
+	if channel != nil && err != nil {
+		delete(selected, channel.mux.addr)
+	}
+}
+
+// Write a mux's control register with the bus lock held
+func (i2cbus *I2CBus) switchMux(addr, control byte) (err error) {
+	err = i2cbus.do("SelectChannel", nil, addr, true, func() error {
+		return i2cbus.muxSelected.write(addr, control, i2cbus.writeMux)
+	})
+	return
+}
+
+// Switch the muxes for the channel, called with the bus lock held
+func (i2cbus *I2CBus) route(channel *MuxChannel, op string) (err error) {
+	err = i2cbus.muxSelected.route(channel, op, i2cbus.writeMux)
+	return
+}
+
+// Write a mux's control register, called with the bus lock held
+func (i2cbus *I2CBus) writeMux(addr, control byte) (err error) {
+	if err = i2cbus.setAddress(addr); err != nil {
+		return
+	}
+	var n int
+	if n, err = i2cbus.file.Write([]byte{control}); err == nil && n != 1 {
+		err = lengthError("SelectChannel", addr, 0, "unexpected number (%v) of bytes written", n)
+	}
+	return
+}
+
+func (mc *MuxChannel) WriteByte(addr, reg, value byte) (err error) {
+	err = mc.mux.bus.writeByte(mc, addr, reg, value)
+	return
+}
+
+func (mc *MuxChannel) ReadByteBlock(addr, reg byte, readLength byte) (data []byte, err error) {
+	data = make([]byte, readLength)
+	if err = mc.mux.bus.readBlock(mc, addr, reg, data); err != nil {
+		data = nil
+	}
+	return
+}
+
+func (mc *MuxChannel) ReadBlockInto(addr, reg byte, data []byte) (err error) {
+	err = mc.mux.bus.readBlock(mc, addr, reg, data)
+	return
+}
+
+func (mc *MuxChannel) WriteByteBlock(addr, reg byte, list []byte) (err error) {
+	err = mc.mux.bus.writeByteBlock(mc, addr, reg, list)
+	return
+}
+
+func (mc *MuxChannel) Transfer(msgs ...Msg) (err error) {
+	err = mc.mux.bus.transfer(mc, msgs)
+	return
+}
@@ -0,0 +1,183 @@
+package i2c
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/**
+* The transaction log written by a Recorder and read back by a Replay.
+* A header ("I2CR", a version byte, and the start time as a little endian
+* int64 of nanoseconds) is followed by one record per register access:
+*
+*   varint  nanoseconds since the previous record (or the start)
+*   byte    bit 0 set for a write, bits 1-3 the status (see RECORD_*)
+*   byte    device address
+*   byte    register
+*   uvarint data length
+*   bytes   data written, or data read
+**/
+const (
+	RECORD_OK         = 0
+	RECORD_NACK       = 1
+	RECORD_TIMEOUT    = 2
+	RECORD_BAD_LENGTH = 3
+	RECORD_FAILED     = 4
+
+	recordMagic   = "I2CR"
+	recordVersion = 1
+)
+
+// One register access
+type Record struct {
+	When   int64 // nanoseconds, as time.Now().UnixNano() when the access finished
+	Addr   byte
+	Reg    byte
+	Write  bool
+	Status byte // RECORD_OK, or which kind of failure
+	Data   []byte
+}
+
+// Writes Records to a transaction log
+type RecordWriter struct {
+	w    *bufio.Writer
+	last int64
+	buf  [binary.MaxVarintLen64]byte
+}
+
+// Reads Records back from a transaction log
+type RecordReader struct {
+	r     *bufio.Reader
+	Start int64 // when the log was started
+	last  int64
+}
+
+// Return the status to record for a transaction's error
+func recordStatus(err error) byte {
+	switch {
+	case err == nil:
+		return RECORD_OK
+	case errors.Is(err, ErrNack):
+		return RECORD_NACK
+	case errors.Is(err, ErrTimeout):
+		return RECORD_TIMEOUT
+	case errors.Is(err, ErrBadLength):
+		return RECORD_BAD_LENGTH
+	}
+	return RECORD_FAILED
+}
+
+// Return the error a recorded status stands for
+func (rec *Record) Err() (err error) {
+	var kind error
+	switch rec.Status {
+	case RECORD_OK:
+		return
+	case RECORD_NACK:
+		kind = ErrNack
+	case RECORD_TIMEOUT:
+		kind = ErrTimeout
+	case RECORD_BAD_LENGTH:
+		kind = ErrBadLength
+	}
+	err = &Error{Op: "Replay", Addr: rec.Addr, Reg: rec.Reg, Kind: kind, Err: errors.New("recorded failure")}
+	return
+}
+
+// Start a transaction log at the given time
+func NewRecordWriter(w io.Writer, start int64) (rw *RecordWriter, err error) {
+	rw = new(RecordWriter)
+	rw.w = bufio.NewWriter(w)
+	rw.last = start
+
+	var header [len(recordMagic) + 1 + 8]byte
+	copy(header[:], recordMagic)
+	header[len(recordMagic)] = recordVersion
+	binary.LittleEndian.PutUint64(header[len(recordMagic)+1:], uint64(start))
+	_, err = rw.w.Write(header[:])
+	return
+}
+
+// Append a Record to the log
+func (rw *RecordWriter) Write(rec *Record) (err error) {
+	var flags byte
+	if rec.Write {
+		flags = 0x01
+	}
+	flags |= (rec.Status & 0x07) << 1
+
+	n := binary.PutVarint(rw.buf[:], rec.When-rw.last)
+	rw.w.Write(rw.buf[:n])
+	rw.w.Write([]byte{flags, rec.Addr, rec.Reg})
+	n = binary.PutUvarint(rw.buf[:], uint64(len(rec.Data)))
+	rw.w.Write(rw.buf[:n])
+	_, err = rw.w.Write(rec.Data)
+	rw.last = rec.When
+	return
+}
+
+// Write any buffered Records out
+func (rw *RecordWriter) Flush() error {
+	return rw.w.Flush()
+}
+
+// Open a transaction log, reading its header
+func NewRecordReader(r io.Reader) (rr *RecordReader, err error) {
+	rr = new(RecordReader)
+	rr.r = bufio.NewReader(r)
+
+	var header [len(recordMagic) + 1 + 8]byte
+	if _, err = io.ReadFull(rr.r, header[:]); err != nil {
+		return
+	}
+	if string(header[:len(recordMagic)]) != recordMagic {
+		err = errors.New("i2c: not a transaction log")
+		return
+	}
+	if header[len(recordMagic)] != recordVersion {
+		err = fmt.Errorf("i2c: unsupported transaction log version %v", header[len(recordMagic)])
+		return
+	}
+	rr.Start = int64(binary.LittleEndian.Uint64(header[len(recordMagic)+1:]))
+	rr.last = rr.Start
+	return
+}
+
+// Return the next Record, or io.EOF at the end of the log
+func (rr *RecordReader) Next() (rec Record, err error) {
+	var (
+		delta  int64
+		length uint64
+		fields [3]byte
+	)
+	if delta, err = binary.ReadVarint(rr.r); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(rr.r, fields[:]); err != nil {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	if length, err = binary.ReadUvarint(rr.r); err != nil {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	if length > I2C_M_MAXLEN {
+		err = fmt.Errorf("i2c: corrupt transaction log, record length %v", length)
+		return
+	}
+	rec.Data = make([]byte, length)
+	if _, err = io.ReadFull(rr.r, rec.Data); err != nil {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	rr.last += delta
+	rec.When = rr.last
+	rec.Write = fields[0]&0x01 != 0
+	rec.Status = (fields[0] >> 1) & 0x07
+	rec.Addr = fields[1]
+	rec.Reg = fields[2]
+	return
+}
@@ -0,0 +1,154 @@
+package i2c
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// A Clock supplies the time the sensor loop should stamp its data with.
+// Recorder and Replay are Clocks so that a replay sees the exact
+// times the recorded flight saw.
+type Clock interface {
+	Now() int64
+}
+
+// Recorder is a Transport that passes everything through to another
+// Transport, logging every register access along the way.
+type Recorder struct {
+	bus       Transport
+	log       *RecordWriter
+	lock      sync.Mutex
+	now       int64 // when the last transaction finished
+	lastFlush int64
+	pointers  map[byte]byte // register pointers, as left by Transfer writes
+	err       error         // the first error writing the log
+}
+
+// Return a Recorder logging the transactions on bus to w
+func NewRecorder(bus Transport, w io.Writer) (rec *Recorder, err error) {
+	rec = new(Recorder)
+	rec.bus = bus
+	rec.now = time.Now().UnixNano()
+	rec.lastFlush = rec.now
+	rec.pointers = make(map[byte]byte)
+	rec.log, err = NewRecordWriter(w, rec.now)
+	return
+}
+
+// Return when the last transaction finished, or when recording started
+func (rec *Recorder) Now() int64 {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	return rec.now
+}
+
+// Return the first error writing the log, if any
+func (rec *Recorder) Err() error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	return rec.err
+}
+
+// Write any buffered records out to the log
+func (rec *Recorder) Flush() (err error) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	if err = rec.log.Flush(); err != nil && rec.err == nil {
+		rec.err = err
+	}
+	return
+}
+
+// Log one register access, called with the lock held.  Logging
+// problems are kept for Err rather than failing the transaction,
+// the flight matters more than the log.
+func (rec *Recorder) record(addr, reg byte, write bool, data []byte, err error) {
+	rec.now = time.Now().UnixNano()
+	r := Record{When: rec.now, Addr: addr, Reg: reg, Write: write, Status: recordStatus(err), Data: data}
+	if werr := rec.log.Write(&r); werr != nil && rec.err == nil {
+		rec.err = werr
+	}
+	// don't lose more than a second of log if the power goes
+	if rec.now-rec.lastFlush >= int64(time.Second) {
+		if werr := rec.log.Flush(); werr != nil && rec.err == nil {
+			rec.err = werr
+		}
+		rec.lastFlush = rec.now
+	}
+}
+
+func (rec *Recorder) WriteByte(addr, reg, value byte) (err error) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	err = rec.bus.WriteByte(addr, reg, value)
+	rec.record(addr, reg, true, []byte{value}, err)
+	return
+}
+
+func (rec *Recorder) ReadByteBlock(addr, reg byte, readLength byte) (data []byte, err error) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	data, err = rec.bus.ReadByteBlock(addr, reg, readLength)
+	if err != nil {
+		rec.record(addr, reg, false, nil, err)
+	} else {
+		rec.record(addr, reg, false, data, err)
+	}
+	return
+}
+
+func (rec *Recorder) ReadBlockInto(addr, reg byte, data []byte) (err error) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	if err = ReadBlockInto(rec.bus, addr, reg, data); err != nil {
+		rec.record(addr, reg, false, nil, err)
+	} else {
+		rec.record(addr, reg, false, data, err)
+	}
+	return
+}
+
+func (rec *Recorder) WriteByteBlock(addr, reg byte, list []byte) (err error) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	err = rec.bus.WriteByteBlock(addr, reg, list)
+	rec.record(addr, reg, true, list, err)
+	return
+}
+
+// Pass a combined transaction through, when the underlying bus can do them.
+// Each message is logged as its own record, a write message as a write
+// of the rest of its bytes to the register in its first byte, and a read
+// message as a read of the register the previous write pointed at.
+func (rec *Recorder) Transfer(msgs ...Msg) (err error) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	t, ok := rec.bus.(Transferer)
+	if !ok {
+		err = ErrNotSupported
+		return
+	}
+	err = t.Transfer(msgs...)
+	for _, msg := range msgs {
+		if msg.Flags&I2C_M_RD != 0 {
+			data := msg.Buf
+			if err != nil {
+				data = nil
+			}
+			rec.record(msg.Addr, rec.pointers[msg.Addr], false, data, err)
+		} else if len(msg.Buf) > 0 {
+			rec.pointers[msg.Addr] = msg.Buf[0]
+			rec.record(msg.Addr, msg.Buf[0], true, msg.Buf[1:], err)
+		}
+	}
+	return
+}
@@ -0,0 +1,164 @@
+package i2c
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	// Returned once every recorded transaction has been replayed
+	ErrReplayEnded = errors.New("i2c: end of replay")
+	// Returned once a replay's driver asks for something other than
+	// what was recorded, after that the replay no longer means anything
+	ErrReplayDiverged = errors.New("i2c: replay diverged from the recording")
+)
+
+// Replay is a Transport that answers from a transaction log written
+// by a Recorder.  Each access has to match the next record, reads get
+// back the recorded bytes and failures are replayed as failures.
+type Replay struct {
+	log  *RecordReader
+	lock sync.Mutex
+	now  int64 // when the last replayed transaction finished
+	err  error // sticky once the replay has ended or diverged
+	// register pointers, as left by Transfer writes
+	pointers map[byte]byte
+}
+
+// Return a Replay of the transaction log read from r
+func NewReplay(r io.Reader) (rp *Replay, err error) {
+	rp = new(Replay)
+	rp.pointers = make(map[byte]byte)
+	if rp.log, err = NewRecordReader(r); err == nil {
+		rp.now = rp.log.Start
+	}
+	return
+}
+
+// Return when the last replayed transaction finished in the recording,
+// or when recording started
+func (rp *Replay) Now() int64 {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	return rp.now
+}
+
+// Consume the next record, which has to be the same access
+func (rp *Replay) next(addr, reg byte, write bool) (rec Record, err error) {
+	if rp.err != nil {
+		err = rp.err
+		return
+	}
+	if rec, err = rp.log.Next(); err != nil {
+		if err == io.EOF {
+			err = ErrReplayEnded
+		}
+		rp.err = err
+		return
+	}
+	if rec.Addr != addr || rec.Reg != reg || rec.Write != write {
+		rp.err = fmt.Errorf("%w: got addr=0x%02X reg=0x%02X write=%v, recorded addr=0x%02X reg=0x%02X write=%v",
+			ErrReplayDiverged, addr, reg, write, rec.Addr, rec.Reg, rec.Write)
+		err = rp.err
+		return
+	}
+	rp.now = rec.When
+	return
+}
+
+// Consume the next record, which has to be a write of the same bytes
+func (rp *Replay) write(addr, reg byte, data []byte) (err error) {
+	var rec Record
+	if rec, err = rp.next(addr, reg, true); err != nil {
+		return
+	}
+	if !bytes.Equal(rec.Data, data) {
+		rp.err = fmt.Errorf("%w: wrote % X to addr=0x%02X reg=0x%02X, recorded % X",
+			ErrReplayDiverged, data, addr, reg, rec.Data)
+		return rp.err
+	}
+	return rec.Err()
+}
+
+// Consume the next record, which has to be a read of the same length
+func (rp *Replay) read(addr, reg byte, data []byte) (err error) {
+	var rec Record
+	if rec, err = rp.next(addr, reg, false); err != nil {
+		return
+	}
+	if err = rec.Err(); err != nil {
+		return
+	}
+	if len(rec.Data) != len(data) {
+		rp.err = fmt.Errorf("%w: read %v bytes from addr=0x%02X reg=0x%02X, recorded %v",
+			ErrReplayDiverged, len(data), addr, reg, len(rec.Data))
+		return rp.err
+	}
+	copy(data, rec.Data)
+	return
+}
+
+func (rp *Replay) WriteByte(addr, reg, value byte) (err error) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	err = rp.write(addr, reg, []byte{value})
+	return
+}
+
+func (rp *Replay) ReadByteBlock(addr, reg byte, readLength byte) (data []byte, err error) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	data = make([]byte, readLength)
+	if err = rp.read(addr, reg, data); err != nil {
+		data = nil
+	}
+	return
+}
+
+func (rp *Replay) ReadBlockInto(addr, reg byte, data []byte) (err error) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	err = rp.read(addr, reg, data)
+	return
+}
+
+func (rp *Replay) WriteByteBlock(addr, reg byte, list []byte) (err error) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	err = rp.write(addr, reg, list)
+	return
+}
+
+// Replay a combined transaction, one record per message, the
+// same way the Recorder logged it
+func (rp *Replay) Transfer(msgs ...Msg) (err error) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	for _, msg := range msgs {
+		var merr error
+		if msg.Flags&I2C_M_RD != 0 {
+			merr = rp.read(msg.Addr, rp.pointers[msg.Addr], msg.Buf)
+		} else if len(msg.Buf) > 0 {
+			rp.pointers[msg.Addr] = msg.Buf[0]
+			merr = rp.write(msg.Addr, msg.Buf[0], msg.Buf[1:])
+		}
+		// a failed transfer recorded every message as failed,
+		// keep consuming them so the replay stays in step
+		if merr != nil && err == nil {
+			err = merr
+		}
+		if rp.err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,166 @@
+package i2c
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"time"
+)
+
+// How an I2CBus retries a failed transaction.  The wait between
+// attempts starts at Backoff and doubles each time, up to MaxBackoff.
+// Only transactions that write are retried, a failed read may still
+// have drained a FIFO or released latched outputs, so it's returned
+// for the driver to decide what to do.
+type RetryPolicy struct {
+	Attempts   int // tries per transaction, including the first
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Transaction counters for one device address
+type Stats struct {
+	Attempts   uint64 // transfers put on the bus, including retries
+	Retries    uint64 // attempts after the first one
+	Failures   uint64 // transactions that still failed after retrying
+	Nacks      uint64 // failed attempts, by kind
+	Timeouts   uint64
+	BadLengths uint64
+}
+
+// The policy every new I2CBus starts with, a couple of quick retries
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   3,
+	Backoff:    100 * time.Microsecond,
+	MaxBackoff: time.Millisecond,
+}
+
+func init() {
+	// Export the counters of every open bus with the other telemetry at /debug/vars
+	expvar.Publish("i2c", expvar.Func(func() interface{} {
+		busMapLock.Lock()
+		defer busMapLock.Unlock()
+
+		all := make(map[string]map[string]Stats)
+		for number, i2cbus := range busMap {
+			stats := make(map[string]Stats)
+			for addr, s := range i2cbus.Stats() {
+				stats[fmt.Sprintf("0x%02X", addr)] = s
+			}
+			all[fmt.Sprintf("i2c-%v", number)] = stats
+		}
+		return all
+	}))
+}
+
+// Set how failed transactions are retried on this bus
+func (i2cbus *I2CBus) SetRetryPolicy(policy RetryPolicy) {
+	i2cbus.statsLock.Lock()
+	defer i2cbus.statsLock.Unlock()
+
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
+	}
+	i2cbus.policy = policy
+}
+
+// Return how failed transactions are retried on this bus
+func (i2cbus *I2CBus) RetryPolicy() (policy RetryPolicy) {
+	i2cbus.statsLock.Lock()
+	defer i2cbus.statsLock.Unlock()
+
+	policy = i2cbus.policy
+	return
+}
+
+// Return a copy of the counters for every address used on this bus
+func (i2cbus *I2CBus) Stats() (stats map[byte]Stats) {
+	i2cbus.statsLock.Lock()
+	defer i2cbus.statsLock.Unlock()
+
+	stats = make(map[byte]Stats, len(i2cbus.stats))
+	for addr, s := range i2cbus.stats {
+		stats[addr] = *s
+	}
+	return
+}
+
+// Zero the counters for every address
+func (i2cbus *I2CBus) ResetStats() {
+	i2cbus.statsLock.Lock()
+	defer i2cbus.statsLock.Unlock()
+
+	i2cbus.stats = make(map[byte]*Stats)
+}
+
+// Count an attempt, and what went wrong with it, and the transaction as
+// failed when it's the last attempt and it failed too
+func (i2cbus *I2CBus) count(addr byte, retry, last bool, err error) {
+	i2cbus.statsLock.Lock()
+	defer i2cbus.statsLock.Unlock()
+
+	s := i2cbus.stats[addr]
+	if s == nil {
+		s = new(Stats)
+		i2cbus.stats[addr] = s
+	}
+	s.Attempts++
+	if retry {
+		s.Retries++
+	}
+	if last && err != nil {
+		s.Failures++
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrNack):
+		s.Nacks++
+	case errors.Is(err, ErrTimeout):
+		s.Timeouts++
+	case errors.Is(err, ErrBadLength):
+		s.BadLengths++
+	}
+}
+
+// Run attempt while holding the bus lock, through the mux channel
+// when one is given, retrying it according to the bus's policy when
+// retry is set.  The lock is dropped while backing off so
+// other devices on the bus aren't held up by a misbehaving one.
+// How long the transaction waited for and held the lock is counted
+// in the latency histograms for op and addr.
+func (i2cbus *I2CBus) do(op string, channel *MuxChannel, addr byte, retry bool, attempt func() error) (err error) {
+	var wait, bus time.Duration
+
+	start := time.Now()
+	policy := i2cbus.RetryPolicy()
+	if !retry {
+		policy.Attempts = 1
+	}
+	backoff := policy.Backoff
+	for try := 0; ; try++ {
+		before := time.Now()
+		i2cbus.lock.Lock()
+		locked := time.Now()
+		if err = i2cbus.route(channel, op); err == nil {
+			err = attempt()
+		}
+		i2cbus.muxSelected.failed(channel, err)
+		i2cbus.lock.Unlock()
+		wait += locked.Sub(before)
+		bus += time.Since(locked)
+
+		last := err == nil || try+1 >= policy.Attempts
+		i2cbus.count(addr, try > 0, last, err)
+		if last {
+			break
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+	i2cbus.addLatency(op, addr, wait, bus, time.Since(start))
+
+	return
+}
@@ -0,0 +1,28 @@
+package i2c
+
+const (
+	// the range of ordinary 7 bit addresses, the rest are reserved
+	SCAN_FIRST_ADDR = 0x03
+	SCAN_LAST_ADDR  = 0x77
+)
+
+// Return the addresses on the bus that acknowledge a write of register
+// 0 followed by a one byte read.  Unlike i2cdetect -r, which only reads
+// a byte, this moves the register pointer, harmless on the chips here.
+// On an I2CBus the probes aren't retried or counted in its Stats, where
+// every empty address would be a NACK.
+func Scan(bus Transport) (addrs []byte) {
+	probe := func(addr byte) (err error) {
+		_, err = bus.ReadByteBlock(addr, 0, 1)
+		return
+	}
+	if i2cbus, ok := bus.(*I2CBus); ok {
+		probe = i2cbus.probe
+	}
+	for addr := SCAN_FIRST_ADDR; addr <= SCAN_LAST_ADDR; addr++ {
+		if probe(byte(addr)) == nil {
+			addrs = append(addrs, byte(addr))
+		}
+	}
+	return
+}
@@ -0,0 +1,327 @@
+package i2c
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/**
+* A Scheduler sits in front of a Transport and runs the transactions of
+* its Clients one at a time, highest priority first and in the order
+* they were queued within a priority.  A transaction already on the bus
+* is never interrupted, a high priority transaction preempts lower
+* priority ones by being taken off the queue ahead of them.  Each Client
+* can set a deadline, the time from queueing a transaction to it
+* finishing, and every transaction that finishes late is counted as a
+* missed deadline.
+**/
+const (
+	PRIORITY_LOW    = 0
+	PRIORITY_NORMAL = 1
+	PRIORITY_HIGH   = 2
+	PRIORITIES      = 3
+)
+
+// Returned for transactions queued on, or still queued when closing, a closed Scheduler
+var ErrSchedulerClosed = errors.New("i2c: scheduler closed")
+
+// Transaction counters for one priority
+type ScheduleStats struct {
+	Transactions uint64
+	Missed       uint64        // finished after their deadline
+	MaxWait      time.Duration // longest time queued before running
+	MaxLate      time.Duration // furthest past a deadline
+}
+
+type Scheduler struct {
+	bus    Transport
+	id     int
+	lock   sync.Mutex
+	ready  *sync.Cond
+	queues [PRIORITIES][]*job
+	stats  [PRIORITIES]ScheduleStats
+	closed bool
+}
+
+// A Client is a Transport whose transactions go through a Scheduler
+// at one priority
+type Client struct {
+	sched    *Scheduler
+	priority int
+	deadline time.Duration // none if 0
+}
+
+// What a queued transaction does
+const (
+	jobWriteByte = iota
+	jobReadByteBlock
+	jobReadBlockInto
+	jobWriteByteBlock
+	jobTransfer
+)
+
+// One queued transaction.  Jobs are pooled and the transaction is
+// described by fields rather than a closure, so a transaction through
+// a Scheduler doesn't allocate.
+type job struct {
+	priority         int
+	queued           time.Time
+	deadline         time.Time
+	op               int
+	addr, reg, value byte
+	length           byte   // for ReadByteBlock
+	buf              []byte // the block to write, or the buffer to read into
+	msgs             []Msg
+	data             []byte // what ReadByteBlock read
+	done             chan error
+}
+
+var (
+	schedulers     map[int]*Scheduler
+	schedulersLock sync.Mutex
+	schedulerCount int
+	jobPool        = sync.Pool{New: func() interface{} {
+		return &job{done: make(chan error, 1)}
+	}}
+)
+
+func init() {
+	schedulers = make(map[int]*Scheduler)
+
+	// Export the counters of every open scheduler at /debug/vars
+	expvar.Publish("i2c_scheduler", expvar.Func(func() interface{} {
+		schedulersLock.Lock()
+		defer schedulersLock.Unlock()
+
+		names := [PRIORITIES]string{"low", "normal", "high"}
+		all := make(map[string]map[string]ScheduleStats)
+		for id, sched := range schedulers {
+			stats := make(map[string]ScheduleStats)
+			for priority, s := range sched.Stats() {
+				stats[names[priority]] = s
+			}
+			all[fmt.Sprintf("scheduler-%v", id)] = stats
+		}
+		return all
+	}))
+}
+
+// Return a Scheduler for the transactions on bus, running until closed
+func NewScheduler(bus Transport) (sched *Scheduler) {
+	sched = new(Scheduler)
+	sched.bus = bus
+	sched.ready = sync.NewCond(&sched.lock)
+
+	schedulersLock.Lock()
+	schedulerCount++
+	sched.id = schedulerCount
+	schedulers[sched.id] = sched
+	schedulersLock.Unlock()
+
+	go sched.run()
+	return
+}
+
+// Return a Client queueing transactions at priority, each expected to
+// finish within deadline of being queued, or with no deadline if it's 0
+func (sched *Scheduler) Client(priority int, deadline time.Duration) (client *Client) {
+	if priority < PRIORITY_LOW {
+		priority = PRIORITY_LOW
+	} else if priority >= PRIORITIES {
+		priority = PRIORITIES - 1
+	}
+	client = new(Client)
+	client.sched = sched
+	client.priority = priority
+	client.deadline = deadline
+	return
+}
+
+// Return a copy of the counters for each priority
+func (sched *Scheduler) Stats() (stats [PRIORITIES]ScheduleStats) {
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+
+	stats = sched.stats
+	return
+}
+
+// Zero the counters for every priority
+func (sched *Scheduler) ResetStats() {
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+
+	sched.stats = [PRIORITIES]ScheduleStats{}
+}
+
+// Stop running transactions, anything still queued fails with ErrSchedulerClosed
+func (sched *Scheduler) Close() {
+	sched.lock.Lock()
+	sched.closed = true
+	for priority, queue := range sched.queues {
+		for _, j := range queue {
+			j.done <- ErrSchedulerClosed
+		}
+		sched.queues[priority] = nil
+	}
+	sched.lock.Unlock()
+	sched.ready.Broadcast()
+
+	schedulersLock.Lock()
+	delete(schedulers, sched.id)
+	schedulersLock.Unlock()
+}
+
+// Take the next transaction off the queues, called with the lock held
+func (sched *Scheduler) next() (j *job) {
+	for priority := PRIORITIES - 1; priority >= PRIORITY_LOW; priority-- {
+		if queue := sched.queues[priority]; len(queue) > 0 {
+			// shuffle down rather than reslice, so the queue's
+			// array gets reused rather than reallocated
+			j = queue[0]
+			copy(queue, queue[1:])
+			queue[len(queue)-1] = nil
+			sched.queues[priority] = queue[:len(queue)-1]
+			return
+		}
+	}
+	return
+}
+
+// Run the queued transactions until closed
+func (sched *Scheduler) run() {
+	for {
+		sched.lock.Lock()
+		j := sched.next()
+		for j == nil && !sched.closed {
+			sched.ready.Wait()
+			j = sched.next()
+		}
+		sched.lock.Unlock()
+		if j == nil {
+			return
+		}
+
+		started := time.Now()
+		err := j.run(sched.bus)
+		finished := time.Now()
+
+		sched.lock.Lock()
+		s := &sched.stats[j.priority]
+		s.Transactions++
+		if wait := started.Sub(j.queued); wait > s.MaxWait {
+			s.MaxWait = wait
+		}
+		if !j.deadline.IsZero() && finished.After(j.deadline) {
+			s.Missed++
+			if late := finished.Sub(j.deadline); late > s.MaxLate {
+				s.MaxLate = late
+			}
+		}
+		sched.lock.Unlock()
+
+		j.done <- err
+	}
+}
+
+// Run the transaction on bus
+func (j *job) run(bus Transport) (err error) {
+	switch j.op {
+	case jobWriteByte:
+		err = bus.WriteByte(j.addr, j.reg, j.value)
+	case jobReadByteBlock:
+		j.data, err = bus.ReadByteBlock(j.addr, j.reg, j.length)
+	case jobReadBlockInto:
+		err = ReadBlockInto(bus, j.addr, j.reg, j.buf)
+	case jobWriteByteBlock:
+		err = bus.WriteByteBlock(j.addr, j.reg, j.buf)
+	case jobTransfer:
+		err = bus.(Transferer).Transfer(j.msgs...)
+	}
+	return
+}
+
+// Return a job from the pool for a transaction with addr and reg
+func (client *Client) job(op int, addr, reg byte) (j *job) {
+	j = jobPool.Get().(*job)
+	j.priority = client.priority
+	j.op = op
+	j.addr = addr
+	j.reg = reg
+	return
+}
+
+// Put a job back in the pool, dropping what it referenced
+func release(j *job) {
+	j.buf, j.msgs, j.data = nil, nil, nil
+	jobPool.Put(j)
+}
+
+// Queue a transaction and wait for it to run
+func (client *Client) submit(j *job) (err error) {
+	sched := client.sched
+	j.queued = time.Now()
+	j.deadline = time.Time{}
+	if client.deadline > 0 {
+		j.deadline = j.queued.Add(client.deadline)
+	}
+
+	sched.lock.Lock()
+	if sched.closed {
+		sched.lock.Unlock()
+		return ErrSchedulerClosed
+	}
+	sched.queues[j.priority] = append(sched.queues[j.priority], j)
+	sched.lock.Unlock()
+	sched.ready.Signal()
+
+	err = <-j.done
+	return
+}
+
+func (client *Client) WriteByte(addr, reg, value byte) (err error) {
+	j := client.job(jobWriteByte, addr, reg)
+	j.value = value
+	err = client.submit(j)
+	release(j)
+	return
+}
+
+func (client *Client) ReadByteBlock(addr, reg byte, readLength byte) (data []byte, err error) {
+	j := client.job(jobReadByteBlock, addr, reg)
+	j.length = readLength
+	err = client.submit(j)
+	data = j.data
+	release(j)
+	return
+}
+
+func (client *Client) ReadBlockInto(addr, reg byte, data []byte) (err error) {
+	j := client.job(jobReadBlockInto, addr, reg)
+	j.buf = data
+	err = client.submit(j)
+	release(j)
+	return
+}
+
+func (client *Client) WriteByteBlock(addr, reg byte, list []byte) (err error) {
+	j := client.job(jobWriteByteBlock, addr, reg)
+	j.buf = list
+	err = client.submit(j)
+	release(j)
+	return
+}
+
+func (client *Client) Transfer(msgs ...Msg) (err error) {
+	if _, ok := client.sched.bus.(Transferer); !ok {
+		return ErrNotSupported
+	}
+	j := client.job(jobTransfer, 0, 0)
+	j.msgs = msgs
+	err = client.submit(j)
+	release(j)
+	return
+}
@@ -0,0 +1,117 @@
+package i2c
+
+import (
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// as defined in /usr/include/linux/i2c-dev.h
+	I2C_RDWR                = 0x0707
+	I2C_RDWR_IOCTL_MAX_MSGS = 42
+	// as defined in /usr/include/linux/i2c.h
+	I2C_M_RD     = 0x0001
+	I2C_M_MAXLEN = 0xFFFF
+)
+
+// as defined in /usr/include/linux/i2c.h
+type i2c_msg struct {
+	addr  uint16
+	flags uint16
+	len   uint16
+	buf   uintptr
+}
+
+// as defined in /usr/include/linux/i2c-dev.h
+type i2c_rdwr_ioctl_data struct {
+	msgs  uintptr
+	nmsgs uint32
+}
+
+// One message of a combined transaction.  A read message
+// (Flags has I2C_M_RD set) fills Buf, a write message sends it.
+type Msg struct {
+	Addr  byte
+	Flags uint16
+	Buf   []byte
+}
+
+// A Transferer can run several messages as one combined transaction,
+// with a repeated start between them instead of a stop.
+type Transferer interface {
+	Transfer(msgs ...Msg) error
+}
+
+// Read len(data) bytes starting at reg in one combined transaction,
+// a register write followed by a repeated start read.  Unlike
+// ReadByteBlock, the read isn't limited to I2C_SMBUS_BLOCK_MAX bytes.
+func ReadRegisters(t Transferer, addr, reg byte, data []byte) (err error) {
+	err = t.Transfer(
+		Msg{Addr: addr, Buf: []byte{reg}},
+		Msg{Addr: addr, Flags: I2C_M_RD, Buf: data})
+	return
+}
+
+// Check the messages fit in a single I2C_RDWR ioctl
+func checkMsgs(msgs []Msg) (err error) {
+	if len(msgs) > I2C_RDWR_IOCTL_MAX_MSGS {
+		err = lengthError("Transfer", 0, 0, "%v messages exceeds I2C_RDWR_IOCTL_MAX_MSGS", len(msgs))
+		return
+	}
+	for _, msg := range msgs {
+		if len(msg.Buf) > I2C_M_MAXLEN {
+			err = lengthError("Transfer", msg.Addr, 0, "message length %v exceeds I2C_M_MAXLEN", len(msg.Buf))
+			return
+		}
+	}
+	return
+}
+
+// Run the messages as one combined I2C_RDWR transaction
+func (i2cbus *I2CBus) Transfer(msgs ...Msg) (err error) {
+	err = i2cbus.transfer(nil, msgs)
+	return
+}
+
+// Run the messages, through a mux channel when one is given
+func (i2cbus *I2CBus) transfer(channel *MuxChannel, msgs []Msg) (err error) {
+	if err = checkMsgs(msgs); err != nil || len(msgs) == 0 {
+		return
+	}
+
+	kmsgs := make([]i2c_msg, len(msgs))
+	for i, msg := range msgs {
+		kmsgs[i].addr = uint16(msg.Addr)
+		kmsgs[i].flags = msg.Flags
+		kmsgs[i].len = uint16(len(msg.Buf))
+		if len(msg.Buf) > 0 {
+			kmsgs[i].buf = uintptr(unsafe.Pointer(&msg.Buf[0]))
+		}
+	}
+
+	// counted against the first message's address,
+	// usually the register write to the device being read
+	addr := msgs[0].Addr
+	// a transfer that reads isn't retried, see RetryPolicy
+	retry := true
+	for _, msg := range msgs {
+		if msg.Flags&I2C_M_RD != 0 {
+			retry = false
+		}
+	}
+	err = i2cbus.do("Transfer", channel, addr, retry, func() (err error) {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
+			i2cbus.file.Fd(), I2C_RDWR, uintptr(unsafe.Pointer(&i2c_rdwr_ioctl_data{
+				msgs:  uintptr(unsafe.Pointer(&kmsgs[0])),
+				nmsgs: uint32(len(kmsgs))}))); errno != 0 {
+			err = newError("Transfer", addr, 0, syscall.Errno(errno))
+		}
+		return
+	})
+	// the kernel held the message buffers through uintptrs
+	runtime.KeepAlive(msgs)
+	runtime.KeepAlive(kmsgs)
+
+	return
+}
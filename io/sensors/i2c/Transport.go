@@ -0,0 +1,36 @@
+package i2c
+
+// Transport is the register level contract the sensor drivers use
+// to talk to their chips.  *I2CBus implements it on top of /dev/i2c-N,
+// *FakeBus implements it in memory so the drivers can run without a Pi.
+type Transport interface {
+	// Write a single byte to a register
+	WriteByte(addr, reg, value byte) error
+	// Read readLength bytes starting at a register
+	ReadByteBlock(addr, reg byte, readLength byte) ([]byte, error)
+	// Write a block of bytes starting at a register
+	WriteByteBlock(addr, reg byte, list []byte) error
+}
+
+// A BlockReader reads into a buffer the caller supplies, so reading
+// doesn't allocate.  Every Transport in this package is one.
+type BlockReader interface {
+	// Read len(data) bytes starting at a register into data
+	ReadBlockInto(addr, reg byte, data []byte) error
+}
+
+// Read len(data) bytes starting at reg into data, without allocating
+// if bus is a BlockReader, through ReadByteBlock if it isn't
+func ReadBlockInto(bus Transport, addr, reg byte, data []byte) (err error) {
+	if br, ok := bus.(BlockReader); ok {
+		return br.ReadBlockInto(addr, reg, data)
+	}
+	if len(data) > I2C_SMBUS_BLOCK_MAX {
+		return lengthError("ReadByteBlock", addr, reg, "read length %v exceeds I2C_SMBUS_BLOCK_MAX", len(data))
+	}
+	var block []byte
+	if block, err = bus.ReadByteBlock(addr, reg, byte(len(data))); err == nil {
+		copy(data, block)
+	}
+	return
+}
@@ -0,0 +1,115 @@
+package spi
+
+import (
+	"goPiCopter/io/sensors/i2c"
+	"sync"
+)
+
+/**
+* Bus puts the register read/write contract the sensor drivers use
+* (i2c.Transport) on top of an SPI connection, using the ST register
+* conventions.  The first byte clocked out holds the register address
+* in bits 5-0, bit 6 (MS) set to auto-increment over several bytes and
+* bit 7 set for a read.  The drivers set bit 7 of the register for the
+* i2c auto-increment, that's replaced by the SPI bits.  There's one chip
+* per chip select, so the device address is ignored.
+**/
+const (
+	SPI_READ     = 0x80
+	SPI_MULTIPLE = 0x40
+	SPI_REG_MASK = 0x3F
+)
+
+type Bus struct {
+	conn Conn
+	// what's clocked out and in on a read, kept
+	// between reads so reading doesn't allocate
+	lock sync.Mutex
+	w, r []byte
+}
+
+// Return a Bus for the chip on an SPI connection
+func NewBus(conn Conn) (bus *Bus) {
+	bus = new(Bus)
+	bus.conn = conn
+	return
+}
+
+// Return the command byte for an access of n bytes
+func command(reg byte, n int, read bool) (cmd byte) {
+	cmd = reg & SPI_REG_MASK
+	if n > 1 {
+		cmd |= SPI_MULTIPLE
+	}
+	if read {
+		cmd |= SPI_READ
+	}
+	return
+}
+
+func (bus *Bus) WriteByte(addr, reg, value byte) (err error) {
+	err = bus.conn.Tx([]byte{command(reg, 1, false), value}, nil)
+	return
+}
+
+func (bus *Bus) ReadByteBlock(addr, reg byte, readLength byte) (data []byte, err error) {
+	data = make([]byte, readLength)
+	if err = bus.read(reg, data); err != nil {
+		data = nil
+	}
+	return
+}
+
+func (bus *Bus) ReadBlockInto(addr, reg byte, data []byte) (err error) {
+	err = bus.read(reg, data)
+	return
+}
+
+func (bus *Bus) WriteByteBlock(addr, reg byte, list []byte) (err error) {
+	w := make([]byte, len(list)+1)
+	w[0] = command(reg, len(list), false)
+	copy(w[1:], list)
+	err = bus.conn.Tx(w, nil)
+	return
+}
+
+// Read len(data) bytes starting at reg
+func (bus *Bus) read(reg byte, data []byte) (err error) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if n := len(data) + 1; n > cap(bus.w) {
+		bus.w = make([]byte, n)
+		bus.r = make([]byte, n)
+	}
+	w := bus.w[:len(data)+1]
+	r := bus.r[:len(w)]
+	w[0] = command(reg, len(data), true)
+	for i := 1; i < len(w); i++ {
+		w[i] = 0
+	}
+	if err = bus.conn.Tx(w, r); err == nil {
+		copy(data, r[1:])
+	}
+	return
+}
+
+// Combined transactions, as far as they make sense for one SPI chip.
+// A write message followed by a read message is a register read of
+// any length, any other write message is a register write.
+func (bus *Bus) Transfer(msgs ...i2c.Msg) (err error) {
+	for i := 0; i < len(msgs) && err == nil; i++ {
+		msg := msgs[i]
+		switch {
+		case msg.Flags&i2c.I2C_M_RD != 0:
+			// a read without a register to read from
+			err = i2c.ErrNotSupported
+		case len(msg.Buf) == 1 && i+1 < len(msgs) && msgs[i+1].Flags&i2c.I2C_M_RD != 0:
+			err = bus.read(msg.Buf[0], msgs[i+1].Buf)
+			i++
+		case len(msg.Buf) > 1:
+			err = bus.WriteByteBlock(msg.Addr, msg.Buf[0], msg.Buf[1:])
+		}
+	}
+	return
+}
@@ -0,0 +1,57 @@
+package spi
+
+import (
+	"errors"
+	"goPiCopter/io/sensors/i2c"
+	"sync"
+)
+
+/**
+* FakeConn is an in-memory Conn to a chip emulated by an i2c.FakeDevice,
+* one of the emulator package's chips for example, so the same emulation
+* answers on either bus.  It decodes the ST command byte, and hands the
+* MS auto-increment bit on as the high bit of the register address the
+* way it arrives over i2c.
+**/
+type FakeConn struct {
+	dev  i2c.FakeDevice
+	lock sync.Mutex
+}
+
+// Return a FakeConn to dev
+func NewFakeConn(dev i2c.FakeDevice) (conn *FakeConn) {
+	conn = new(FakeConn)
+	conn.dev = dev
+	return
+}
+
+func (conn *FakeConn) Tx(w, r []byte) (err error) {
+	if r != nil && len(r) != len(w) {
+		err = errors.New("spi: read buffer length doesn't match write length")
+		return
+	}
+	if len(w) == 0 {
+		return
+	}
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	reg := w[0] & SPI_REG_MASK
+	if w[0]&SPI_MULTIPLE != 0 {
+		reg |= 0x80
+	}
+	if w[0]&SPI_READ != 0 {
+		if r == nil {
+			// still read, reading can have side effects
+			r = make([]byte, len(w))
+		}
+		// nothing comes back while the command byte goes out
+		r[0] = 0
+		err = conn.dev.ReadRegisters(reg, r[1:])
+	} else if len(w) > 1 {
+		err = conn.dev.WriteRegisters(reg, w[1:])
+	}
+
+	return
+}
@@ -0,0 +1,114 @@
+package spi
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// as defined in /usr/include/linux/spi/spidev.h
+	SPI_IOC_WR_MODE          = 0x40016B01
+	SPI_IOC_WR_BITS_PER_WORD = 0x40016B03
+	SPI_IOC_WR_MAX_SPEED_HZ  = 0x40046B04
+	SPI_IOC_MESSAGE_1        = 0x40206B00 // _IOW('k', 0, char[sizeof(struct spi_ioc_transfer)])
+	SPI_MODE_0               = 0x00
+	SPI_MODE_3               = 0x03 // CPOL=1, CPHA=1, what the ST sensors use
+)
+
+// as defined in /usr/include/linux/spi/spidev.h
+type spi_ioc_transfer struct {
+	tx_buf           uint64
+	rx_buf           uint64
+	len              uint32
+	speed_hz         uint32
+	delay_usecs      uint16
+	bits_per_word    uint8
+	cs_change        uint8
+	tx_nbits         uint8
+	rx_nbits         uint8
+	word_delay_usecs uint8
+	pad              uint8
+}
+
+// A Conn is a full duplex SPI connection to one chip.  Tx holds
+// chip select for the whole transfer, clocking w out while clocking
+// len(w) bytes into r, which may be nil if nothing is to be read.
+type Conn interface {
+	Tx(w, r []byte) error
+}
+
+// A SPIDev is a Conn through /dev/spidevB.C
+type SPIDev struct {
+	file  *os.File
+	speed uint32
+	lock  sync.Mutex
+}
+
+// Open /dev/spidevBus.ChipSelect with the given mode and maximum clock rate
+func Open(bus, chipSelect byte, mode byte, speedHz uint32) (dev *SPIDev, err error) {
+	dev = new(SPIDev)
+	dev.speed = speedHz
+	if dev.file, err = os.OpenFile(fmt.Sprintf("/dev/spidev%v.%v", bus, chipSelect), os.O_RDWR, 0); err != nil {
+		return
+	}
+
+	bits := uint8(8)
+	settings := []struct {
+		request uintptr
+		value   unsafe.Pointer
+	}{
+		{SPI_IOC_WR_MODE, unsafe.Pointer(&mode)},
+		{SPI_IOC_WR_BITS_PER_WORD, unsafe.Pointer(&bits)},
+		{SPI_IOC_WR_MAX_SPEED_HZ, unsafe.Pointer(&speedHz)},
+	}
+	for _, setting := range settings {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.file.Fd(), setting.request, uintptr(setting.value)); errno != 0 {
+			err = syscall.Errno(errno)
+			dev.file.Close()
+			return
+		}
+	}
+
+	return
+}
+
+func (dev *SPIDev) Tx(w, r []byte) (err error) {
+	if r != nil && len(r) != len(w) {
+		err = fmt.Errorf("spi: read buffer length %v doesn't match write length %v", len(r), len(w))
+		return
+	}
+	if len(w) == 0 {
+		return
+	}
+
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	transfer := spi_ioc_transfer{
+		tx_buf:        uint64(uintptr(unsafe.Pointer(&w[0]))),
+		len:           uint32(len(w)),
+		speed_hz:      dev.speed,
+		bits_per_word: 8,
+	}
+	if r != nil {
+		transfer.rx_buf = uint64(uintptr(unsafe.Pointer(&r[0])))
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
+		dev.file.Fd(), SPI_IOC_MESSAGE_1, uintptr(unsafe.Pointer(&transfer))); errno != 0 {
+		err = syscall.Errno(errno)
+	}
+	// the kernel held the buffers through integers
+	runtime.KeepAlive(w)
+	runtime.KeepAlive(r)
+
+	return
+}
+
+// Close the spidev file
+func (dev *SPIDev) Close() error {
+	return dev.file.Close()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"goPiCopter/io/sensors"
+	"goPiCopter/io/sensors/i2c"
+	"os"
+	"text/tabwriter"
+)
+
+/**
+* The scan subcommand, goPiCopter scan [-bus n]
+* Probe every address on the bus, and identify the chips the
+* sensor drivers support, for bringing up a new frame.
+**/
+func scan(args []string) {
+	var (
+		scanFlags = flag.NewFlagSet("scan", flag.ExitOnError)
+		number    = scanFlags.Uint("bus", *busNumber, "i2c bus to scan")
+		bus       *i2c.I2CBus
+		err       error
+		found     map[string]bool
+	)
+	scanFlags.Parse(args)
+
+	bus, err = i2c.Bus(byte(*number))
+	if err != nil {
+		fmt.Printf("Error: opening i2c bus %v, err=%v\n", *number, err)
+		return
+	}
+
+	found = make(map[string]bool)
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(table, "ADDR\tDRIVER\tDETAIL\n")
+	for _, addr := range i2c.Scan(bus) {
+		for _, id := range sensors.Identify(bus, addr) {
+			driver := id.Driver
+			if driver == "" {
+				driver = "-"
+			}
+			found[id.Driver] = true
+			fmt.Fprintf(table, "0x%02X\t%s\t%s\n", id.Addr, driver, id.Detail)
+		}
+	}
+	table.Flush()
+
+	for _, probe := range sensors.Probes {
+		if !found[probe.Driver] {
+			fmt.Printf("%s not found, looked at", probe.Driver)
+			for _, addr := range probe.Addrs {
+				fmt.Printf(" 0x%02X", addr)
+			}
+			fmt.Printf("\n")
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"goPiCopter/io/sensors"
+	"goPiCopter/io/sensors/emulator"
+	"goPiCopter/io/sensors/i2c"
+	"math"
+	"time"
+)
+
+/**
+* Calibrate an emulated accelerometer with offset, scale and cross axis
+* errors in the six poses, with the copter lingering in each pose after
+* it's asked for the next and wobbling on the way there, and check the
+* calibration takes the errors back out.  Check the bias computed with
+* the copter level leaves gravity on Z too.
+**/
+func main() {
+	var failures int
+
+	check := func(what string, got, want, tolerance float32) {
+		if math.Abs(float64(got-want)) > float64(tolerance) {
+			fmt.Printf("FAIL %s: got %v, want %v\n", what, got, want)
+			failures++
+		}
+	}
+	const g = sensors.LSM303ACCEL_GRAVITY_EARTH
+
+	// Quick and fine, so the poses don't take long to read still
+	config := sensors.LSM303ACCELConfig{DataRate: 400, Range: sensors.LSM303ACCEL_RANGE_2G, HighResolution: true}
+	offset := [3]float32{0.03, -0.05, 0.08}
+
+	// The bias, with the copter level, leaves 1g on Z
+	levelEmu := emulator.NewLSM303ACCEL(emulator.Still{Accel: [3]float32{0, 0, 1}})
+	levelEmu.SetDistortion(offset, [3][3]float32{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}})
+	levelBus := i2c.NewFakeBus()
+	levelBus.Attach(sensors.LSM303ACCEL_ADDR, levelEmu)
+	level, err := sensors.NewLSM303ACCELOnBus(levelBus)
+	if err == nil {
+		err = level.Configure(config)
+	}
+	if err != nil {
+		fmt.Printf("Error: getting device LSM303ACCEL, err=%v\n", err)
+		return
+	}
+	for i := 0; i < 100; i++ {
+		level.Measure()
+	}
+	if err = level.ComputeBias(); err != nil {
+		fmt.Printf("Error: computing the bias, err=%v\n", err)
+		return
+	}
+	for i := 0; i < 10; i++ {
+		level.Measure()
+	}
+	if x, y, z, err := level.Evaluate(); err != nil {
+		fmt.Printf("Error: evaluating, err=%v\n", err)
+		return
+	} else {
+		check("level bias x", x, 0, 0.02)
+		check("level bias y", y, 0, 0.02)
+		check("level bias z", z, g, 0.02)
+	}
+
+	runs := []struct {
+		crossAxis bool
+		matrix    [3][3]float32
+	}{
+		{false, [3][3]float32{{1.03, 0, 0}, {0, 0.97, 0}, {0, 0, 1.05}}},
+		{true, [3][3]float32{{1.03, 0.02, -0.01}, {0.015, 0.97, 0.02}, {-0.01, 0.01, 1.05}}},
+	}
+	for _, run := range runs {
+		// Asked for the next pose the copter stays put a moment, then
+		// wobbles on its way there
+		var (
+			gravity, previous = [3]float32{0, 0, 1}, [3]float32{0, 0, 1}
+			now, movedAt      time.Duration
+			prompts           []string
+		)
+		motion := emulator.MotionFunc(func(t time.Duration) (s emulator.Sample) {
+			now = t
+			switch since := t - movedAt; {
+			case since < 300*time.Millisecond:
+				s.Accel = previous
+			case since < 500*time.Millisecond:
+				wobble := float32(0.3 * math.Sin(t.Seconds()*40))
+				s.Accel = [3]float32{gravity[0] + wobble, gravity[1] - wobble, gravity[2] + wobble}
+			default:
+				s.Accel = gravity
+			}
+			return
+		})
+		accelEmu := emulator.NewLSM303ACCEL(motion)
+		accelEmu.SetDistortion(offset, run.matrix)
+		bus := i2c.NewFakeBus()
+		bus.Attach(sensors.LSM303ACCEL_ADDR, accelEmu)
+		accelerometer, err := sensors.NewLSM303ACCELOnBus(bus)
+		if err == nil {
+			err = accelerometer.Configure(config)
+		}
+		if err != nil {
+			fmt.Printf("Error: getting device LSM303ACCEL, err=%v\n", err)
+			return
+		}
+		_, err = accelerometer.CalibrateSixPosition(run.crossAxis, 5*time.Second, func(pose sensors.AccelPose) {
+			prompts = append(prompts, pose.Name)
+			previous, gravity, movedAt = gravity, pose.Gravity, now
+		})
+		if err != nil {
+			fmt.Printf("FAIL cross axis %v calibration: %v\n", run.crossAxis, err)
+			failures++
+			continue
+		}
+		for i, pose := range sensors.AccelPoses {
+			if i >= len(prompts) || prompts[i] != pose.Name {
+				fmt.Printf("FAIL cross axis %v prompts: got %v\n", run.crossAxis, prompts)
+				failures++
+				break
+			}
+		}
+
+		// Calibrated, any attitude reads true
+		movedAt = -time.Hour
+		for _, attitude := range [][3]float32{{0, 0, 1}, {0.6, 0, 0.8}, {-0.48, 0.6, -0.64}, {0, -1, 0}} {
+			gravity = attitude
+			for i := 0; i < 10; i++ {
+				accelerometer.Measure()
+			}
+			x, y, z, err := accelerometer.Evaluate()
+			if err != nil {
+				fmt.Printf("Error: evaluating, err=%v\n", err)
+				return
+			}
+			what := fmt.Sprintf("cross axis %v calibrated %v", run.crossAxis, attitude)
+			check(what+" x", x, attitude[0]*g, 0.03)
+			check(what+" y", y, attitude[1]*g, 0.03)
+			check(what+" z", z, attitude[2]*g, 0.03)
+		}
+	}
+
+	// Still readings that aren't in a pose, and a fit short of poses
+	var calibrator sensors.AccelCalibrator
+	if _, _, err = calibrator.Add(0.6*g, 0, 0.8*g); err == nil {
+		fmt.Printf("FAIL tilted pose accepted\n")
+		failures++
+	}
+	if pose, isNew, err := calibrator.Add(0, 0, -g); err != nil || pose != 1 || !isNew {
+		fmt.Printf("FAIL upside down: pose %v, new %v, %v\n", pose, isNew, err)
+		failures++
+	}
+	if _, err = calibrator.Fit(); err == nil {
+		fmt.Printf("FAIL fit with one pose\n")
+		failures++
+	}
+
+	// Never still
+	shaking := emulator.MotionFunc(func(t time.Duration) (s emulator.Sample) {
+		s.Accel = [3]float32{0, 0, 1 + float32(0.5*math.Sin(t.Seconds()*40))}
+		return
+	})
+	shakingBus := i2c.NewFakeBus()
+	shakingBus.Attach(sensors.LSM303ACCEL_ADDR, emulator.NewLSM303ACCEL(shaking))
+	shaken, err := sensors.NewLSM303ACCELOnBus(shakingBus)
+	if err == nil {
+		err = shaken.Configure(config)
+	}
+	if err != nil {
+		fmt.Printf("Error: getting device LSM303ACCEL, err=%v\n", err)
+		return
+	}
+	if _, _, _, err = shaken.WaitStill(200 * time.Millisecond); !errors.Is(err, sensors.ErrMoving) {
+		fmt.Printf("FAIL shaking: got %v, want ErrMoving\n", err)
+		failures++
+	}
+
+	if failures == 0 {
+		fmt.Printf("PASS\n")
+	} else {
+		fmt.Printf("%d failures\n", failures)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"goPiCopter/io"
+	"goPiCopter/io/sensors"
+	"goPiCopter/io/sensors/emulator"
+	"goPiCopter/io/sensors/gpio"
+	"goPiCopter/io/sensors/i2c"
+	"math"
+	"time"
+)
+
+/**
+* Read the emulated sensors on fake data ready lines, the gyroscope's and
+* accelerometer's edges raised in turn, stamped 5ms apart on a kernel
+* clock of their own, and check the chips were set to raise their pins,
+* the FIFOs left off, and the data stamped from the edges.  Then leave
+* the lines unwired and check the loop gives up on them and polls, and
+* break the lines after they've worked and check they aren't spun on.
+**/
+func main() {
+	var failures int
+
+	check := func(what string, got, want, tolerance float32) {
+		if math.Abs(float64(got-want)) > float64(tolerance) {
+			fmt.Printf("FAIL %s: got %v, want %v\n", what, got, want)
+			failures++
+		}
+	}
+	register := func(bus *i2c.FakeBus, addr, reg byte) byte {
+		data, err := bus.ReadByteBlock(addr, reg, 1)
+		if err != nil {
+			fmt.Printf("Error: reading register 0x%02X, err=%v\n", reg, err)
+			return 0
+		}
+		return data[0]
+	}
+	newBus := func() (bus *i2c.FakeBus) {
+		motion := emulator.Still{Rate: [3]float32{0, 0, 30}, Accel: [3]float32{0, 0, 1}, Field: [3]float32{0.2, -0.1, -0.4}}
+		bus = i2c.NewFakeBus()
+		bus.Attach(sensors.L3GD20_ADDR, emulator.NewL3GD20(motion))
+		bus.Attach(sensors.LSM303ACCEL_ADDR, emulator.NewLSM303ACCEL(motion))
+		bus.Attach(sensors.LSM303MAG_ADDR, emulator.NewLSM303MAG(motion))
+		return
+	}
+	const step = int64(5 * time.Millisecond)
+	// Raise the lines' edges in turn every 5ms until stop is closed
+	raise := func(gyroLine, accelLine *gpio.FakeLine, stop chan struct{}) {
+		stamp := int64(1000 * time.Hour)
+		for i := 0; ; i++ {
+			line := gyroLine
+			if i%2 == 1 {
+				line = accelLine
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			line.Raise(stamp)
+			stamp += step
+			time.Sleep(time.Duration(step))
+		}
+	}
+
+	// Wired, the edges coming in turn every 5ms
+	bus := newBus()
+	gyroLine, accelLine := gpio.NewFakeLine(), gpio.NewFakeLine()
+	stop := make(chan struct{})
+	go raise(gyroLine, accelLine, stop)
+	sensorChannel := make(chan io.SensorData)
+	go io.ReadSensorsOnLines(bus, gyroLine, accelLine, sensorChannel)
+
+	var first int64
+	for i := 0; i < 40; i++ {
+		data, ok := <-sensorChannel
+		if !ok {
+			fmt.Printf("FAIL interrupts: sensors stopped\n")
+			failures++
+			break
+		}
+		if i == 0 {
+			first = data.When
+		}
+		// stamped from the edges, on their 5ms grid
+		if (data.When-first)%step != 0 {
+			fmt.Printf("FAIL interrupts summary %v: stamped %v after the first, not on the edges' grid\n", i, data.When-first)
+			failures++
+		}
+		if data.Count == 0 {
+			fmt.Printf("FAIL interrupts summary %v: no samples\n", i)
+			failures++
+		}
+		check("interrupts gyro z", data.Gz, 30, 0.5)
+		check("interrupts accel z", data.Az, sensors.LSM303ACCEL_GRAVITY_EARTH, 0.3)
+	}
+	close(stop)
+	if register(bus, sensors.L3GD20_ADDR, sensors.L3GD20_CTRL_REG3)&sensors.L3GD20_CTRL_REG3_I2_DRDY == 0 {
+		fmt.Printf("FAIL L3GD20 data ready not routed to DRDY/INT2\n")
+		failures++
+	}
+	if register(bus, sensors.LSM303ACCEL_ADDR, sensors.LSM303ACCEL_CTRL_REG3)&sensors.LSM303ACCEL_CTRL_REG3_I1_DRDY1 == 0 {
+		fmt.Printf("FAIL LSM303ACCEL data ready not routed to INT1\n")
+		failures++
+	}
+	if register(bus, sensors.L3GD20_ADDR, sensors.L3GD20_CTRL_REG5)&sensors.L3GD20_CTRL_REG5_FIFO_EN != 0 {
+		fmt.Printf("FAIL L3GD20 FIFO on with data ready interrupts\n")
+		failures++
+	}
+
+	// Unwired, nothing ever rises
+	bus = newBus()
+	sensorChannel = make(chan io.SensorData)
+	go io.ReadSensorsOnLines(bus, gpio.NewFakeLine(), gpio.NewFakeLine(), sensorChannel)
+	for i := 0; i < 40; i++ {
+		data, ok := <-sensorChannel
+		if !ok {
+			fmt.Printf("FAIL unwired: sensors stopped\n")
+			failures++
+			break
+		}
+		check("unwired gyro z", data.Gz, 30, 0.5)
+	}
+	if register(bus, sensors.L3GD20_ADDR, sensors.L3GD20_CTRL_REG5)&sensors.L3GD20_CTRL_REG5_FIFO_EN == 0 {
+		fmt.Printf("FAIL unwired L3GD20 FIFO not on once polling\n")
+		failures++
+	}
+
+	// Broken, the lines fail at once after working for a while
+	bus = newBus()
+	brokenGyro, brokenAccel := gpio.NewFakeLine(), gpio.NewFakeLine()
+	stopBroken := make(chan struct{})
+	go raise(brokenGyro, brokenAccel, stopBroken)
+	sensorChannel = make(chan io.SensorData)
+	go io.ReadSensorsOnLines(bus, brokenGyro, brokenAccel, sensorChannel)
+	for i := 0; i < 10; i++ {
+		<-sensorChannel
+	}
+	close(stopBroken)
+	go func() {
+		for range sensorChannel {
+		}
+	}()
+	broken := errors.New("gpio: read failed")
+	brokenGyro.Fail(broken)
+	brokenAccel.Fail(broken)
+	waits := brokenGyro.Waits() + brokenAccel.Waits()
+	const brokenFor = 250 * time.Millisecond
+	time.Sleep(brokenFor)
+	// each line's waited on once a DRDY_TIMEOUT, and a couple more on the way
+	most := 2 * (int(brokenFor/io.DRDY_TIMEOUT) + 2)
+	if got := brokenGyro.Waits() + brokenAccel.Waits() - waits; got > most {
+		fmt.Printf("FAIL broken lines waited on %v times in %v, want at most %v\n", got, brokenFor, most)
+		failures++
+	}
+
+	if failures == 0 {
+		fmt.Printf("PASS\n")
+	} else {
+		fmt.Printf("%d failures\n", failures)
+	}
+}
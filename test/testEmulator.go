@@ -0,0 +1,729 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"goPiCopter/io"
+	"goPiCopter/io/sensors"
+	"goPiCopter/io/sensors/emulator"
+	"goPiCopter/io/sensors/i2c"
+	"goPiCopter/io/sensors/spi"
+	"math"
+	"reflect"
+	"time"
+)
+
+/**
+* Run the sensor drivers against the emulated chips on a fake
+* i2c bus, and the gyroscope on a fake SPI connection too, and compare
+* what they report against the motion profile driving the emulators,
+* the drivers on their own and the read loop end to end.
+* No RaspberryPi required.
+**/
+func main() {
+	var (
+		err      error
+		failures int
+	)
+
+	// Rotate about Z, slowly rolling over, in a 0.45 gauss field
+	motion := emulator.MotionFunc(func(t time.Duration) (s emulator.Sample) {
+		secs := float32(t.Seconds())
+		s.Rate = [3]float32{10, -20, 90 + 10*secs}
+		s.Accel = [3]float32{0, 0.1 * secs, 1}
+		s.Field = [3]float32{0.2, -0.1, -0.4}
+		return
+	})
+
+	gyroEmu := emulator.NewL3GD20(motion)
+	accelEmu := emulator.NewLSM303ACCEL(motion)
+	magEmu := emulator.NewLSM303MAG(motion)
+
+	bus := i2c.NewFakeBus()
+	bus.Attach(sensors.L3GD20_ADDR, gyroEmu)
+	bus.Attach(sensors.LSM303ACCEL_ADDR, accelEmu)
+	bus.Attach(sensors.LSM303MAG_ADDR, magEmu)
+
+	check := func(what string, got, want, tolerance float32) {
+		if math.Abs(float64(got-want)) > float64(tolerance) {
+			fmt.Printf("FAIL %s: got %v, want %v\n", what, got, want)
+			failures++
+		}
+	}
+
+	gyroscope, err := sensors.NewL3GD20OnBus(bus)
+	if err != nil {
+		fmt.Printf("Error: getting device L3GD20, err=%v\n", err)
+		return
+	}
+	ranges := []struct {
+		dpsRange    byte
+		sensitivity float32
+	}{
+		{sensors.L3GD20_RANGE_250DPS, sensors.L3GD20_SENSITIVITY_250DPS},
+		{sensors.L3GD20_RANGE_500DPS, sensors.L3GD20_SENSITIVITY_500DPS},
+		{sensors.L3GD20_RANGE_2000DPS, sensors.L3GD20_SENSITIVITY_2000DPS},
+	}
+	for i, r := range ranges {
+		config := sensors.DefaultL3GD20Config
+		config.Range = r.dpsRange
+		config.DataRate = sensors.L3GD20DataRates[i]
+		config.Bandwidth = sensors.L3GD20Bandwidths[config.DataRate][3]
+		config.HighPassCutoff = sensors.L3GD20HighPassCutoffs[config.DataRate][i]
+		config.LowPass = true
+		config.BlockDataUpdate = true
+		if err = gyroscope.Configure(config); err != nil {
+			fmt.Printf("Error: configuring gyroscope, err=%v\n", err)
+			return
+		}
+		if got, err := gyroscope.ReadConfig(); err != nil || got != config {
+			fmt.Printf("FAIL gyro config: read back %+v, %v, configured %+v\n", got, err, config)
+			failures++
+		}
+		for i := 0; i < 100; i++ {
+			x, y, z, err := gyroscope.ReadXYZ()
+			if err != nil {
+				fmt.Printf("Error: reading gyroscope, err=%v\n", err)
+				return
+			}
+			truth := gyroEmu.Truth()
+			check("gyro x", x, truth.Rate[0], r.sensitivity)
+			check("gyro y", y, truth.Rate[1], r.sensitivity)
+			check("gyro z", z, truth.Rate[2], r.sensitivity)
+		}
+	}
+	invalid := sensors.DefaultL3GD20Config
+	invalid.Bandwidth = 70 // only at 190Hz
+	if err = gyroscope.Configure(invalid); err == nil {
+		fmt.Printf("FAIL gyro config: 70Hz bandwidth at 95Hz accepted\n")
+		failures++
+	}
+
+	// The FIFO, through a combined transaction and through block
+	// reads on a bus that can't do them, on a clock the test drives
+	for _, burst := range []bool{true, false} {
+		var (
+			elapsed time.Duration
+			samples [sensors.L3GD20_FIFO_SIZE]sensors.L3GD20Sample
+			fifoBus i2c.Transport
+		)
+		fifoEmu := emulator.NewL3GD20(motion)
+		fifoEmu.SetClock(func() time.Duration { return elapsed })
+		fifoBus = i2c.NewFakeBus()
+		fifoBus.(*i2c.FakeBus).Attach(sensors.L3GD20_ADDR, fifoEmu)
+		if !burst {
+			fifoBus = struct{ i2c.Transport }{fifoBus}
+		}
+		fifoGyroscope, err := sensors.NewL3GD20OnBus(fifoBus)
+		if err == nil {
+			err = fifoGyroscope.EnableFIFO()
+		}
+		if err != nil {
+			fmt.Printf("Error: enabling the gyroscope FIFO, err=%v\n", err)
+			return
+		}
+		reads := []struct {
+			advance time.Duration
+			n       int
+			overrun bool
+		}{
+			{100 * time.Millisecond, 9, false}, // 95Hz
+			{50 * time.Millisecond, 5, false},
+			{time.Second, sensors.L3GD20_FIFO_SIZE, true},
+		}
+		for _, r := range reads {
+			elapsed += r.advance
+			now := int64(elapsed)
+			n, overrun, err := fifoGyroscope.ReadFIFO(now, samples[:])
+			if err != nil {
+				fmt.Printf("Error: reading the gyroscope FIFO, err=%v\n", err)
+				return
+			}
+			if n != r.n || overrun != r.overrun {
+				fmt.Printf("FAIL gyro fifo (burst %v): read %v samples, overrun %v, want %v, %v\n", burst, n, overrun, r.n, r.overrun)
+				failures++
+				continue
+			}
+			truth := fifoEmu.Truth()
+			last := samples[n-1]
+			check("gyro fifo x", last.X, truth.Rate[0], sensors.L3GD20_SENSITIVITY_250DPS)
+			check("gyro fifo y", last.Y, truth.Rate[1], sensors.L3GD20_SENSITIVITY_250DPS)
+			check("gyro fifo z", last.Z, truth.Rate[2], sensors.L3GD20_SENSITIVITY_250DPS)
+			if last.When != now || samples[0].When != now-int64(n-1)*int64(time.Second/95) {
+				fmt.Printf("FAIL gyro fifo (burst %v): samples stamped %v to %v, read at %v\n", burst, samples[0].When, last.When, now)
+				failures++
+			}
+		}
+	}
+
+	spiGyroEmu := emulator.NewL3GD20(motion)
+	spiGyroscope, err := sensors.NewL3GD20With(sensors.WithTransport(spi.NewBus(spi.NewFakeConn(spiGyroEmu))))
+	if err != nil {
+		fmt.Printf("Error: getting device L3GD20 on SPI, err=%v\n", err)
+		return
+	}
+	for i := 0; i < 100; i++ {
+		x, y, z, err := spiGyroscope.ReadXYZ()
+		if err != nil {
+			fmt.Printf("Error: reading gyroscope on SPI, err=%v\n", err)
+			return
+		}
+		truth := spiGyroEmu.Truth()
+		check("spi gyro x", x, truth.Rate[0], sensors.L3GD20_SENSITIVITY_250DPS)
+		check("spi gyro y", y, truth.Rate[1], sensors.L3GD20_SENSITIVITY_250DPS)
+		check("spi gyro z", z, truth.Rate[2], sensors.L3GD20_SENSITIVITY_250DPS)
+	}
+
+	accelerometer, err := sensors.NewLSM303ACCELOnBus(bus)
+	if err != nil {
+		fmt.Printf("Error: getting device LSM303ACCEL, err=%v\n", err)
+		return
+	}
+	accelRanges := []struct {
+		gRange      byte
+		sensitivity float32
+	}{
+		{sensors.LSM303ACCEL_RANGE_2G, sensors.LSM303ACCEL_SENSITIVITY_2G},
+		{sensors.LSM303ACCEL_RANGE_4G, sensors.LSM303ACCEL_SENSITIVITY_4G},
+		{sensors.LSM303ACCEL_RANGE_8G, sensors.LSM303ACCEL_SENSITIVITY_8G},
+		{sensors.LSM303ACCEL_RANGE_16G, sensors.LSM303ACCEL_SENSITIVITY_16G},
+	}
+	modes := []struct {
+		name       string
+		config     sensors.LSM303ACCELConfig
+		resolution float32 // digits of the 12 bit value per output step
+	}{
+		{"high resolution", sensors.LSM303ACCELConfig{DataRate: 400, HighResolution: true, BlockDataUpdate: true}, 1},
+		{"normal", sensors.LSM303ACCELConfig{DataRate: 100}, 4},
+		{"low power", sensors.LSM303ACCELConfig{DataRate: 1620, LowPower: true}, 16},
+	}
+	for _, r := range accelRanges {
+		for _, mode := range modes {
+			config := mode.config
+			config.Range = r.gRange
+			if err = accelerometer.Configure(config); err != nil {
+				fmt.Printf("Error: configuring accelerometer, err=%v\n", err)
+				return
+			}
+			if readBack, err := accelerometer.ReadConfig(); err != nil || readBack != config {
+				fmt.Printf("FAIL accel config: read back %+v, %v, want %+v\n", readBack, err, config)
+				failures++
+			}
+			// m/s^2, within one output step
+			tolerance := mode.resolution * r.sensitivity * sensors.LSM303ACCEL_GRAVITY_EARTH
+			for i := 0; i < 100; i++ {
+				x, y, z, err := accelerometer.ReadXYZ()
+				if err != nil {
+					fmt.Printf("Error: reading accelerometer, err=%v\n", err)
+					return
+				}
+				truth := accelEmu.Truth()
+				what := fmt.Sprintf("(range %v, %s)", r.gRange, mode.name)
+				check("accel x "+what, x, truth.Accel[0]*sensors.LSM303ACCEL_GRAVITY_EARTH, tolerance)
+				check("accel y "+what, y, truth.Accel[1]*sensors.LSM303ACCEL_GRAVITY_EARTH, tolerance)
+				check("accel z "+what, z, truth.Accel[2]*sensors.LSM303ACCEL_GRAVITY_EARTH, tolerance)
+			}
+		}
+	}
+	invalidAccel := []sensors.LSM303ACCELConfig{
+		{DataRate: 100, HighResolution: true, LowPower: true},
+		{DataRate: 1620},
+		{DataRate: 1344, LowPower: true},
+		{DataRate: 100, Range: 4},
+	}
+	for _, config := range invalidAccel {
+		if config.Validate() == nil {
+			fmt.Printf("FAIL accel config: %+v should be invalid\n", config)
+			failures++
+		}
+	}
+
+	// The accelerometer's FIFO, at 100Hz
+	for _, burst := range []bool{true, false} {
+		var (
+			elapsed time.Duration
+			samples [sensors.LSM303ACCEL_FIFO_SIZE]sensors.LSM303ACCELSample
+			fifoBus i2c.Transport
+		)
+		fifoEmu := emulator.NewLSM303ACCEL(motion)
+		fifoEmu.SetClock(func() time.Duration { return elapsed })
+		fifoBus = i2c.NewFakeBus()
+		fifoBus.(*i2c.FakeBus).Attach(sensors.LSM303ACCEL_ADDR, fifoEmu)
+		if !burst {
+			fifoBus = struct{ i2c.Transport }{fifoBus}
+		}
+		fifoAccelerometer, err := sensors.NewLSM303ACCELOnBus(fifoBus)
+		if err == nil {
+			err = fifoAccelerometer.Configure(sensors.LSM303ACCELConfig{DataRate: 100, HighResolution: true})
+		}
+		if err == nil {
+			err = fifoAccelerometer.EnableFIFO()
+		}
+		if err != nil {
+			fmt.Printf("Error: enabling the accelerometer FIFO, err=%v\n", err)
+			return
+		}
+		reads := []struct {
+			advance time.Duration
+			n       int
+			overrun bool
+		}{
+			{100 * time.Millisecond, 10, false},
+			{50 * time.Millisecond, 5, false},
+			{time.Second, sensors.LSM303ACCEL_FIFO_SIZE, true},
+		}
+		for _, r := range reads {
+			elapsed += r.advance
+			now := int64(elapsed)
+			n, overrun, err := fifoAccelerometer.ReadFIFO(now, samples[:])
+			if err != nil {
+				fmt.Printf("Error: reading the accelerometer FIFO, err=%v\n", err)
+				return
+			}
+			if n != r.n || overrun != r.overrun {
+				fmt.Printf("FAIL accel fifo (burst %v): read %v samples, overrun %v, want %v, %v\n", burst, n, overrun, r.n, r.overrun)
+				failures++
+				continue
+			}
+			truth := fifoEmu.Truth()
+			last := samples[n-1]
+			tolerance := float32(sensors.LSM303ACCEL_SENSITIVITY_2G * sensors.LSM303ACCEL_GRAVITY_EARTH)
+			check("accel fifo x", last.X, truth.Accel[0]*sensors.LSM303ACCEL_GRAVITY_EARTH, tolerance)
+			check("accel fifo y", last.Y, truth.Accel[1]*sensors.LSM303ACCEL_GRAVITY_EARTH, tolerance)
+			check("accel fifo z", last.Z, truth.Accel[2]*sensors.LSM303ACCEL_GRAVITY_EARTH, tolerance)
+			if last.When != now || samples[0].When != now-int64(n-1)*int64(time.Second/100) {
+				fmt.Printf("FAIL accel fifo (burst %v): samples stamped %v to %v, read at %v\n", burst, samples[0].When, last.When, now)
+				failures++
+			}
+		}
+	}
+
+	magnetometer, err := sensors.NewLSM303MAGOnBus(bus)
+	if err != nil {
+		fmt.Printf("Error: getting device LSM303MAG, err=%v\n", err)
+		return
+	}
+	gains := []byte{
+		sensors.LSM303MAG_GAIN_1_3, sensors.LSM303MAG_GAIN_1_9, sensors.LSM303MAG_GAIN_2_5,
+		sensors.LSM303MAG_GAIN_4_0, sensors.LSM303MAG_GAIN_4_7, sensors.LSM303MAG_GAIN_5_6,
+		sensors.LSM303MAG_GAIN_8_1,
+	}
+	for _, gain := range gains {
+		// the gain applies from the next measurement
+		err = magnetometer.SetGain(gain)
+		if err == nil {
+			err = magnetometer.WaitReady(100 * time.Millisecond)
+		}
+		x, y, z, err := magnetometer.ReadXYZ()
+		if err != nil {
+			fmt.Printf("Error: reading magnetometer, err=%v\n", err)
+			return
+		}
+		// gauss to microtesla, within one LSB at the coarsest gain
+		truth := magEmu.Truth()
+		check(fmt.Sprintf("mag x (gain 0x%02X)", gain), x, truth.Field[0]*100, 0.5)
+		check(fmt.Sprintf("mag y (gain 0x%02X)", gain), y, truth.Field[1]*100, 0.5)
+		check(fmt.Sprintf("mag z (gain 0x%02X)", gain), z, truth.Field[2]*100, 0.5)
+	}
+
+	for _, rate := range sensors.LSM303MAGDataRates {
+		config := sensors.LSM303MAGConfig{DataRate: rate, Gain: sensors.LSM303MAG_GAIN_1_9, Mode: sensors.LSM303MAG_MODE_CONTINUOUS}
+		if err = magnetometer.Configure(config); err != nil {
+			fmt.Printf("Error: configuring magnetometer, err=%v\n", err)
+			return
+		}
+		if readBack, err := magnetometer.ReadConfig(); err != nil || readBack != config {
+			fmt.Printf("FAIL mag config: read back %+v, %v, want %+v\n", readBack, err, config)
+			failures++
+		}
+		if ready, err := magnetometer.DataReady(); err != nil || !ready {
+			fmt.Printf("FAIL mag data ready in continuous mode: %v, %v\n", ready, err)
+			failures++
+		}
+	}
+	if (sensors.LSM303MAGConfig{DataRate: 10, Gain: sensors.LSM303MAG_GAIN_1_3}).Validate() == nil {
+		fmt.Printf("FAIL mag config: 10Hz should be invalid\n")
+		failures++
+	}
+
+	// A single measurement, from sleep
+	err = magnetometer.Configure(sensors.LSM303MAGConfig{DataRate: 15, Gain: sensors.LSM303MAG_GAIN_1_3, Mode: sensors.LSM303MAG_MODE_SLEEP})
+	if err == nil {
+		_, _, _, err = magnetometer.ReadXYZ() // the last continuous measurement
+	}
+	if err != nil {
+		fmt.Printf("Error: putting the magnetometer to sleep, err=%v\n", err)
+		return
+	}
+	if ready, err := magnetometer.DataReady(); err != nil || ready {
+		fmt.Printf("FAIL mag data ready asleep: %v, %v\n", ready, err)
+		failures++
+	}
+	if x, y, z, err := magnetometer.ReadSingle(10 * time.Millisecond); err != nil {
+		fmt.Printf("FAIL mag single measurement: %v\n", err)
+		failures++
+	} else {
+		truth := magEmu.Truth()
+		check("mag single x", x, truth.Field[0]*100, 0.5)
+		check("mag single y", y, truth.Field[1]*100, 0.5)
+		check("mag single z", z, truth.Field[2]*100, 0.5)
+	}
+	if err = magnetometer.WaitReady(5 * time.Millisecond); !errors.Is(err, sensors.ErrNotReady) {
+		fmt.Printf("FAIL mag wait ready asleep: got %v, want ErrNotReady\n", err)
+		failures++
+	}
+
+	// A field too strong for the finest gains steps the gain up, 3 gauss
+	// overflows X at 1.3 and 1.9 gauss and fits at 2.5
+	strongEmu := emulator.NewLSM303MAG(emulator.Still{Field: [3]float32{3, 0.2, -0.4}})
+	strongBus := i2c.NewFakeBus()
+	strongBus.Attach(sensors.LSM303MAG_ADDR, strongEmu)
+	strongMagnetometer, err := sensors.NewLSM303MAGOnBus(strongBus)
+	if err != nil {
+		fmt.Printf("Error: getting device LSM303MAG, err=%v\n", err)
+		return
+	}
+	overflows := 0
+	for i := 0; i < len(sensors.LSM303MAGGains); i++ {
+		x, y, z, err := strongMagnetometer.ReadXYZ()
+		if errors.Is(err, sensors.ErrOverflow) {
+			overflows++
+			// what's read before a measurement at the new gain isn't scaled with it
+			if _, _, _, err = strongMagnetometer.ReadXYZ(); !errors.Is(err, sensors.ErrNotReady) {
+				fmt.Printf("FAIL mag overflow: read at the old gain, err=%v\n", err)
+				failures++
+			}
+			if err = strongMagnetometer.WaitReady(100 * time.Millisecond); err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			fmt.Printf("Error: reading magnetometer, err=%v\n", err)
+			return
+		}
+		check("strong mag x", x, 300, 0.5)
+		check("strong mag y", y, 20, 0.5)
+		check("strong mag z", z, -40, 0.5)
+		break
+	}
+	if config, err := strongMagnetometer.ReadConfig(); overflows != 2 || err != nil || config.Gain != sensors.LSM303MAG_GAIN_2_5 {
+		fmt.Printf("FAIL mag overflow: %v overflows, gain 0x%02X, want 2, 0x%02X\n", overflows, config.Gain, sensors.LSM303MAG_GAIN_2_5)
+		failures++
+	}
+
+	// Warm up from 10 to 50 degrees C over 40 seconds, with the gyroscope
+	// and magnetometer biases drifting as it does
+	warming := emulator.MotionFunc(func(t time.Duration) (s emulator.Sample) {
+		s.Temp = 10 + float32(t.Seconds())
+		d := s.Temp - 25
+		s.Rate = [3]float32{0.5 + 0.05*d, -0.03 * d, 0.02 * d}
+		s.Field = [3]float32{0.2 + 0.002*d, -0.1, -0.4 - 0.001*d}
+		return
+	})
+	warmGyroEmu := emulator.NewL3GD20(warming)
+	warmMagEmu := emulator.NewLSM303MAG(warming)
+	warmBus := i2c.NewFakeBus()
+	warmBus.Attach(sensors.L3GD20_ADDR, warmGyroEmu)
+	warmBus.Attach(sensors.LSM303MAG_ADDR, warmMagEmu)
+	warmGyroscope, err := sensors.NewL3GD20OnBus(warmBus)
+	if err != nil {
+		fmt.Printf("Error: getting device L3GD20, err=%v\n", err)
+		return
+	}
+	warmMagnetometer, err := sensors.NewLSM303MAGOnBus(warmBus)
+	if err != nil {
+		fmt.Printf("Error: getting device LSM303MAG, err=%v\n", err)
+		return
+	}
+	thermometers := []struct {
+		name    string
+		sensor  sensors.Triaxial
+		reads   int     // to warm up by 20 degrees
+		temp    float32 // degrees C per digit
+		slope   [3]float32
+		want    func(s emulator.Sample) [3]float32 // what the sensor should read, uncompensated
+		truth   func() emulator.Sample
+		residue float32 // what's left after compensation
+	}{
+		{"gyro", warmGyroscope, 95 * 20, 1, [3]float32{0.05, -0.03, 0.02},
+			func(s emulator.Sample) [3]float32 { return s.Rate },
+			warmGyroEmu.Truth, 0.1},
+		// the temperature is read every TEMP_REFRESH readings, 3 seconds
+		// and degrees apart at 15Hz, so the compensation lags behind
+		{"mag", warmMagnetometer, 15 * 20, 1.0 / sensors.LSM303MAG_TEMP_LSB_PER_DEG, [3]float32{0.2, 0, -0.1},
+			func(s emulator.Sample) [3]float32 {
+				return [3]float32{s.Field[0] * 100, s.Field[1] * 100, s.Field[2] * 100}
+			}, warmMagEmu.Truth, 0.8},
+	}
+	for _, th := range thermometers {
+		thermometer := th.sensor.(sensors.Thermometer)
+		var readings []sensors.TempReading
+		for i := 0; i < th.reads; i++ {
+			x, y, z, err := th.sensor.ReadXYZ()
+			if err == nil {
+				var temp float32
+				if temp, err = thermometer.ReadCelsius(); err == nil {
+					check(th.name+" temperature", temp, th.truth().Temp, th.temp)
+					readings = append(readings, sensors.TempReading{Temp: temp, X: x, Y: y, Z: z})
+				}
+			}
+			if err != nil {
+				fmt.Printf("Error: logging %s temperature, err=%v\n", th.name, err)
+				return
+			}
+		}
+		model, err := sensors.FitTempModel(readings)
+		if err != nil {
+			fmt.Printf("Error: fitting %s temperature model, err=%v\n", th.name, err)
+			return
+		}
+		for axis := 0; axis < 3; axis++ {
+			check(fmt.Sprintf("%s temperature slope %v", th.name, axis), model.Slope[axis], th.slope[axis], 0.01)
+		}
+
+		// The next 20 degrees, compensated, leaves what doesn't drift.
+		// The temperature's refreshed as samples are measured.
+		thermometer.SetTempModel(&model)
+		for i := 0; i < th.reads; i++ {
+			err := th.sensor.Measure()
+			var x, y, z float32
+			if err == nil {
+				x, y, z, err = th.sensor.Evaluate()
+			}
+			if err != nil {
+				fmt.Printf("Error: reading %s, err=%v\n", th.name, err)
+				return
+			}
+			truth := th.truth()
+			want := th.want(truth)
+			d := truth.Temp - model.Reference
+			check(th.name+" compensated x", x, want[0]-th.slope[0]*d-model.Offset[0], th.residue)
+			check(th.name+" compensated y", y, want[1]-th.slope[1]*d-model.Offset[1], th.residue)
+			check(th.name+" compensated z", z, want[2]-th.slope[2]*d-model.Offset[2], th.residue)
+		}
+		thermometer.SetTempModel(nil)
+	}
+	if err = warmGyroscope.CalibrateTemperature(100); err != nil {
+		fmt.Printf("Error: calibrating the gyroscope's temperature, err=%v\n", err)
+		return
+	}
+	if temp, err := warmGyroscope.ReadCelsius(); err != nil || temp != 100 {
+		fmt.Printf("FAIL gyro temperature calibration: read %v, %v, want 100\n", temp, err)
+		failures++
+	}
+
+	// Mounted differently, the drivers read in the board's axes: the
+	// gyroscope yawed a quarter turn, the accelerometer upside down, where
+	// level reads -1g on its Z, and the magnetometer with X and Y swapped
+	yawed, err := sensors.Rotation(0, 0, 90)
+	if err != nil || yawed != (sensors.Orientation{{0, -1, 0}, {1, 0, 0}, {0, 0, 1}}) {
+		fmt.Printf("FAIL yaw 90: got %v, %v\n", yawed, err)
+		failures++
+	}
+	upsideDown, _ := sensors.Rotation(180, 0, 0)
+	swapped, err := sensors.CustomOrientation([3][3]float32{{0, 1, 0}, {1, 0, 0}, {0, 0, 1}})
+	if err != nil {
+		fmt.Printf("FAIL swapped orientation: %v\n", err)
+		failures++
+	}
+	if _, err = sensors.Rotation(45, 0, 0); err == nil {
+		fmt.Printf("FAIL 45 degree rotation accepted\n")
+		failures++
+	}
+	if _, err = sensors.CustomOrientation([3][3]float32{{2, 0, 0}, {0, 1, 0}, {0, 0, 1}}); err == nil {
+		fmt.Printf("FAIL stretching orientation accepted\n")
+		failures++
+	}
+	mounted := emulator.Still{Rate: [3]float32{10, -20, 30}, Accel: [3]float32{0, 0, -1}, Field: [3]float32{0.2, -0.1, -0.4}}
+	mountedBus := i2c.NewFakeBus()
+	mountedBus.Attach(sensors.L3GD20_ADDR, emulator.NewL3GD20(mounted))
+	mountedBus.Attach(sensors.LSM303ACCEL_ADDR, emulator.NewLSM303ACCEL(mounted))
+	mountedBus.Attach(sensors.LSM303MAG_ADDR, emulator.NewLSM303MAG(mounted))
+	mountedGyroscope, err := sensors.NewL3GD20With(sensors.WithTransport(mountedBus), sensors.WithOrientation(yawed))
+	if err != nil {
+		fmt.Printf("Error: getting device L3GD20, err=%v\n", err)
+		return
+	}
+	mountedAccelerometer, err := sensors.NewLSM303ACCELWith(sensors.WithTransport(mountedBus), sensors.WithOrientation(upsideDown))
+	if err == nil {
+		err = mountedAccelerometer.Configure(sensors.LSM303ACCELConfig{DataRate: 100, Range: sensors.LSM303ACCEL_RANGE_2G, HighResolution: true})
+	}
+	if err != nil {
+		fmt.Printf("Error: getting device LSM303ACCEL, err=%v\n", err)
+		return
+	}
+	mountedMagnetometer, err := sensors.NewLSM303MAGWith(sensors.WithTransport(mountedBus), sensors.WithOrientation(swapped))
+	if err != nil {
+		fmt.Printf("Error: getting device LSM303MAG, err=%v\n", err)
+		return
+	}
+	for i := 0; i < 10; i++ {
+		mountedAccelerometer.Measure()
+	}
+	if err = mountedAccelerometer.ComputeBias(); err != nil {
+		fmt.Printf("Error: computing the mounted accelerometer's bias, err=%v\n", err)
+		return
+	}
+	mountings := []struct {
+		what      string
+		sensor    sensors.Triaxial
+		want      [3]float32
+		tolerance float32
+	}{
+		{"yawed gyro", mountedGyroscope, [3]float32{20, 10, 30}, sensors.L3GD20_SENSITIVITY_250DPS},
+		{"upside down accel", mountedAccelerometer, [3]float32{0, 0, sensors.LSM303ACCEL_GRAVITY_EARTH}, 0.02},
+		{"swapped mag", mountedMagnetometer, [3]float32{-10, 20, -40}, 0.5},
+	}
+	for _, m := range mountings {
+		x, y, z, err := m.sensor.ReadXYZ()
+		if err != nil {
+			fmt.Printf("Error: reading %s, err=%v\n", m.what, err)
+			return
+		}
+		check(m.what+" x", x, m.want[0], m.tolerance)
+		check(m.what+" y", y, m.want[1], m.tolerance)
+		check(m.what+" z", z, m.want[2], m.tolerance)
+	}
+
+	// Self-tests, of healthy chips and of damaged ones: a gyroscope axis
+	// that's come loose, an accelerometer that's lost its sensitivity and
+	// a magnetometer reading next to nothing
+	healthy := emulator.Still{Accel: [3]float32{0.1, -0.2, 0.98}, Field: [3]float32{0.2, -0.1, -0.4}}
+	damaged := emulator.Still{Accel: [3]float32{0, 0, 0.5}, Field: [3]float32{0.05, 0, 0}}
+	selfTests := []struct {
+		what     string
+		motion   emulator.Still
+		deadAxis byte // the register of an axis reading 0, 0 for none
+		pass     bool
+	}{
+		{"healthy", healthy, 0, true},
+		{"damaged", damaged, sensors.L3GD20_OUT_Y_L, false},
+	}
+	for _, st := range selfTests {
+		testBus := i2c.NewFakeBus()
+		testBus.Attach(sensors.L3GD20_ADDR, deadAxis{emulator.NewL3GD20(st.motion), st.deadAxis})
+		testBus.Attach(sensors.LSM303ACCEL_ADDR, emulator.NewLSM303ACCEL(st.motion))
+		testBus.Attach(sensors.LSM303MAG_ADDR, emulator.NewLSM303MAG(st.motion))
+		testGyroscope, err := sensors.NewL3GD20OnBus(testBus)
+		if err != nil {
+			fmt.Printf("Error: getting device L3GD20, err=%v\n", err)
+			return
+		}
+		testAccelerometer, err := sensors.NewLSM303ACCELOnBus(testBus)
+		if err != nil {
+			fmt.Printf("Error: getting device LSM303ACCEL, err=%v\n", err)
+			return
+		}
+		testMagnetometer, err := sensors.NewLSM303MAGOnBus(testBus)
+		if err != nil {
+			fmt.Printf("Error: getting device LSM303MAG, err=%v\n", err)
+			return
+		}
+		before, err := testGyroscope.ReadConfig()
+		if err != nil {
+			fmt.Printf("Error: reading gyroscope config, err=%v\n", err)
+			return
+		}
+		for _, tester := range []sensors.SelfTester{testGyroscope, testAccelerometer, testMagnetometer} {
+			report, err := tester.SelfTest()
+			hardware := tester.Name() == "L3GD20"
+			if err != nil || report.Pass != st.pass || report.Hardware != hardware || len(report.Checks) == 0 {
+				fmt.Printf("FAIL %s %s self-test: got %v, %v, want pass %v\n", st.what, tester.Name(), report, err, st.pass)
+				failures++
+			}
+		}
+		if after, err := testGyroscope.ReadConfig(); err != nil || after != before {
+			fmt.Printf("FAIL %s gyro self-test: left configured %+v, %v, was %+v\n", st.what, after, err, before)
+			failures++
+		}
+	}
+
+	// End to end, the read loop's summaries against the profile's truth,
+	// in the board's axes as io mounts the chips
+	truth := emulator.Sample{Rate: [3]float32{12, -34, 56}, Accel: [3]float32{0.1, -0.2, 0.97}, Field: [3]float32{0.2, -0.1, -0.4}}
+	loopBus := i2c.NewFakeBus()
+	loopBus.Attach(sensors.L3GD20_ADDR, emulator.NewL3GD20(emulator.Still(truth)))
+	loopBus.Attach(sensors.LSM303ACCEL_ADDR, emulator.NewLSM303ACCEL(emulator.Still(truth)))
+	loopBus.Attach(sensors.LSM303MAG_ADDR, emulator.NewLSM303MAG(emulator.Still(truth)))
+	var want [3][3]float32
+	want[0][0], want[0][1], want[0][2] = io.GYRO_ORIENTATION.Apply(truth.Rate[0], truth.Rate[1], truth.Rate[2])
+	want[1][0], want[1][1], want[1][2] = io.ACCEL_ORIENTATION.Apply(truth.Accel[0], truth.Accel[1], truth.Accel[2])
+	want[2][0], want[2][1], want[2][2] = io.MAG_ORIENTATION.Apply(truth.Field[0]*100, truth.Field[1]*100, truth.Field[2]*100)
+	sensorChannel := make(chan io.SensorData)
+	go io.ReadSensorsOn(loopBus, sensorChannel)
+	for i := 0; i < 20; i++ {
+		data, ok := <-sensorChannel
+		if !ok {
+			fmt.Printf("FAIL read loop: sensors stopped\n")
+			failures++
+			break
+		}
+		g := float32(sensors.GRAVITY_EARTH)
+		check("read loop gyro x", data.Gx, want[0][0], 0.05)
+		check("read loop gyro y", data.Gy, want[0][1], 0.05)
+		check("read loop gyro z", data.Gz, want[0][2], 0.05)
+		check("read loop accel x", data.Ax, want[1][0]*g, 0.05)
+		check("read loop accel y", data.Ay, want[1][1]*g, 0.05)
+		check("read loop accel z", data.Az, want[1][2]*g, 0.05)
+		check("read loop mag x", data.Mx, want[2][0], 0.5)
+		check("read loop mag y", data.My, want[2][1], 0.5)
+		check("read loop mag z", data.Mz, want[2][2], 0.5)
+	}
+
+	// Construction fails with the reason, and without a driver
+	absentBus := i2c.NewFakeBus()
+	absentBus.Attach(sensors.L3GD20_ADDR, emulator.NewLSM303ACCEL(motion))
+	absentBus.Attach(sensors.LSM303ACCEL_ADDR, stuckDevice{})
+	constructions := []struct {
+		what string
+		new  func() (interface{}, error)
+		kind error
+	}{
+		{"missing magnetometer", func() (interface{}, error) { return sensors.NewLSM303MAGOnBus(absentBus) }, sensors.ErrNotPresent},
+		{"accelerometer posing as gyroscope", func() (interface{}, error) { return sensors.NewL3GD20OnBus(absentBus) }, sensors.ErrWrongChip},
+		{"stuck accelerometer", func() (interface{}, error) { return sensors.NewLSM303ACCELOnBus(absentBus) }, sensors.ErrBus},
+	}
+	for _, c := range constructions {
+		driver, err := c.new()
+		var de *sensors.DriverError
+		if !errors.Is(err, c.kind) || !errors.As(err, &de) || !reflect.ValueOf(driver).IsNil() {
+			fmt.Printf("FAIL %s: got %v, %v, want a nil driver and %v\n", c.what, driver, err, c.kind)
+			failures++
+		}
+	}
+
+	if failures == 0 {
+		fmt.Printf("PASS\n")
+	} else {
+		fmt.Printf("%d failures\n", failures)
+	}
+}
+
+// A device with an axis that reads 0, the two bytes from reg
+type deadAxis struct {
+	i2c.FakeDevice
+	reg byte
+}
+
+func (d deadAxis) ReadRegisters(reg byte, data []byte) (err error) {
+	if err = d.FakeDevice.ReadRegisters(reg, data); err != nil || d.reg == 0 {
+		return
+	}
+	for i := range data {
+		if r := reg&0x7F + byte(i); r == d.reg || r == d.reg+1 {
+			data[i] = 0
+		}
+	}
+	return
+}
+
+// A device that never finishes a transaction
+type stuckDevice struct{}
+
+func (stuckDevice) ReadRegisters(reg byte, data []byte) error {
+	return i2c.ErrTimeout
+}
+
+func (stuckDevice) WriteRegisters(reg byte, data []byte) error {
+	return i2c.ErrTimeout
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"goPiCopter/imus"
 	"goPiCopter/io/sensors"
+	"goPiCopter/io/sensors/i2c"
 	"math"
+	"sort"
 	"time"
 )
 
@@ -14,7 +16,8 @@ import (
 * through the filter, and prints the computed
 * Yaw, Pitch, and Roll every 100 iterations.
 * Each iteration takes approximately 3 milliseconds
-* on a RaspberryPi model B.
+* on a RaspberryPi model B.  After every run of iterations
+* it also prints the i2c latencies of each device.
 **/
 func main() {
 	const (
@@ -22,10 +25,11 @@ func main() {
 		r2d = 180.0 / math.Pi // Used to convert radians to degrees
 	)
 	var (
-		gyroscope     *sensors.L3GD20      = nil
-		accelerometer *sensors.LSM303ACCEL = nil
-		magnetometer  *sensors.LSM303MAG   = nil
-		imu           *imus.ImuMayhony     = nil
+		gyroscope     sensors.Gyroscope     = nil
+		accelerometer sensors.Accelerometer = nil
+		magnetometer  sensors.Magnetometer  = nil
+		imu           *imus.ImuMayhony      = nil
+		bus           *i2c.I2CBus           = nil
 
 		err              error
 		dbgPrint         bool
@@ -53,6 +57,12 @@ func main() {
 		return
 	}
 
+	bus, err = i2c.Bus(1)
+	if err != nil {
+		fmt.Printf("Error: getting i2c bus, err=%v\n", err)
+		return
+	}
+
 	imu = imus.NewImuMayhony()
 
 	maxIterations := 10000
@@ -84,5 +94,32 @@ func main() {
 		finishTime := time.Now().UnixNano()
 		delta := finishTime - startTime
 		fmt.Printf("%4.2f milliseconds per iteration\n", (float64(delta)/float64(maxIterations))/1000000.0)
+		printLatencies(bus)
+	}
+}
+
+/**
+* Print, and then reset, the latency histograms for every device and
+* operation.  A gyroscope read starved by magnetometer reads shows a
+* long wait for the bus lock.
+**/
+func printLatencies(bus *i2c.I2CBus) {
+	latencies := bus.Latencies()
+	bus.ResetLatencies()
+
+	keys := make([]i2c.LatencyKey, 0, len(latencies))
+	for key := range latencies {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Addr != keys[j].Addr {
+			return keys[i].Addr < keys[j].Addr
+		}
+		return keys[i].Op < keys[j].Op
+	})
+	for _, key := range keys {
+		l := latencies[key]
+		fmt.Printf("  0x%02X %-14s wait %v\n", key.Addr, key.Op, l.Wait.String())
+		fmt.Printf("  0x%02X %-14s bus  %v\n", key.Addr, key.Op, l.Bus.String())
 	}
 }
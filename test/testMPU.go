@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"goPiCopter/io"
+	"goPiCopter/io/sensors"
+	"goPiCopter/io/sensors/emulator"
+	"goPiCopter/io/sensors/i2c"
+	"math"
+	"strings"
+	"time"
+)
+
+/**
+* Run the MPU-6050 and MPU-9250 drivers against their emulators on a
+* fake i2c bus: the ranges, the configuration, the bias, the FIFO through
+* a combined transaction and through block reads and after it overflows,
+* the MPU-9250's AK8963 through the bypass, and the read loop with the
+* MPU in place of the Adafruit board.
+**/
+func main() {
+	var (
+		err      error
+		failures int
+	)
+
+	// Rotate about Z, slowly rolling over, in a 0.45 gauss field
+	motion := emulator.MotionFunc(func(t time.Duration) (s emulator.Sample) {
+		secs := float32(t.Seconds())
+		s.Rate = [3]float32{10, -20, 90 + 10*secs}
+		s.Accel = [3]float32{0, 0.1 * secs, 1}
+		s.Field = [3]float32{0.2, -0.1, -0.4}
+		s.Temp = 30
+		return
+	})
+
+	check := func(what string, got, want, tolerance float32) {
+		if math.Abs(float64(got-want)) > float64(tolerance) {
+			fmt.Printf("FAIL %s: got %v, want %v\n", what, got, want)
+			failures++
+		}
+	}
+
+	mpuEmu := emulator.NewMPU6050(motion)
+	bus := i2c.NewFakeBus()
+	bus.Attach(sensors.MPU6050_ADDR, mpuEmu)
+
+	mpu, err := sensors.NewMPU6050OnBus(bus)
+	if err != nil {
+		fmt.Printf("Error: getting device MPU6050, err=%v\n", err)
+		return
+	}
+	if id, err := mpu.Identity(); err != nil || id.Driver != "MPU6050" {
+		fmt.Printf("FAIL MPU6050 identity: %+v, err=%v\n", id, err)
+		failures++
+	}
+	identifies := func(bus i2c.Transport, model string) {
+		ids := sensors.Identify(bus, sensors.MPU6050_ADDR)
+		if len(ids) != 1 || ids[0].Driver != "MPU6050" || !strings.HasSuffix(ids[0].Detail, model) {
+			fmt.Printf("FAIL %s identified as %+v\n", model, ids)
+			failures++
+		}
+	}
+	identifies(bus, "MPU6050")
+	if _, err = sensors.NewMPU9250OnBus(bus); !errors.Is(err, sensors.ErrWrongChip) {
+		fmt.Printf("FAIL MPU9250 driver on an MPU6050: err=%v\n", err)
+		failures++
+	}
+	if _, err = mpu.Magnetometer(); err == nil {
+		fmt.Printf("FAIL MPU6050 has a magnetometer\n")
+		failures++
+	}
+	if deg, err := mpu.ReadCelsius(); err != nil {
+		fmt.Printf("Error: reading MPU6050 temperature, err=%v\n", err)
+		failures++
+	} else {
+		check("MPU6050 temperature", deg, 30, 0.01)
+	}
+
+	// Every range, what's read against the truth to within a digit
+	gyroscope, accelerometer := mpu.Gyroscope(), mpu.Accelerometer()
+	for r := byte(0); r < 4; r++ {
+		config := sensors.DefaultMPU6050Config
+		config.GyroRange, config.AccelRange = r, r
+		if err = mpu.Configure(config); err != nil {
+			fmt.Printf("Error: configuring MPU6050 range %v, err=%v\n", r, err)
+			return
+		}
+		gyroDigit := 1 / sensors.MPU6050GyroSensitivities[r]
+		accelDigit := sensors.GRAVITY_EARTH / sensors.MPU6050AccelSensitivities[r]
+		for i := 0; i < 20; i++ {
+			x, y, z, err := gyroscope.ReadXYZ()
+			if err != nil {
+				fmt.Printf("Error: reading MPU6050 gyroscope, err=%v\n", err)
+				return
+			}
+			truth := mpuEmu.Truth()
+			check("mpu gyro x", x, truth.Rate[0], gyroDigit)
+			check("mpu gyro y", y, truth.Rate[1], gyroDigit)
+			check("mpu gyro z", z, truth.Rate[2], gyroDigit)
+			x, y, z, err = accelerometer.ReadXYZ()
+			if err != nil {
+				fmt.Printf("Error: reading MPU6050 accelerometer, err=%v\n", err)
+				return
+			}
+			truth = mpuEmu.Truth()
+			check("mpu accel x", x, truth.Accel[0]*sensors.GRAVITY_EARTH, accelDigit)
+			check("mpu accel y", y, truth.Accel[1]*sensors.GRAVITY_EARTH, accelDigit)
+			check("mpu accel z", z, truth.Accel[2]*sensors.GRAVITY_EARTH, accelDigit)
+		}
+	}
+
+	// The configuration reads back, and one the chip can't do isn't written
+	config := sensors.MPU6050Config{SampleRate: 200, DLPF: sensors.MPU6050_DLPF_98HZ, GyroRange: sensors.MPU6050_GYRO_RANGE_1000DPS, AccelRange: sensors.MPU6050_ACCEL_RANGE_8G}
+	if err = mpu.Configure(config); err != nil {
+		fmt.Printf("Error: configuring MPU6050, err=%v\n", err)
+		return
+	}
+	if got, err := mpu.ReadConfig(); err != nil || got != config {
+		fmt.Printf("FAIL MPU6050 config: read back %+v, want %+v, err=%v\n", got, config, err)
+		failures++
+	}
+	invalid := config
+	invalid.SampleRate = 300 // doesn't divide 1kHz
+	if err = mpu.Configure(invalid); err == nil {
+		fmt.Printf("FAIL MPU6050 config: 300Hz accepted\n")
+		failures++
+	}
+	if got, _ := mpu.ReadConfig(); got != config {
+		fmt.Printf("FAIL MPU6050 config: invalid config written, read back %+v\n", got)
+		failures++
+	}
+
+	// The bias, still and level, leaves gravity on Z
+	stillEmu := emulator.NewMPU6050(emulator.Still{Rate: [3]float32{1.5, -2, 3}, Accel: [3]float32{0.05, -0.02, 1.03}})
+	stillBus := i2c.NewFakeBus()
+	stillBus.Attach(sensors.MPU6050_ADDR, stillEmu)
+	still, err := sensors.NewMPU6050OnBus(stillBus)
+	if err != nil {
+		fmt.Printf("Error: getting device MPU6050, err=%v\n", err)
+		return
+	}
+	for i := 0; i < 20; i++ {
+		still.Gyroscope().Measure()
+		still.Accelerometer().Measure()
+	}
+	if err = still.Gyroscope().ComputeBias(); err == nil {
+		err = still.Accelerometer().ComputeBias()
+	}
+	if err != nil {
+		fmt.Printf("Error: computing MPU6050 bias, err=%v\n", err)
+		return
+	}
+	gx, gy, gz, _ := still.Gyroscope().ReadXYZ()
+	ax, ay, az, _ := still.Accelerometer().ReadXYZ()
+	check("mpu biased gyro x", gx, 0, 0.01)
+	check("mpu biased gyro y", gy, 0, 0.01)
+	check("mpu biased gyro z", gz, 0, 0.01)
+	check("mpu biased accel x", ax, 0, 0.01)
+	check("mpu biased accel y", ay, 0, 0.01)
+	check("mpu biased accel z", az, sensors.GRAVITY_EARTH, 0.01)
+
+	// The FIFO, through a combined transaction and through block reads on
+	// a bus that can't do them, on a clock the test drives
+	for _, burst := range []bool{true, false} {
+		var (
+			elapsed time.Duration
+			samples [sensors.MPU6050_FIFO_READ_SAMPLES]sensors.MPU6050Sample
+			fifoBus i2c.Transport
+		)
+		fifoEmu := emulator.NewMPU6050(motion)
+		fifoEmu.SetClock(func() time.Duration { return elapsed })
+		fifoBus = i2c.NewFakeBus()
+		fifoBus.(*i2c.FakeBus).Attach(sensors.MPU6050_ADDR, fifoEmu)
+		if !burst {
+			fifoBus = struct{ i2c.Transport }{fifoBus}
+		}
+		fifoMPU, err := sensors.NewMPU6050OnBus(fifoBus)
+		if err == nil {
+			err = fifoMPU.EnableFIFO()
+		}
+		if err != nil {
+			fmt.Printf("Error: enabling the MPU6050 FIFO, err=%v\n", err)
+			return
+		}
+		reads := []struct {
+			advance time.Duration
+			n       int
+			overrun bool
+		}{
+			{100 * time.Millisecond, 10, false}, // 100Hz
+			{50 * time.Millisecond, 5, false},
+			{500 * time.Millisecond, sensors.MPU6050_FIFO_READ_SAMPLES, false}, // 50 waiting
+			{0, 10, false},
+			{2 * time.Second, 0, true}, // 2400 bytes
+			{100 * time.Millisecond, 10, false},
+			{200 * time.Millisecond, 20, false},
+		}
+		for _, r := range reads {
+			elapsed += r.advance
+			now := int64(elapsed)
+			n, overrun, err := fifoMPU.ReadFIFO(now, samples[:])
+			if err != nil {
+				fmt.Printf("Error: reading the MPU6050 FIFO, err=%v\n", err)
+				return
+			}
+			if n != r.n || overrun != r.overrun {
+				fmt.Printf("FAIL mpu fifo (burst %v): read %v samples, overrun %v, want %v, %v\n", burst, n, overrun, r.n, r.overrun)
+				failures++
+				continue
+			}
+			// every sample lines up, after the overrun too
+			for _, sample := range samples[:n] {
+				check("mpu fifo sample gyro x", sample.Gyro[0], 10, 0.05)
+				check("mpu fifo sample gyro y", sample.Gyro[1], -20, 0.05)
+				check("mpu fifo sample accel z", sample.Accel[2], sensors.GRAVITY_EARTH, 0.01)
+			}
+			if n == 0 || r.advance == 500*time.Millisecond {
+				// the newest samples are still waiting
+				continue
+			}
+			truth := fifoEmu.Truth()
+			last := samples[n-1]
+			check("mpu fifo gyro z", last.Gyro[2], truth.Rate[2], 1/sensors.MPU6050GyroSensitivities[sensors.MPU6050_GYRO_RANGE_500DPS])
+			check("mpu fifo accel y", last.Accel[1], truth.Accel[1]*sensors.GRAVITY_EARTH, 0.01)
+			if last.When != now || samples[0].When != now-int64(n-1)*int64(time.Second/100) {
+				fmt.Printf("FAIL mpu fifo (burst %v): samples stamped %v to %v, read at %v\n", burst, samples[0].When, last.When, now)
+				failures++
+			}
+		}
+		// MeasureFIFO takes samples for both views
+		elapsed += 100 * time.Millisecond
+		if n, _, err := fifoMPU.Gyroscope().MeasureFIFO(int64(elapsed)); err != nil || n != 10 {
+			fmt.Printf("FAIL mpu MeasureFIFO (burst %v): %v samples, err=%v\n", burst, n, err)
+			failures++
+		}
+		if _, _, _, err := fifoMPU.Accelerometer().Evaluate(); err != nil {
+			fmt.Printf("FAIL mpu MeasureFIFO (burst %v): no accelerometer samples, err=%v\n", burst, err)
+			failures++
+		}
+	}
+
+	// The MPU-9250's AK8963, only on the host's bus with the bypass on
+	mpu9250Emu := emulator.NewMPU9250(motion)
+	bus9250 := i2c.NewFakeBus()
+	bus9250.Attach(sensors.MPU6050_ADDR, mpu9250Emu)
+	bus9250.Attach(sensors.AK8963_ADDR, mpu9250Emu.Bypass())
+	mpu9250, err := sensors.NewMPU9250OnBus(bus9250)
+	if err != nil {
+		fmt.Printf("Error: getting device MPU9250, err=%v\n", err)
+		return
+	}
+	identifies(bus9250, "MPU9250")
+	if _, err = sensors.NewAK8963OnBus(bus9250); !errors.Is(err, sensors.ErrNotPresent) {
+		fmt.Printf("FAIL AK8963 answered without the bypass: err=%v\n", err)
+		failures++
+	}
+	magnetometer, err := mpu9250.Magnetometer()
+	if err != nil {
+		fmt.Printf("Error: getting device AK8963, err=%v\n", err)
+		return
+	}
+	for i := 0; i < 20; i++ {
+		x, y, z, err := magnetometer.ReadXYZ()
+		if err != nil {
+			fmt.Printf("Error: reading AK8963, err=%v\n", err)
+			return
+		}
+		// in the MPU's axes, in microtesla
+		truth := motion.At(0)
+		check("ak8963 x", x, truth.Field[0]*100, 0.2)
+		check("ak8963 y", y, truth.Field[1]*100, 0.2)
+		check("ak8963 z", z, truth.Field[2]*100, 0.2)
+	}
+	strongEmu := emulator.NewMPU9250(emulator.Still{Field: [3]float32{30, 30, 0}})
+	strongBus := i2c.NewFakeBus()
+	strongBus.Attach(sensors.MPU6050_ADDR, strongEmu)
+	strongBus.Attach(sensors.AK8963_ADDR, strongEmu.Bypass())
+	strong, err := sensors.NewMPU9250OnBus(strongBus)
+	if err == nil {
+		var strongMag *sensors.AK8963
+		if strongMag, err = strong.Magnetometer(); err == nil {
+			_, _, _, err = strongMag.ReadXYZ()
+		}
+	}
+	if !errors.Is(err, sensors.ErrOverflow) {
+		fmt.Printf("FAIL AK8963 in a 6000uT field: err=%v\n", err)
+		failures++
+	}
+
+	// The read loop, on the MPU-9250 in place of the Adafruit board
+	loopEmu := emulator.NewMPU9250(emulator.Still{Rate: [3]float32{0, 0, 30}, Accel: [3]float32{0, 0, 1}, Field: [3]float32{0.2, -0.1, -0.4}})
+	loopBus := i2c.NewFakeBus()
+	loopBus.Attach(sensors.MPU6050_ADDR, loopEmu)
+	loopBus.Attach(sensors.AK8963_ADDR, loopEmu.Bypass())
+	io.SENSOR_BOARD = io.BOARD_MPU9250
+	sensorChannel := make(chan io.SensorData)
+	go io.ReadSensorsOn(loopBus, sensorChannel)
+	for i := 0; i < 20; i++ {
+		data, ok := <-sensorChannel
+		if !ok {
+			fmt.Printf("FAIL mpu9250 board: sensors stopped\n")
+			failures++
+			break
+		}
+		check("mpu9250 board gyro z", data.Gz, 30, 0.05)
+		check("mpu9250 board accel z", data.Az, sensors.GRAVITY_EARTH, 0.01)
+		check("mpu9250 board mag x", data.Mx, 20, 0.2)
+	}
+
+	if failures == 0 {
+		fmt.Printf("PASS\n")
+	} else {
+		fmt.Printf("%d failures\n", failures)
+	}
+}
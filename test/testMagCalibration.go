@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"goPiCopter/io/sensors"
+	"goPiCopter/io/sensors/emulator"
+	"goPiCopter/io/sensors/i2c"
+	"math"
+	"math/rand"
+	"time"
+)
+
+/**
+* Fit the magnetometer's hard and soft iron calibration to synthetic
+* readings, a 45 microtesla field seen through iron that offsets and bends
+* it, and check the calibration takes the distortion back out.  Then do
+* the same through the driver, turning the emulated magnetometer through
+* every direction with the iron on the emulator, and in a field too
+* strong for the finest gain.
+**/
+func main() {
+	var failures int
+
+	check := func(what string, got, want, tolerance float32) {
+		if math.Abs(float64(got-want)) > float64(tolerance) {
+			fmt.Printf("FAIL %s: got %v, want %v\n", what, got, want)
+			failures++
+		}
+	}
+
+	// Symmetric, so the correction doesn't rotate the field as well
+	softIron := [3][3]float32{{1.2, 0.1, 0.05}, {0.1, 0.9, -0.08}, {0.05, -0.08, 1.05}}
+	hardIron := [3]float32{12, -30, 8}
+	distort := func(field [3]float32) (out [3]float32) {
+		for axis := 0; axis < 3; axis++ {
+			m := softIron[axis]
+			out[axis] = m[0]*field[0] + m[1]*field[1] + m[2]*field[2] + hardIron[axis]
+		}
+		return
+	}
+	// the calibration keeps the volume, so the field it finds is scaled by
+	// the cube root of the soft iron's determinant
+	det := softIron[0][0]*(softIron[1][1]*softIron[2][2]-softIron[1][2]*softIron[2][1]) -
+		softIron[0][1]*(softIron[1][0]*softIron[2][2]-softIron[1][2]*softIron[2][0]) +
+		softIron[0][2]*(softIron[1][0]*softIron[2][1]-softIron[1][1]*softIron[2][0])
+	scale := float32(math.Cbrt(float64(det)))
+
+	// Evenly spread directions, and a field of 45 in each
+	directions := fibonacciSphere(300)
+	random := rand.New(rand.NewSource(1))
+	var samples [][3]float32
+	for _, d := range directions {
+		s := distort([3]float32{45 * d[0], 45 * d[1], 45 * d[2]})
+		for axis := range s {
+			s[axis] += float32(random.NormFloat64() * 0.2)
+		}
+		samples = append(samples, s)
+	}
+	fit, err := sensors.FitMagCalibration(samples)
+	if err != nil {
+		fmt.Printf("Error: fitting the magnetometer calibration, err=%v\n", err)
+		return
+	}
+	for axis := 0; axis < 3; axis++ {
+		check(fmt.Sprintf("hard iron %v", axis), fit.Offset[axis], hardIron[axis], 0.2)
+	}
+	check("field", fit.Field, 45*scale, 0.2)
+	check("residual", fit.Residual, 0, 0.4)
+	check("coverage", fit.Coverage, 1, 0.05)
+	for i, d := range directions {
+		x, y, z := fit.Apply(samples[i][0], samples[i][1], samples[i][2])
+		check("calibrated x", x, 45*scale*d[0], 1)
+		check("calibrated y", y, 45*scale*d[1], 1)
+		check("calibrated z", z, 45*scale*d[2], 1)
+	}
+
+	// Turned through only a few directions the fit either fails or
+	// says it can't be trusted
+	var few [][3]float32
+	for i, d := range directions {
+		if d[2] > 0.7 {
+			few = append(few, samples[i])
+		}
+	}
+	if fit, err := sensors.FitMagCalibration(few); err == nil && fit.Coverage > 0.25 {
+		fmt.Printf("FAIL partial coverage: coverage %v\n", fit.Coverage)
+		failures++
+	}
+	if _, err := sensors.FitMagCalibration(samples[:8]); err == nil {
+		fmt.Printf("FAIL 8 samples: fitted\n")
+		failures++
+	}
+
+	// Through the driver, a direction for each measurement at 15Hz
+	motion := emulator.MotionFunc(func(t time.Duration) (s emulator.Sample) {
+		d := directions[int(math.Round(t.Seconds()*15))%len(directions)]
+		s.Field = [3]float32{0.45 * d[0], 0.45 * d[1], 0.45 * d[2]}
+		return
+	})
+	magEmu := emulator.NewLSM303MAG(motion)
+	magEmu.SetIron([3]float32{hardIron[0] / 100, hardIron[1] / 100, hardIron[2] / 100}, softIron)
+	bus := i2c.NewFakeBus()
+	bus.Attach(sensors.LSM303MAG_ADDR, magEmu)
+	magnetometer, err := sensors.NewLSM303MAGOnBus(bus)
+	if err != nil {
+		fmt.Printf("Error: getting device LSM303MAG, err=%v\n", err)
+		return
+	}
+	if fit, err = magnetometer.Calibrate(len(directions), 0); err != nil {
+		fmt.Printf("Error: calibrating the magnetometer, err=%v\n", err)
+		return
+	}
+	check("driver coverage", fit.Coverage, 1, 0.05)
+	check("driver residual", fit.Residual, 0, 0.4)
+	for i := 0; i < 100; i++ {
+		x, y, z, err := magnetometer.ReadXYZ()
+		if err != nil {
+			fmt.Printf("Error: reading magnetometer, err=%v\n", err)
+			return
+		}
+		field := magEmu.Truth().Field
+		check("driver calibrated x", x, field[0]*100*scale, 1)
+		check("driver calibrated y", y, field[1]*100*scale, 1)
+		check("driver calibrated z", z, field[2]*100*scale, 1)
+	}
+	// Without it the driver reads the distorted field
+	magnetometer.SetCalibration(nil)
+	x, y, z, err := magnetometer.ReadXYZ()
+	if err != nil {
+		fmt.Printf("Error: reading magnetometer, err=%v\n", err)
+		return
+	}
+	field := magEmu.Truth().Field
+	distorted := distort([3]float32{field[0] * 100, field[1] * 100, field[2] * 100})
+	check("driver uncalibrated x", x, distorted[0], 0.5)
+	check("driver uncalibrated y", y, distorted[1], 0.5)
+	check("driver uncalibrated z", z, distorted[2], 0.5)
+
+	// A 2 gauss field overflows at the finest gain, the gain's stepped up
+	// and the calibration carries on at the next
+	strongEmu := emulator.NewLSM303MAG(emulator.MotionFunc(func(t time.Duration) (s emulator.Sample) {
+		s = motion.At(t)
+		s.Field = [3]float32{s.Field[0] / 0.45 * 2, s.Field[1] / 0.45 * 2, s.Field[2] / 0.45 * 2}
+		return
+	}))
+	strongBus := i2c.NewFakeBus()
+	strongBus.Attach(sensors.LSM303MAG_ADDR, strongEmu)
+	strongMagnetometer, err := sensors.NewLSM303MAGOnBus(strongBus)
+	if err != nil {
+		fmt.Printf("Error: getting device LSM303MAG, err=%v\n", err)
+		return
+	}
+	if fit, err = strongMagnetometer.Calibrate(len(directions), 0); err != nil {
+		fmt.Printf("FAIL calibrating in a strong field: err=%v\n", err)
+		failures++
+	} else {
+		check("strong field", fit.Field, 200, 1)
+		check("strong field coverage", fit.Coverage, 1, 0.05)
+	}
+
+	if failures == 0 {
+		fmt.Printf("PASS\n")
+	} else {
+		fmt.Printf("%d failures\n", failures)
+	}
+}
+
+// Return n directions spread evenly over the sphere
+func fibonacciSphere(n int) (directions [][3]float32) {
+	golden := math.Pi * (3 - math.Sqrt(5))
+	for i := 0; i < n; i++ {
+		z := 1 - (float64(i)+0.5)*2/float64(n)
+		r := math.Sqrt(1 - z*z)
+		theta := golden * float64(i)
+		directions = append(directions, [3]float32{float32(r * math.Cos(theta)), float32(r * math.Sin(theta)), float32(z)})
+	}
+	return
+}
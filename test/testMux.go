@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"goPiCopter/io/sensors/i2c"
+)
+
+/**
+* Put two TCA9548A muxes on a FakeBus, with a chip at the same address
+* behind three of their channels, and check each channel reaches its own
+* chip.  Switching to a channel switches the other mux off, and a mux
+* is only written when its channel changes.  Then reset a mux behind the
+* driver's back and check the channel recovers after the failed read.
+**/
+func main() {
+	const (
+		addr  = 0x6B
+		whoAm = 0x0F
+	)
+	var failures int
+
+	check := func(what string, ok bool) {
+		if !ok {
+			fmt.Printf("FAIL %s\n", what)
+			failures++
+		}
+	}
+	read := func(what string, bus i2c.Transport, want byte) {
+		data := make([]byte, 1)
+		if err := i2c.ReadBlockInto(bus, addr, whoAm, data); err != nil {
+			fmt.Printf("FAIL %s: err=%v\n", what, err)
+			failures++
+		} else {
+			check(fmt.Sprintf("%s: read 0x%02X, want 0x%02X", what, data[0], want), data[0] == want)
+		}
+	}
+
+	fb := i2c.NewFakeBus()
+	fakeA := i2c.NewFakeTCA9548A()
+	fakeB := i2c.NewFakeTCA9548A()
+	fb.Attach(i2c.TCA9548A_ADDR, fakeA)
+	fb.Attach(i2c.TCA9548A_ADDR+1, fakeB)
+	chips := make([]*i2c.RegisterFile, 3)
+	for i := range chips {
+		chips[i] = i2c.NewRegisterFile()
+		chips[i].Registers[whoAm] = 0xD0 + byte(i)
+	}
+	fakeA.Attach(0, addr, chips[0])
+	fakeA.Attach(3, addr, chips[1])
+	fakeB.Attach(1, addr, chips[2])
+
+	// Nothing answers until a channel is enabled
+	muxA, err := i2c.NewTCA9548A(fb, i2c.TCA9548A_ADDR)
+	if err != nil {
+		fmt.Printf("Error: setting up mux A, err=%v\n", err)
+		return
+	}
+	muxB, err := i2c.NewTCA9548A(fb, i2c.TCA9548A_ADDR+1)
+	if err != nil {
+		fmt.Printf("Error: setting up mux B, err=%v\n", err)
+		return
+	}
+	check("mux A starts with every channel disabled", fakeA.Control() == 0)
+	check("mux B starts with every channel disabled", fakeB.Control() == 0)
+	_, err = fb.ReadByteBlock(addr, whoAm, 1)
+	check("nothing answers with every channel disabled", err != nil)
+	_, err = i2c.NewTCA9548A(fb, i2c.TCA9548A_ADDR+2)
+	check("no mux where nothing is attached", err != nil)
+	_, err = muxA.Channel(i2c.TCA9548A_CHANNELS)
+	check("no channel past the last", err != nil)
+
+	a0, _ := muxA.Channel(0)
+	a3, _ := muxA.Channel(3)
+	b1, _ := muxB.Channel(1)
+
+	// Channel switching
+	read("mux A channel 0", a0, 0xD0)
+	check("mux A enables channel 0", fakeA.Control() == 0x01)
+	read("mux A channel 3", a3, 0xD1)
+	check("mux A enables channel 3", fakeA.Control() == 0x08)
+	switches := fakeA.Switches()
+	read("mux A channel 3 again", a3, 0xD1)
+	check("mux A isn't written when its channel doesn't change", fakeA.Switches() == switches)
+	if err = a3.WriteByte(addr, 0x20, 0x0F); err != nil {
+		fmt.Printf("FAIL writing through mux A channel 3: err=%v\n", err)
+		failures++
+	}
+	check("the write reaches only the chip behind channel 3", chips[1].Registers[0x20] == 0x0F && chips[0].Registers[0x20] == 0)
+
+	// Switching the other mux off, the chips would both answer otherwise
+	read("mux B channel 1", b1, 0xD2)
+	check("mux B enables channel 1", fakeB.Control() == 0x02)
+	check("mux A is switched off", fakeA.Control() == 0)
+	data := make([]byte, 1)
+	if err = i2c.ReadRegisters(a0, addr, whoAm, data); err != nil || data[0] != 0xD0 {
+		fmt.Printf("FAIL transfer through mux A channel 0: read 0x%02X, err=%v\n", data[0], err)
+		failures++
+	}
+	check("mux B is switched off", fakeB.Control() == 0)
+	check("mux A enables channel 0 for the transfer", fakeA.Control() == 0x01)
+
+	// Recovery after a failure, the mux forgets its channel
+	fakeA.Reset()
+	_, err = a0.ReadByteBlock(addr, whoAm, 1)
+	check("reading after the mux was reset fails", err != nil)
+	read("mux A channel 0 after the failure", a0, 0xD0)
+	check("mux A enables channel 0 again", fakeA.Control() == 0x01)
+
+	if failures == 0 {
+		fmt.Printf("PASS\n")
+	} else {
+		fmt.Printf("%d failures\n", failures)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"goPiCopter/io/sensors"
+	"goPiCopter/io/sensors/emulator"
+	"goPiCopter/io/sensors/i2c"
+	"goPiCopter/io/sensors/spi"
+	"testing"
+)
+
+/**
+* Benchmark the sensor read path, reporting the time and allocations
+* per read.  ReadByteBlock allocates the slice it returns, everything
+* reading into a caller supplied buffer, and the drivers' Measure,
+* shouldn't allocate at all.  Runs against the emulated chips, and
+* against the real bus as well when there's a /dev/i2c-1 with an
+* L3GD20 on it.
+**/
+func main() {
+	var failures int
+
+	motion := emulator.Still{Rate: [3]float32{1, 2, 3}, Accel: [3]float32{0, 0, 1}, Field: [3]float32{0.2, -0.1, -0.4}}
+	fake := i2c.NewFakeBus()
+	fake.Attach(sensors.L3GD20_ADDR, emulator.NewL3GD20(motion))
+
+	sched := i2c.NewScheduler(fake)
+	defer sched.Close()
+	client := sched.Client(i2c.PRIORITY_HIGH, 0)
+
+	spiBus := spi.NewBus(spi.NewFakeConn(emulator.NewL3GD20(motion)))
+
+	gyroscope, err := sensors.NewL3GD20OnBus(fake)
+	if err != nil {
+		fmt.Printf("Error: getting device L3GD20, err=%v\n", err)
+		return
+	}
+	scheduledGyroscope, err := sensors.NewL3GD20OnBus(client)
+	if err != nil {
+		fmt.Printf("Error: getting device L3GD20 on the scheduler, err=%v\n", err)
+		return
+	}
+
+	fifoBus := i2c.NewFakeBus()
+	fifoBus.Attach(sensors.L3GD20_ADDR, emulator.NewL3GD20(motion))
+	fifoGyroscope, err := sensors.NewL3GD20OnBus(fifoBus)
+	if err == nil {
+		err = fifoGyroscope.EnableFIFO()
+	}
+	if err != nil {
+		fmt.Printf("Error: enabling the L3GD20 FIFO, err=%v\n", err)
+		return
+	}
+
+	fifoBus.Attach(sensors.LSM303ACCEL_ADDR, emulator.NewLSM303ACCEL(motion))
+	fifoAccelerometer, err := sensors.NewLSM303ACCELOnBus(fifoBus)
+	if err == nil {
+		err = fifoAccelerometer.EnableFIFO()
+	}
+	if err != nil {
+		fmt.Printf("Error: enabling the LSM303ACCEL FIFO, err=%v\n", err)
+		return
+	}
+
+	fifoBus.Attach(sensors.MPU6050_ADDR, emulator.NewMPU6050(motion))
+	fifoMPU, err := sensors.NewMPU6050OnBus(fifoBus)
+	if err == nil {
+		err = fifoMPU.EnableFIFO()
+	}
+	if err != nil {
+		fmt.Printf("Error: enabling the MPU6050 FIFO, err=%v\n", err)
+		return
+	}
+
+	mpuEmu := emulator.NewMPU9250(motion)
+	fake.Attach(sensors.MPU6050_ADDR, mpuEmu)
+	fake.Attach(sensors.AK8963_ADDR, mpuEmu.Bypass())
+	mpu, err := sensors.NewMPU9250OnBus(fake)
+	if err != nil {
+		fmt.Printf("Error: getting device MPU9250, err=%v\n", err)
+		return
+	}
+	ak8963, err := mpu.Magnetometer()
+	if err != nil {
+		fmt.Printf("Error: getting device AK8963, err=%v\n", err)
+		return
+	}
+
+	fake.Attach(sensors.LSM303MAG_ADDR, emulator.NewLSM303MAG(motion))
+	magnetometer, err := sensors.NewLSM303MAGOnBus(fake)
+	if err != nil {
+		fmt.Printf("Error: getting device LSM303MAG, err=%v\n", err)
+		return
+	}
+	calibration := sensors.IdentityMagCalibration()
+	magnetometer.SetCalibration(&calibration)
+
+	buffer := make([]byte, 6)
+	readInto := func(bus i2c.Transport) func(b *testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := i2c.ReadBlockInto(bus, sensors.L3GD20_ADDR, sensors.L3GD20_OUT_X_L|0x80, buffer); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+	measure := func(sensor sensors.Triaxial) func(b *testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := sensor.Measure(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			sensor.Evaluate()
+		}
+	}
+	measureFIFO := func(sensor sensors.Buffered) func(b *testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := sensor.MeasureFIFO(0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+
+	benchmarks := []struct {
+		name      string
+		allocates bool // expected to allocate
+		bench     func(b *testing.B)
+	}{
+		{"FakeBus ReadByteBlock", true, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := fake.ReadByteBlock(sensors.L3GD20_ADDR, sensors.L3GD20_OUT_X_L|0x80, 6); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}},
+		{"FakeBus ReadBlockInto", false, readInto(fake)},
+		{"Scheduler ReadBlockInto", false, readInto(client)},
+		{"SPI ReadBlockInto", false, readInto(spiBus)},
+		{"L3GD20 Measure", false, measure(gyroscope)},
+		{"L3GD20 Measure, scheduled", false, measure(scheduledGyroscope)},
+		{"L3GD20 MeasureFIFO", false, measureFIFO(fifoGyroscope)},
+		{"LSM303ACCEL MeasureFIFO", false, measureFIFO(fifoAccelerometer)},
+		{"MPU9250 gyroscope Measure", false, measure(mpu.Gyroscope())},
+		{"MPU9250 accelerometer Measure", false, measure(mpu.Accelerometer())},
+		{"MPU6050 MeasureFIFO", false, measureFIFO(fifoMPU.Gyroscope())},
+		{"AK8963 Measure", false, measure(ak8963)},
+		{"LSM303MAG ReadXYZ, calibrated", false, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, _, err := magnetometer.ReadXYZ(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}},
+	}
+
+	if bus, err := i2c.Bus(1); err == nil {
+		if _, err = bus.ReadByteBlock(sensors.L3GD20_ADDR, sensors.L3GD20_WHO_AM_I, 1); err == nil {
+			benchmarks = append(benchmarks, struct {
+				name      string
+				allocates bool
+				bench     func(b *testing.B)
+			}{"I2CBus ReadBlockInto", false, readInto(bus)})
+		}
+	}
+
+	for _, bm := range benchmarks {
+		result := testing.Benchmark(bm.bench)
+		fmt.Printf("%-28s %s %s\n", bm.name, result.String(), result.MemString())
+		if !bm.allocates && result.AllocsPerOp() != 0 {
+			fmt.Printf("FAIL %s: %v allocations per read\n", bm.name, result.AllocsPerOp())
+			failures++
+		}
+	}
+
+	if failures == 0 {
+		fmt.Printf("PASS\n")
+	} else {
+		fmt.Printf("%d failures\n", failures)
+	}
+}